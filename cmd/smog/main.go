@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/ethanpil/smog/internal/app"
 	"github.com/ethanpil/smog/internal/auth"
@@ -19,6 +23,13 @@ var (
 	silent     bool
 )
 
+// Flags for the auth commands
+var (
+	loginDevice bool
+	revokeLocal bool
+	statusJSON  bool
+)
+
 var rootCmd = &cobra.Command{
 	Use:   "smog",
 	Short: "smog is a simple smtp relay for gmail",
@@ -86,6 +97,10 @@ var authCmd = &cobra.Command{
 var loginCmd = &cobra.Command{
 	Use:   "login",
 	Short: "authenticates with gmail",
+	Long: `Authorizes smog to send mail with a Google account. By default the Google
+sign-in page is opened in a browser. If no browser can be opened, the page is
+opened on any other machine and the URL it redirects to is pasted back.
+With --device, a code is entered on another device instead.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		cfg, err := config.LoadConfig(configPath)
 		if err != nil {
@@ -94,7 +109,7 @@ var loginCmd = &cobra.Command{
 		}
 		// Auth command should be verbose by default to guide the user.
 		logger := log.New(log.LevelVerbose, cfg.LogPath, true)
-		if err := auth.Login(logger, &cfg); err != nil {
+		if err := auth.Login(logger, &cfg, auth.LoginOptions{Device: loginDevice}); err != nil {
 			logger.Error("failed to authenticate", "err", err)
 			os.Exit(1)
 		}
@@ -104,6 +119,10 @@ var loginCmd = &cobra.Command{
 var revokeCmd = &cobra.Command{
 	Use:   "revoke",
 	Short: "revokes gmail authentication",
+	Long: `Revokes smog's access to the Google account at Google and securely deletes
+the stored token and its backup. If Google cannot be reached, the token files
+are kept; --local-only deletes them without contacting Google, which leaves
+the access granted until it is removed in the Google account settings.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		cfg, err := config.LoadConfig(configPath)
 		if err != nil {
@@ -112,13 +131,109 @@ var revokeCmd = &cobra.Command{
 		}
 		// Auth command should be verbose by default to guide the user.
 		logger := log.New(log.LevelVerbose, cfg.LogPath, true)
-		if err := auth.RevokeToken(logger, &cfg); err != nil {
+		if err := auth.RevokeToken(logger, &cfg, auth.RevokeOptions{LocalOnly: revokeLocal}); err != nil {
 			logger.Error("failed to revoke token", "err", err)
 			os.Exit(1)
 		}
 	},
 }
 
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "shows the state of the stored gmail authorization",
+	Long: `Shows the Google account the stored token belongs to, the granted scopes,
+the expiry of the access token, whether a refresh token is present and a
+refresh works right now, and the permissions of the token file. Exits with
+status 1 if a problem is found, so that monitoring scripts can run it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.LoadConfig(configPath)
+		if err != nil {
+			fmt.Printf("Error: failed to load configuration: %v\n", err)
+			os.Exit(1)
+		}
+		// Logs would get in the way of the output, which scripts may parse.
+		logger := log.New(log.LevelDisabled, "", false)
+		if verbose {
+			logger = log.New(log.LevelVerbose, "", true)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		status, err := auth.TokenStatus(ctx, logger, &cfg)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if statusJSON {
+			jsonOutput, err := json.MarshalIndent(status, "", "  ")
+			if err != nil {
+				fmt.Printf("Error: failed to display status: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println(string(jsonOutput))
+		} else {
+			printTokenStatus(status)
+		}
+		if !status.OK() {
+			os.Exit(1)
+		}
+	},
+}
+
+// printTokenStatus prints a token status for people.
+func printTokenStatus(status *auth.Status) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if status.TokenFound {
+		fmt.Fprintf(w, "Token file:\t%s (mode %s)\n", status.TokenPath, status.FileMode)
+	} else {
+		fmt.Fprintf(w, "Token file:\t%s (not found)\n", status.TokenPath)
+	}
+	if status.TokenFound {
+		account := status.Account
+		if account == "" {
+			account = "unknown"
+			if status.AccountNote != "" {
+				account += " (" + status.AccountNote + ")"
+			}
+		}
+		fmt.Fprintf(w, "Account:\t%s\n", account)
+		if len(status.Scopes) > 0 {
+			fmt.Fprintf(w, "Scopes:\t%s\n", strings.Join(status.Scopes, ", "))
+		}
+		if len(status.MissingScopes) > 0 {
+			fmt.Fprintf(w, "Missing scopes:\t%s\n", strings.Join(status.MissingScopes, ", "))
+		}
+		if status.AccessTokenExpiry != nil {
+			expiry := status.AccessTokenExpiry.Local().Format(time.RFC1123)
+			if status.AccessTokenExpiry.Before(time.Now()) {
+				expiry += " (expired)"
+			}
+			fmt.Fprintf(w, "Access token expires:\t%s\n", expiry)
+		}
+		refreshToken := "missing"
+		if status.HasRefreshToken {
+			refreshToken = "present"
+		}
+		fmt.Fprintf(w, "Refresh token:\t%s\n", refreshToken)
+		refresh := status.Refresh
+		if refresh == auth.RefreshNotAttempted {
+			refresh = "n/a (no refresh token)"
+		}
+		fmt.Fprintf(w, "Refresh:\t%s\n", refresh)
+	}
+	w.Flush()
+
+	if status.OK() {
+		fmt.Println("\nNo problems found.")
+		return
+	}
+	fmt.Println("\nProblems:")
+	for _, p := range status.Problems {
+		fmt.Printf("  - %s\n", p)
+	}
+}
+
 var configCmd = &cobra.Command{
 	Use:   "config",
 	Short: "configures the smtp relay",
@@ -174,9 +289,14 @@ func init() {
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging to console")
 	rootCmd.PersistentFlags().BoolVarP(&silent, "silent", "s", false, "Disable all logging")
 
+	loginCmd.Flags().BoolVar(&loginDevice, "device", false, "Authorize by entering a code on another device")
+	revokeCmd.Flags().BoolVar(&revokeLocal, "local-only", false, "Only delete the stored token, without revoking it at Google")
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print the status as JSON")
+
 	// Add subcommands
 	authCmd.AddCommand(loginCmd)
 	authCmd.AddCommand(revokeCmd)
+	authCmd.AddCommand(statusCmd)
 	configCmd.AddCommand(createCmd)
 	configCmd.AddCommand(showCmd)
 	rootCmd.AddCommand(serveCmd)
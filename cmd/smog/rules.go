@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/ethanpil/smog/internal/log"
+	"github.com/ethanpil/smog/internal/message"
+	"github.com/ethanpil/smog/internal/rules"
+	"github.com/spf13/cobra"
+)
+
+// Flags for the rules test command
+var (
+	rulesClientIP string
+	rulesUser     string
+	rulesFrom     string
+	rulesTo       []string
+)
+
+var rulesCmd = &cobra.Command{
+	Use:   "rules",
+	Short: "works with the header rewriting rules",
+}
+
+var rulesTestCmd = &cobra.Command{
+	Use:   "test <file.eml>",
+	Short: "shows the headers of a message after the rules are applied",
+	Long: `Applies the [[Rule]] tables of the configuration to a message file and prints
+the rules that matched and the resulting header. The envelope sender and
+recipients default to the addresses in the From, To and Cc headers.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.LoadConfig(configPath)
+		if err != nil {
+			fmt.Printf("Error: failed to load configuration: %v\n", err)
+			os.Exit(1)
+		}
+		logger := log.New(log.LevelMinimal, cfg.LogPath, verbose)
+
+		engine, err := rules.New(logger, cfg.Rules)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		header, err := message.ReadHeader(bufio.NewReader(f))
+		if err != nil {
+			fmt.Printf("Error: failed to read message header: %v\n", err)
+			os.Exit(1)
+		}
+
+		env := rules.Envelope{User: rulesUser, From: rulesFrom, To: rulesTo}
+		if rulesClientIP != "" {
+			if env.ClientIP = net.ParseIP(rulesClientIP); env.ClientIP == nil {
+				fmt.Printf("Error: %q is not an IP address\n", rulesClientIP)
+				os.Exit(1)
+			}
+		}
+		if env.From == "" {
+			if addrs := headerAddresses(header, "From"); len(addrs) > 0 {
+				env.From = addrs[0]
+			}
+		}
+		if len(env.To) == 0 {
+			env.To = headerAddresses(header, "To", "Cc")
+		}
+
+		applied := engine.Apply(env, header)
+		if len(applied) == 0 {
+			fmt.Println("No rules matched.")
+		} else {
+			fmt.Printf("Matched rules: %s\n", strings.Join(applied, ", "))
+		}
+		fmt.Println()
+		header.WriteTo(os.Stdout)
+	},
+}
+
+// headerAddresses returns the addresses in the named header fields, skipping
+// fields that cannot be parsed.
+func headerAddresses(header *message.Header, names ...string) []string {
+	var addrs []string
+	for _, name := range names {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		list, err := mail.ParseAddressList(strings.Join(values, ", "))
+		if err != nil {
+			continue
+		}
+		for _, addr := range list {
+			addrs = append(addrs, addr.Address)
+		}
+	}
+	return addrs
+}
+
+func init() {
+	rulesTestCmd.Flags().StringVar(&rulesClientIP, "ip", "", "Client IP address to match Subnets against")
+	rulesTestCmd.Flags().StringVar(&rulesUser, "user", "", "Authenticated username to match Users against")
+	rulesTestCmd.Flags().StringVar(&rulesFrom, "from", "", "Envelope sender (default: the From header address)")
+	rulesTestCmd.Flags().StringSliceVar(&rulesTo, "to", nil, "Envelope recipient (repeatable; default: the To and Cc header addresses)")
+
+	rulesCmd.AddCommand(rulesTestCmd)
+	rootCmd.AddCommand(rulesCmd)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/ethanpil/smog/internal/log"
+	"github.com/ethanpil/smog/internal/policy"
+	"github.com/ethanpil/smog/internal/users"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// Flags for the user commands
+var (
+	userHash           string
+	userAllowedSenders []string
+	userMaxRecipients  int
+)
+
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "manages smtp user accounts",
+	Long: `Manages the SMTP accounts stored in the users file (UsersPath).
+Passwords are read from the terminal, or from standard input when it is not a
+terminal, and are never accepted as arguments.`,
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add <username>",
+	Short: "adds a user account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openUserStore()
+		// Check the patterns before asking for a password.
+		if err := policy.ValidatePatterns(userAllowedSenders); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		password, err := readNewPassword()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		hash, err := users.HashPassword(password, userHash)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		user := users.User{
+			Name:           args[0],
+			PasswordHash:   hash,
+			AllowedSenders: userAllowedSenders,
+			MaxRecipients:  userMaxRecipients,
+		}
+		if err := store.Add(user); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		saveUserStore(store)
+		fmt.Printf("User %q added.\n", user.Name)
+	},
+}
+
+var userRemoveCmd = &cobra.Command{
+	Use:   "remove <username>",
+	Short: "removes a user account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openUserStore()
+		if err := store.Remove(args[0]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		saveUserStore(store)
+		fmt.Printf("User %q removed.\n", args[0])
+	},
+}
+
+var userPasswdCmd = &cobra.Command{
+	Use:   "passwd <username>",
+	Short: "changes the password of a user account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openUserStore()
+		user, ok := store.Get(args[0])
+		if !ok {
+			fmt.Printf("Error: %v: %s\n", users.ErrUserNotFound, args[0])
+			os.Exit(1)
+		}
+
+		password, err := readNewPassword()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		user.PasswordHash, err = users.HashPassword(password, userHash)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := store.Update(user); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		saveUserStore(store)
+		fmt.Printf("Password for %q changed.\n", user.Name)
+	},
+}
+
+var userListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "lists the user accounts",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		store := openUserStore()
+		list := store.List()
+		if len(list) == 0 {
+			fmt.Println("No users.")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "USER\tALLOWED SENDERS\tMAX RECIPIENTS")
+		for _, u := range list {
+			senders := "any"
+			if len(u.AllowedSenders) > 0 {
+				senders = strings.Join(u.AllowedSenders, ", ")
+			}
+			limit := "default"
+			if u.MaxRecipients > 0 {
+				limit = fmt.Sprint(u.MaxRecipients)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", u.Name, senders, limit)
+		}
+		w.Flush()
+	},
+}
+
+// openUserStore loads the configuration and the users file it points to.
+func openUserStore() *users.Store {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		fmt.Printf("Error: failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+	logger := log.New(log.LevelMinimal, cfg.LogPath, verbose)
+
+	store, err := users.Load(logger, cfg.UsersPath)
+	if err != nil {
+		fmt.Printf("Error: failed to load users: %v\n", err)
+		os.Exit(1)
+	}
+	return store
+}
+
+func saveUserStore(store *users.Store) {
+	if err := store.Save(); err != nil {
+		fmt.Printf("Error: failed to save users: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// readNewPassword reads a password. On a terminal the password is prompted
+// for twice without echo; otherwise the first line of standard input is used.
+func readNewPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if password == "" {
+			return "", errors.New("password must not be empty")
+		}
+		return password, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	if len(first) == 0 {
+		return "", errors.New("password must not be empty")
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	if string(first) != string(second) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(first), nil
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{userAddCmd, userPasswdCmd} {
+		cmd.Flags().StringVar(&userHash, "hash", users.HashBcrypt, "Password hash algorithm: bcrypt or argon2id")
+	}
+	userAddCmd.Flags().StringSliceVar(&userAllowedSenders, "allow-sender", nil, "Sender the user may use, as an address, @domain or pattern such as *@example.com (repeatable; default any)")
+	userAddCmd.Flags().IntVar(&userMaxRecipients, "max-recipients", 0, "Maximum recipients per message (default: MaxRecipients)")
+
+	userCmd.AddCommand(userAddCmd)
+	userCmd.AddCommand(userRemoveCmd)
+	userCmd.AddCommand(userPasswdCmd)
+	userCmd.AddCommand(userListCmd)
+	rootCmd.AddCommand(userCmd)
+}
@@ -0,0 +1,274 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/ethanpil/smog/internal/gmail"
+	"github.com/ethanpil/smog/internal/spool"
+	gapi "google.golang.org/api/gmail/v1"
+)
+
+const (
+	// maxRetryInterval caps the exponential backoff between delivery attempts.
+	maxRetryInterval = time.Hour
+	// pollInterval is how often the spool is scanned for messages whose retry
+	// time has come.
+	pollInterval = time.Second
+)
+
+// deliveryQueue delivers spooled messages through the Gmail service using a
+// fixed pool of workers. Failed deliveries are retried with exponential backoff
+// until SpoolMaxAttempts is reached, after which the message is buried in the
+// spool's dead-letter directory. Messages Gmail rejects permanently are buried
+// right away.
+type deliveryQueue struct {
+	cfg   *config.Config
+	log   *slog.Logger
+	spool *spool.Spool
+	gmail gmail.Service
+
+	jobs chan *spool.Message
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+func newDeliveryQueue(cfg *config.Config, logger *slog.Logger, sp *spool.Spool, gmailService gmail.Service) *deliveryQueue {
+	return &deliveryQueue{
+		cfg:      cfg,
+		log:      logger,
+		spool:    sp,
+		gmail:    gmailService,
+		jobs:     make(chan *spool.Message),
+		inflight: make(map[string]bool),
+	}
+}
+
+// start launches the scheduler and the worker pool. They run until ctx is
+// canceled; wait blocks until all of them have returned.
+func (q *deliveryQueue) start(ctx context.Context) {
+	for i := 0; i < q.cfg.SpoolWorkers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.worker(ctx)
+		}()
+	}
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.schedule(ctx)
+	}()
+
+	q.log.Info("delivery queue started", "path", q.cfg.SpoolPath, "workers", q.cfg.SpoolWorkers)
+}
+
+// wait blocks until the scheduler and all workers have stopped.
+func (q *deliveryQueue) wait() {
+	q.wg.Wait()
+}
+
+// schedule periodically scans the spool and hands due messages to the workers.
+func (q *deliveryQueue) schedule(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		q.dispatchDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.spool.Ready():
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *deliveryQueue) dispatchDue(ctx context.Context) {
+	msgs, err := q.spool.Pending()
+	if err != nil {
+		q.log.Error("failed to scan delivery queue", "err", err)
+		return
+	}
+
+	now := time.Now()
+	for _, msg := range msgs {
+		// Pending is ordered by NextAttempt, so nothing after this is due either.
+		if msg.NextAttempt.After(now) {
+			return
+		}
+		if !q.claim(msg.ID) {
+			continue
+		}
+		select {
+		case q.jobs <- msg:
+		case <-ctx.Done():
+			q.release(msg.ID)
+			return
+		}
+	}
+}
+
+func (q *deliveryQueue) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-q.jobs:
+			q.deliver(ctx, msg)
+			q.release(msg.ID)
+		}
+	}
+}
+
+// deliver makes a single delivery attempt and records its outcome in the spool.
+func (q *deliveryQueue) deliver(ctx context.Context, msg *spool.Message) {
+	sentMsg, err := q.send(ctx, msg)
+	if err == nil {
+		q.log.Info("message relayed successfully",
+			"id", msg.ID,
+			"client_ip", msg.ClientIP,
+			"from", msg.From,
+			"to", msg.To,
+			"attempts", msg.Attempts+1,
+			"message_id", sentMsg.Id,
+		)
+		if err := q.spool.Remove(msg); err != nil {
+			q.log.Error("failed to remove delivered message from queue", "id", msg.ID, "err", err)
+		}
+		return
+	}
+
+	// Recipients that already received the message must not get it again.
+	var partial *gmail.PartialError
+	if errors.As(err, &partial) {
+		msg.To = remainingRecipients(msg.To, partial.Delivered)
+		q.log.Warn("message delivered to some recipients only", "id", msg.ID, "delivered", partial.Delivered, "remaining", msg.To)
+	}
+
+	// A shutdown interrupting the send is not the message's fault.
+	if ctx.Err() != nil {
+		q.log.Info("delivery interrupted by shutdown, message stays queued", "id", msg.ID)
+		if partial != nil {
+			if err := q.spool.Update(msg); err != nil {
+				q.log.Error("failed to update queued message", "id", msg.ID, "err", err)
+			}
+		}
+		return
+	}
+
+	msg.Attempts++
+	msg.LastError = err.Error()
+
+	// A message whose data is gone cannot be delivered by trying again.
+	permanent := gmail.IsPermanent(err) || errors.Is(err, errMissingData)
+	if permanent || msg.Attempts >= q.cfg.SpoolMaxAttempts {
+		q.log.Error("giving up on message, moving it to the dead-letter directory",
+			"id", msg.ID,
+			"from", msg.From,
+			"to", msg.To,
+			"attempts", msg.Attempts,
+			"permanent", permanent,
+			"err", err,
+		)
+		if err := q.spool.Bury(msg); err != nil {
+			q.log.Error("failed to move message to dead-letter directory", "id", msg.ID, "err", err)
+		}
+		return
+	}
+
+	delay := retryDelay(time.Duration(q.cfg.SpoolRetryInterval)*time.Second, msg.Attempts)
+	msg.NextAttempt = time.Now().Add(delay).UTC()
+	q.log.Warn("delivery failed, will retry",
+		"id", msg.ID,
+		"attempts", msg.Attempts,
+		"retry_in", delay.String(),
+		"err", err,
+	)
+	if err := q.spool.Update(msg); err != nil {
+		q.log.Error("failed to update queued message", "id", msg.ID, "err", err)
+	}
+}
+
+// errMissingData is returned by send when the data file of a queued message
+// does not exist.
+var errMissingData = errors.New("spooled message data is missing")
+
+// send opens the data of a queued message and sends it through Gmail.
+func (q *deliveryQueue) send(ctx context.Context, msg *spool.Message) (*gapi.Message, error) {
+	f, err := q.spool.Open(msg)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %v", errMissingData, err)
+		}
+		return nil, fmt.Errorf("failed to open spooled message: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat spooled message: %w", err)
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, time.Duration(q.cfg.SendTimeout)*time.Second)
+	defer cancel()
+	return q.gmail.Send(sendCtx, msg.To, gmail.ReaderAtSource(f, info.Size()))
+}
+
+// remainingRecipients returns the recipients that are not in delivered.
+func remainingRecipients(recipients, delivered []string) []string {
+	done := make(map[string]bool, len(delivered))
+	for _, rcpt := range delivered {
+		done[rcpt] = true
+	}
+	var remaining []string
+	for _, rcpt := range recipients {
+		if !done[rcpt] {
+			remaining = append(remaining, rcpt)
+		}
+	}
+	return remaining
+}
+
+// claim marks a message as being delivered so the scheduler does not hand it
+// out twice. It returns false if the message is already claimed.
+func (q *deliveryQueue) claim(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.inflight[id] {
+		return false
+	}
+	q.inflight[id] = true
+	return true
+}
+
+func (q *deliveryQueue) release(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inflight, id)
+}
+
+// retryDelay returns the backoff before the next attempt after the given number
+// of failed attempts: base, 2*base, 4*base, ... capped at maxRetryInterval.
+func retryDelay(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxRetryInterval {
+			return maxRetryInterval
+		}
+	}
+	if delay > maxRetryInterval {
+		return maxRetryInterval
+	}
+	return delay
+}
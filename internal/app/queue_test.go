@@ -0,0 +1,172 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/ethanpil/smog/internal/gmail"
+	"github.com/ethanpil/smog/internal/spool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gapi "google.golang.org/api/gmail/v1"
+)
+
+func TestRetryDelay(t *testing.T) {
+	base := time.Minute
+	assert.Equal(t, time.Minute, retryDelay(base, 1))
+	assert.Equal(t, 2*time.Minute, retryDelay(base, 2))
+	assert.Equal(t, 4*time.Minute, retryDelay(base, 3))
+	assert.Equal(t, maxRetryInterval, retryDelay(base, 20))
+	assert.Equal(t, maxRetryInterval, retryDelay(2*time.Hour, 1))
+}
+
+func TestDeliveryQueue_RetriesThenDelivers(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	sp, err := spool.New(logger, dir)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	calls := 0
+	delivered := make(chan string, 1)
+	mockGmail := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			if calls == 1 {
+				return nil, errors.New("temporary failure")
+			}
+			body, _ := io.ReadAll(rawEmail)
+			delivered <- string(body)
+			return &gapi.Message{Id: "sent-id"}, nil
+		},
+	}
+
+	cfg := &config.Config{SpoolPath: dir, SpoolWorkers: 1, SpoolMaxAttempts: 3, SpoolRetryInterval: 0}
+	q := newDeliveryQueue(cfg, logger, sp, mockGmail)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		q.wait()
+	}()
+	q.start(ctx)
+
+	require.NoError(t, sp.Enqueue(&spool.Message{To: []string{"rcpt@example.com"}}, strings.NewReader("Subject: hi\r\n\r\nbody")))
+
+	select {
+	case body := <-delivered:
+		assert.Contains(t, body, "body")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the queued message to be delivered")
+	}
+
+	// The delivered message must leave the queue.
+	require.Eventually(t, func() bool {
+		pending, err := sp.Pending()
+		return err == nil && len(pending) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestDeliveryQueue_BuriesAfterMaxAttempts(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	sp, err := spool.New(logger, dir)
+	require.NoError(t, err)
+
+	mockGmail := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			return nil, errors.New("permanent failure")
+		},
+	}
+
+	cfg := &config.Config{SpoolPath: dir, SpoolWorkers: 1, SpoolMaxAttempts: 2}
+	q := newDeliveryQueue(cfg, logger, sp, mockGmail)
+
+	msg := &spool.Message{To: []string{"rcpt@example.com"}}
+	require.NoError(t, sp.Enqueue(msg, strings.NewReader("data")))
+
+	ctx := context.Background()
+	q.deliver(ctx, msg)
+	pending, err := sp.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1, "message should stay queued after the first failure")
+	assert.Equal(t, 1, pending[0].Attempts)
+	assert.Equal(t, "permanent failure", pending[0].LastError)
+
+	q.deliver(ctx, pending[0])
+	pending, err = sp.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	_, err = os.Stat(filepath.Join(dir, "dead", msg.ID+".eml"))
+	assert.NoError(t, err, "message should have been moved to the dead-letter directory")
+}
+
+func TestDeliveryQueue_BuriesPermanentFailure(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	sp, err := spool.New(logger, dir)
+	require.NoError(t, err)
+
+	mockGmail := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			return nil, &gmail.Error{Kind: gmail.ErrInvalidRecipient, Status: 400, Err: errors.New("Invalid To header")}
+		},
+	}
+
+	cfg := &config.Config{SpoolPath: dir, SpoolWorkers: 1, SpoolMaxAttempts: 10}
+	q := newDeliveryQueue(cfg, logger, sp, mockGmail)
+
+	msg := &spool.Message{To: []string{"not-an-address"}}
+	require.NoError(t, sp.Enqueue(msg, strings.NewReader("data")))
+
+	q.deliver(context.Background(), msg)
+	pending, err := sp.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending, "a permanent failure must not be retried")
+
+	_, err = os.Stat(filepath.Join(dir, "dead", msg.ID+".eml"))
+	assert.NoError(t, err, "message should have been moved to the dead-letter directory")
+}
+
+func TestDeliveryQueue_BuriesMessageWithMissingData(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	sp, err := spool.New(logger, dir)
+	require.NoError(t, err)
+
+	mockGmail := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			t.Fatal("a message without data must not be sent")
+			return nil, nil
+		},
+	}
+
+	cfg := &config.Config{SpoolPath: dir, SpoolWorkers: 1, SpoolMaxAttempts: 10}
+	q := newDeliveryQueue(cfg, logger, sp, mockGmail)
+
+	msg := &spool.Message{To: []string{"to@example.com"}}
+	require.NoError(t, sp.Enqueue(msg, strings.NewReader("data")))
+	require.NoError(t, os.Remove(filepath.Join(dir, "queue", msg.ID+".eml")))
+
+	q.deliver(context.Background(), msg)
+	pending, err := sp.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending, "a message without data must not be retried")
+
+	dead, err := os.ReadFile(filepath.Join(dir, "dead", msg.ID+".json"))
+	require.NoError(t, err, "metadata should have been moved to the dead-letter directory")
+	assert.Contains(t, string(dead), `"attempts": 1`)
+	assert.Contains(t, string(dead), "spooled message data is missing")
+}
@@ -1,6 +1,9 @@
 package app
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -14,12 +17,14 @@ import (
 	"github.com/ethanpil/smog/internal/auth"
 	"github.com/ethanpil/smog/internal/config"
 	"github.com/ethanpil/smog/internal/gmail"
+	"github.com/ethanpil/smog/internal/rules"
 	smog_smtp "github.com/ethanpil/smog/internal/smtp"
-	"golang.org/x/oauth2"
+	"github.com/ethanpil/smog/internal/spool"
+	"github.com/ethanpil/smog/internal/tlsutil"
+	"github.com/ethanpil/smog/internal/users"
 )
 
 func Run(cfg *config.Config, logger *slog.Logger, gmailService gmail.Service) error {
-	var token *oauth2.Token
 	var err error
 
 	// If a specific gmail service isn't provided, create the default one.
@@ -27,47 +32,117 @@ func Run(cfg *config.Config, logger *slog.Logger, gmailService gmail.Service) er
 	if gmailService == nil {
 		logger.Debug("creating default google api client")
 		var httpClient *http.Client
-		httpClient, token, err = auth.GetClient(logger, cfg)
+		httpClient, err = auth.GetClient(logger, cfg)
 		if err != nil {
 			return fmt.Errorf("could not get google api client: %w", err)
 		}
-		gmailService = gmail.New(logger, httpClient)
+		gmailClient := gmail.New(logger, httpClient, cfg)
+		if cfg.RewriteFrom {
+			loadCtx, cancelLoad := context.WithTimeout(context.Background(), 30*time.Second)
+			err = gmailClient.LoadSendAs(loadCtx)
+			cancelLoad()
+			if err != nil {
+				return fmt.Errorf("could not load gmail send-as aliases: %w", err)
+			}
+		}
+		gmailService = gmailClient
 	} else {
-		// If a gmail service (likely a mock) is provided, we still need a placeholder token
-		// for the backend, although it may not be used by the mock.
 		logger.Debug("using provided gmail service")
-		token = &oauth2.Token{AccessToken: "fake-test-token"}
+	}
+
+	// If a spool directory is configured, accepted messages are queued on disk
+	// and delivered in the background instead of synchronously.
+	var sp *spool.Spool
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cfg.SpoolPath != "" {
+		sp, err = spool.New(logger, cfg.SpoolPath)
+		if err != nil {
+			return fmt.Errorf("could not open spool: %w", err)
+		}
+		queue := newDeliveryQueue(cfg, logger, sp, gmailService)
+		queue.start(ctx)
+		// Stop the queue however Run returns, including when a listener fails.
+		// Messages still in flight stay in the spool and are retried on the next start.
+		defer func() {
+			cancel()
+			queue.wait()
+		}()
+	}
+
+	// Accounts in the users file can authenticate alongside SMTPUser.
+	var userStore *users.Store
+	if cfg.UsersPath != "" {
+		userStore, err = users.Load(logger, cfg.UsersPath)
+		if err != nil {
+			return fmt.Errorf("could not load users: %w", err)
+		}
+	}
+
+	ruleEngine, err := rules.New(logger, cfg.Rules)
+	if err != nil {
+		return fmt.Errorf("could not load header rules: %w", err)
 	}
 
 	be := &smog_smtp.Backend{
 		Cfg:         cfg,
 		Log:         logger,
 		GmailClient: gmailService,
-		Token:       token,
+		Spool:       sp,
+		Users:       userStore,
+		Rules:       ruleEngine,
 	}
 
-	s := smtp.NewServer(be)
+	tlsConfig, err := tlsutil.NewConfig(logger, cfg)
+	if err != nil {
+		return fmt.Errorf("could not configure tls: %w", err)
+	}
+	if tlsConfig != nil {
+		logger.Info("tls enabled", "cert", cfg.TLSCertPath, "min_version", cfg.TLSMinVersion, "require_tls", cfg.RequireTLS)
+	}
 
-	s.Addr = fmt.Sprintf(":%d", cfg.SMTPPort)
-	s.Domain = "localhost"
-	s.ReadTimeout = time.Duration(cfg.ReadTimeout) * time.Second
-	s.WriteTimeout = time.Duration(cfg.WriteTimeout) * time.Second
-	s.MaxMessageBytes = int64(cfg.MessageSizeLimitMB) * 1024 * 1024
-	s.MaxRecipients = cfg.MaxRecipients
-	s.AllowInsecureAuth = cfg.AllowInsecureAuth
+	listeners := cfg.EffectiveListeners()
+	for _, l := range listeners {
+		if l.TLSMode != config.TLSModeNone && l.TLSMode != "" && tlsConfig == nil {
+			return fmt.Errorf("listener %s uses tls mode %q but no certificate is configured", l.Addr(), l.TLSMode)
+		}
+	}
+
+	// Channel to hold errors from the server goroutines
+	serverErrors := make(chan error, len(listeners))
 
-	// Channel to hold errors from the server goroutine
-	serverErrors := make(chan error, 1)
+	// Every listener gets its own server; they share the backend.
+	var servers []*smtp.Server
+	for _, l := range listeners {
+		s := newServer(cfg, be.ForListener(l), l, tlsConfig)
+		servers = append(servers, s)
+
+		// Goroutine to run the server
+		go func(l config.Listener) {
+			logger.Info("starting smog smtp relay", "address", s.Addr, "tls_mode", l.TLSMode, "require_auth", l.RequireAuth)
+			// `ListenAndServe` blocks until an error occurs. `ErrServerClosed` is expected
+			// on a graceful shutdown, so we ignore it.
+			var err error
+			if l.TLSMode == config.TLSModeImplicit {
+				err = s.ListenAndServeTLS()
+			} else {
+				err = s.ListenAndServe()
+			}
+			if err != nil && err != smtp.ErrServerClosed {
+				serverErrors <- fmt.Errorf("smtp server error on %s: %w", s.Addr, err)
+			}
+		}(l)
+	}
 
-	// Goroutine to run the server
-	go func() {
-		logger.Info("starting smog smtp relay", "address", s.Addr)
-		// `ListenAndServe` blocks until an error occurs. `ErrServerClosed` is expected
-		// on a graceful shutdown, so we ignore it.
-		if err := s.ListenAndServe(); err != nil && err != smtp.ErrServerClosed {
-			serverErrors <- fmt.Errorf("smtp server error: %w", err)
+	closeServers := func() error {
+		var errs []error
+		for _, srv := range servers {
+			if err := srv.Close(); err != nil {
+				errs = append(errs, err)
+			}
 		}
-	}()
+		return errors.Join(errs...)
+	}
 
 	// Wait for an interrupt signal or a server error
 	logger.Info("smog is running. press ctrl-c to exit.")
@@ -80,7 +155,7 @@ func Run(cfg *config.Config, logger *slog.Logger, gmailService gmail.Service) er
 		// This case handles errors during server startup or runtime.
 		logger.Error("server failed to start or encountered a fatal error", "err", err)
 		// Attempt a clean shutdown anyway, logging any further errors.
-		if closeErr := s.Close(); closeErr != nil {
+		if closeErr := closeServers(); closeErr != nil {
 			logger.Error("failed to close smtp server during error handling", "err", closeErr)
 		}
 		return err // Return the original error that caused the server to fail.
@@ -88,7 +163,7 @@ func Run(cfg *config.Config, logger *slog.Logger, gmailService gmail.Service) er
 	case sig := <-quit:
 		// This case handles a graceful shutdown signal from the OS.
 		logger.Info("shutting down smog smtp relay", "signal", sig.String())
-		if err := s.Close(); err != nil {
+		if err := closeServers(); err != nil {
 			// This error means the graceful shutdown failed.
 			return fmt.Errorf("failed to gracefully shutdown smtp server: %w", err)
 		}
@@ -97,3 +172,30 @@ func Run(cfg *config.Config, logger *slog.Logger, gmailService gmail.Service) er
 
 	return nil
 }
+
+// newServer creates an SMTP server for a listener using the connection limits
+// from the config. The TLS config is only attached if the listener uses TLS;
+// on a STARTTLS listener it makes the server advertise STARTTLS.
+func newServer(cfg *config.Config, be smtp.Backend, l config.Listener, tlsConfig *tls.Config) *smtp.Server {
+	s := smtp.NewServer(be)
+
+	s.Addr = l.Addr()
+	s.Domain = "localhost"
+	s.ReadTimeout = time.Duration(cfg.ReadTimeout) * time.Second
+	s.WriteTimeout = time.Duration(cfg.WriteTimeout) * time.Second
+	s.MaxMessageBytes = gmail.MessageSizeLimit(cfg.MessageSizeLimitMB)
+	s.MaxRecipients = cfg.MaxRecipients
+	s.AllowInsecureAuth = cfg.AllowInsecureAuth
+
+	switch l.TLSMode {
+	case config.TLSModeStartTLS:
+		s.TLSConfig = tlsConfig
+		if cfg.RequireTLS {
+			// AUTH is then only offered after STARTTLS. MAIL is refused by the session.
+			s.AllowInsecureAuth = false
+		}
+	case config.TLSModeImplicit:
+		s.TLSConfig = tlsConfig
+	}
+	return s
+}
@@ -3,27 +3,37 @@ package app
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/mail"
 	"net/smtp"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ethanpil/smog/internal/config"
 	"github.com/ethanpil/smog/internal/gmail"
+	"github.com/ethanpil/smog/internal/spool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"golang.org/x/oauth2"
 	gapi "google.golang.org/api/gmail/v1"
 	"google.golang.org/api/option"
 )
@@ -40,6 +50,32 @@ func getFreePort(t *testing.T) int {
 	return l.Addr().(*net.TCPAddr).Port
 }
 
+// writeTestCert writes a self-signed certificate and key for localhost into dir
+// and returns their paths.
+func writeTestCert(t *testing.T, dir string) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certPath, keyPath
+}
+
 // mockGmailService is a custom implementation of the gmail.Service that allows
 // us to intercept the Send call and redirect it to our httptest.Server.
 type mockGmailService struct {
@@ -61,9 +97,10 @@ func newMockGmailService(t *testing.T, mockGServer *httptest.Server) gmail.Servi
 // Send overrides the real Send method. It mimics the new behavior of the real
 // gmail.Client by performing header replacement before sending the message to the
 // underlying mock google API http server.
-func (m *mockGmailService) Send(ctx context.Context, token *oauth2.Token, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+func (m *mockGmailService) Send(ctx context.Context, recipients []string, src gmail.Source) (*gapi.Message, error) {
 	// Mimic the header replacement logic from the actual client.
-	// The reader is passed directly, no need to create a new one.
+	rawEmail, err := src()
+	require.NoError(m.t, err, "mock send: failed to open raw email")
 	msg, err := mail.ReadMessage(rawEmail)
 	require.NoError(m.t, err, "mock send: failed to parse raw email")
 
@@ -255,3 +292,321 @@ func TestEndToEndMessageRelay(t *testing.T) {
 		// Server is still running, which is expected.
 	}
 }
+
+// TestSMTPSListener verifies that the implicit TLS listener accepts mail
+// alongside the plaintext listener.
+func TestSMTPSListener(t *testing.T) {
+	certPath, keyPath := writeTestCert(t, t.TempDir())
+
+	received := make(chan []string, 1)
+	mockService := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			received <- recipients
+			return &gapi.Message{Id: "smtps-id"}, nil
+		},
+	}
+
+	cfg := &config.Config{
+		SMTPUser:          "testuser",
+		SMTPPassword:      "testpass",
+		SMTPPort:          getFreePort(t),
+		SMTPSPort:         getFreePort(t),
+		ReadTimeout:       15,
+		WriteTimeout:      15,
+		MaxRecipients:     25,
+		TLSCertPath:       certPath,
+		TLSKeyPath:        keyPath,
+		TLSMinVersion:     "1.2",
+		RequireTLS:        true,
+		AllowInsecureAuth: true,
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- Run(cfg, logger, mockService)
+	}()
+
+	smtpsAddr := fmt.Sprintf("localhost:%d", cfg.SMTPSPort)
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	var conn net.Conn
+	var err error
+	for i := 0; i < 20; i++ {
+		conn, err = tls.Dial("tcp", smtpsAddr, tlsConfig)
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.NoError(t, err, "failed to connect to SMTPS server on %s", smtpsAddr)
+
+	client, err := smtp.NewClient(conn, "localhost")
+	require.NoError(t, err)
+	defer client.Close()
+
+	// STARTTLS is not offered on a connection that is already encrypted.
+	ok, _ := client.Extension("STARTTLS")
+	assert.False(t, ok)
+
+	require.NoError(t, client.Auth(smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, "localhost")))
+	require.NoError(t, client.Mail("sender@example.com"))
+	require.NoError(t, client.Rcpt("rcpt@example.com"))
+	w, err := client.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: smtps\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, client.Quit())
+
+	select {
+	case rcpts := <-received:
+		assert.Equal(t, []string{"rcpt@example.com"}, rcpts)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the message to be relayed")
+	}
+
+	// The plaintext listener is still running and offers STARTTLS.
+	plain, err := smtp.Dial(fmt.Sprintf("localhost:%d", cfg.SMTPPort))
+	require.NoError(t, err)
+	defer plain.Close()
+	ok, _ = plain.Extension("STARTTLS")
+	assert.True(t, ok)
+	assert.Error(t, plain.Mail("sender@example.com"), "MAIL must be refused before STARTTLS")
+
+	select {
+	case err := <-serverErrChan:
+		require.NoError(t, err, "server should not have exited with an error")
+	default:
+	}
+}
+
+// TestListenerPolicies verifies that each configured listener applies its own
+// policy to the connections it accepts.
+func TestListenerPolicies(t *testing.T) {
+	mockService := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			return &gapi.Message{Id: "listener-id"}, nil
+		},
+	}
+
+	open := config.Listener{Address: "127.0.0.1", Port: getFreePort(t), TLSMode: config.TLSModeNone}
+	authenticated := config.Listener{Address: "127.0.0.1", Port: getFreePort(t), TLSMode: config.TLSModeNone, RequireAuth: true}
+	cfg := &config.Config{
+		SMTPUser:          "testuser",
+		SMTPPassword:      "testpass",
+		ReadTimeout:       15,
+		WriteTimeout:      15,
+		MaxRecipients:     25,
+		AllowInsecureAuth: true,
+		Listeners:         []config.Listener{open, authenticated},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- Run(cfg, logger, mockService)
+	}()
+
+	dial := func(l config.Listener) *smtp.Client {
+		var client *smtp.Client
+		var err error
+		for i := 0; i < 20; i++ {
+			client, err = smtp.Dial(l.Addr())
+			if err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		require.NoError(t, err, "failed to connect to SMTP server on %s", l.Addr())
+		return client
+	}
+
+	// The open listener accepts mail without AUTH.
+	client := dial(open)
+	defer client.Close()
+	require.NoError(t, client.Hello("localhost"))
+	assert.NoError(t, client.Mail("sender@example.com"))
+
+	// The other listener refuses MAIL until the client has authenticated.
+	client = dial(authenticated)
+	defer client.Close()
+	require.NoError(t, client.Hello("localhost"))
+	assert.Error(t, client.Mail("sender@example.com"))
+	require.NoError(t, client.Auth(smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, "127.0.0.1")))
+	assert.NoError(t, client.Mail("sender@example.com"))
+
+	select {
+	case err := <-serverErrChan:
+		require.NoError(t, err, "server should not have exited with an error")
+	default:
+	}
+}
+
+// relayRaw relays raw through a server run with cfg and returns the message
+// that reached the Gmail service.
+func relayRaw(t *testing.T, cfg *config.Config, raw string) string {
+	t.Helper()
+	received := make(chan string, 1)
+	mockService := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			data, err := io.ReadAll(rawEmail)
+			if err != nil {
+				return nil, err
+			}
+			received <- string(data)
+			return &gapi.Message{Id: "raw-id"}, nil
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- Run(cfg, logger, mockService)
+	}()
+
+	var client *smtp.Client
+	var err error
+	for i := 0; i < 20; i++ {
+		client, err = smtp.Dial(fmt.Sprintf("localhost:%d", cfg.SMTPPort))
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.NoError(t, err, "failed to connect to SMTP server")
+	defer client.Close()
+
+	require.NoError(t, client.Auth(smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, "localhost")))
+	require.NoError(t, client.Mail("sender@example.com"))
+	require.NoError(t, client.Rcpt("rcpt@example.com"))
+	w, err := client.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte(raw))
+	require.NoError(t, err)
+	require.NoError(t, w.Close(), "message should be accepted")
+	require.NoError(t, client.Quit())
+
+	select {
+	case err := <-serverErrChan:
+		require.NoError(t, err, "server should not have exited with an error")
+	default:
+	}
+
+	select {
+	case data := <-received:
+		return data
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the message to be relayed")
+		return ""
+	}
+}
+
+// TestRelay_MalformedHeaderWithoutRules verifies that without header rules a
+// message whose header cannot be parsed is relayed unchanged rather than
+// refused, as the Received header is only added on a best-effort basis.
+func TestRelay_MalformedHeaderWithoutRules(t *testing.T) {
+	cfg := &config.Config{
+		SMTPUser:          "testuser",
+		SMTPPassword:      "testpass",
+		SMTPPort:          getFreePort(t),
+		ReadTimeout:       15,
+		WriteTimeout:      15,
+		MaxRecipients:     25,
+		AllowInsecureAuth: true,
+		ReceivedHeader:    config.ReceivedHeaderAnonymous,
+	}
+
+	raw := " continued\r\nSubject: malformed\r\n\r\nbody\r\n"
+	assert.Equal(t, raw, relayRaw(t, cfg, raw))
+}
+
+// TestRelay_NoReceivedHeaderWithoutRules verifies that with the Received
+// header off and no header rules the message is relayed byte for byte, without
+// its header being parsed.
+func TestRelay_NoReceivedHeaderWithoutRules(t *testing.T) {
+	testCases := []struct {
+		name string
+		raw  string
+	}{
+		{"Well-formed", "From: sender@example.com\r\nSubject:   spaced\r\n\tfolded\r\n\r\nbody\r\n"},
+		{"Malformed header", " continued\r\nSubject: malformed\r\n\r\nbody\r\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				SMTPUser:          "testuser",
+				SMTPPassword:      "testpass",
+				SMTPPort:          getFreePort(t),
+				ReadTimeout:       15,
+				WriteTimeout:      15,
+				MaxRecipients:     25,
+				AllowInsecureAuth: true,
+				ReceivedHeader:    config.ReceivedHeaderOff,
+			}
+			assert.Equal(t, tc.raw, relayRaw(t, cfg, tc.raw))
+		})
+	}
+}
+
+// blockingHandler is a slog.Handler that holds up the goroutine logging msg
+// until wait is closed.
+type blockingHandler struct {
+	slog.Handler
+	msg  string
+	wait <-chan struct{}
+}
+
+func (h blockingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Message == h.msg {
+		<-h.wait
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// TestRun_ListenerFailureStopsQueue verifies that Run waits for the delivery
+// queue to stop when it returns because a listener failed, not only on a
+// shutdown signal.
+func TestRun_ListenerFailureStopsQueue(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := spool.New(slog.New(slog.NewTextHandler(io.Discard, nil)), dir)
+	require.NoError(t, err)
+	require.NoError(t, sp.Enqueue(&spool.Message{To: []string{"rcpt@example.com"}}, strings.NewReader("Subject: hi\r\n\r\nbody")))
+
+	var inFlight atomic.Int32
+	started := make(chan struct{})
+	mockService := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			inFlight.Add(1)
+			defer inFlight.Add(-1)
+			close(started)
+			<-ctx.Done()
+			// A delivery takes a moment to wind down after it is cancelled.
+			time.Sleep(100 * time.Millisecond)
+			return nil, ctx.Err()
+		},
+	}
+	// The listener only starts once the delivery is in flight.
+	logger := slog.New(blockingHandler{
+		Handler: slog.NewTextHandler(io.Discard, nil),
+		msg:     "starting smog smtp relay",
+		wait:    started,
+	})
+
+	// The listener cannot bind, as the port is taken.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer taken.Close()
+	port := taken.Addr().(*net.TCPAddr).Port
+	cfg := &config.Config{
+		ReadTimeout:        15,
+		WriteTimeout:       15,
+		SpoolPath:          dir,
+		SpoolWorkers:       1,
+		SpoolMaxAttempts:   10,
+		SpoolRetryInterval: 60,
+		Listeners:          []config.Listener{{Address: "127.0.0.1", Port: port, TLSMode: config.TLSModeNone}},
+	}
+
+	require.Error(t, Run(cfg, logger, mockService))
+	assert.Zero(t, inFlight.Load(), "Run must not return while a delivery is in flight")
+}
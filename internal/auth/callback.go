@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// authRequest is a single authorization attempt. Its state ties the redirect
+// back to the request, and its PKCE verifier ties the code exchange to it, so
+// a code delivered by anyone else is of no use.
+type authRequest struct {
+	state    string
+	verifier string
+}
+
+func newAuthRequest() (*authRequest, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate oauth state: %w", err)
+	}
+	return &authRequest{
+		state:    base64.RawURLEncoding.EncodeToString(b),
+		verifier: oauth2.GenerateVerifier(),
+	}, nil
+}
+
+// authCodeURL returns the URL of the consent page for the request.
+func (a *authRequest) authCodeURL(config *oauth2.Config) string {
+	return config.AuthCodeURL(a.state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(a.verifier))
+}
+
+// exchange trades the authorization code for a token.
+func (a *authRequest) exchange(ctx context.Context, config *oauth2.Config, code string) (*oauth2.Token, error) {
+	tok, err := config.Exchange(ctx, code, oauth2.VerifierOption(a.verifier))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve token from web: %w", err)
+	}
+	return tok, nil
+}
+
+// validState reports whether state is the state of the request.
+func (a *authRequest) validState(state string) bool {
+	return subtle.ConstantTimeCompare([]byte(state), []byte(a.state)) == 1
+}
+
+// callbackHandler receives the redirect from the consent page on the loopback
+// address. It accepts a single redirect with the state of the request and
+// reports its code or error; every other request is rejected and ignored, so
+// other local processes can neither inject a code nor abort the login.
+type callbackHandler struct {
+	log  *slog.Logger
+	req  *authRequest
+	once sync.Once
+	// codes and errs receive the outcome of the accepted redirect.
+	codes chan string
+	errs  chan error
+}
+
+func newCallbackHandler(logger *slog.Logger, req *authRequest) *callbackHandler {
+	return &callbackHandler{
+		log:   logger,
+		req:   req,
+		codes: make(chan string, 1),
+		errs:  make(chan error, 1),
+	}
+}
+
+func (h *callbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	if !h.req.validState(query.Get("state")) {
+		h.log.Warn("rejected oauth callback with an invalid state", "remote_addr", r.RemoteAddr)
+		writeResultPage(w, http.StatusBadRequest, false, "This request does not belong to the running login. Start again with 'smog auth login'.")
+		return
+	}
+
+	accepted := false
+	h.once.Do(func() {
+		accepted = true
+		if e := query.Get("error"); e != "" {
+			h.log.Error("oauth callback reported an error", "error", e)
+			writeResultPage(w, http.StatusOK, false, fmt.Sprintf("Google did not grant access (%s). You can close this window and run 'smog auth login' again.", e))
+			h.errs <- fmt.Errorf("authorization failed: %s", e)
+			return
+		}
+		code := query.Get("code")
+		if code == "" {
+			h.log.Error("oauth callback received no code")
+			writeResultPage(w, http.StatusBadRequest, false, "The authorization code is missing. You can close this window and run 'smog auth login' again.")
+			h.errs <- fmt.Errorf("authorization code not found")
+			return
+		}
+		writeResultPage(w, http.StatusOK, true, "smog is now authorized to send mail with your Google account. You can close this window.")
+		h.codes <- code
+	})
+	if !accepted {
+		writeResultPage(w, http.StatusConflict, false, "The login has already been completed. You can close this window.")
+	}
+}
+
+var resultPage = template.Must(template.New("result").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>smog - {{if .OK}}Authorization complete{{else}}Authorization failed{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #f4f5f7; margin: 0; }
+main { max-width: 32em; margin: 15vh auto; padding: 2em; background: #fff; border-radius: 8px; box-shadow: 0 1px 4px rgba(0,0,0,.15); }
+h1 { font-size: 1.4em; color: {{if .OK}}#1e7e34{{else}}#b02a37{{end}}; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{if .OK}}Authorization complete{{else}}Authorization failed{{end}}</h1>
+<p>{{.Message}}</p>
+</main>
+</body>
+</html>
+`))
+
+// writeResultPage tells the user in the browser how the login went.
+func writeResultPage(w http.ResponseWriter, status int, ok bool, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	resultPage.Execute(w, struct {
+		OK      bool
+		Message string
+	}{ok, message})
+}
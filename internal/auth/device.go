@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"golang.org/x/oauth2"
+)
+
+// getTokenFromDevice obtains a token with the device authorization grant
+// (RFC 8628): the user opens a verification URL on any device, enters the code
+// shown here, and smog polls the token endpoint until access is granted or
+// the code expires. Google only offers the grant to OAuth clients of the "TVs
+// and Limited Input devices" type.
+func getTokenFromDevice(ctx context.Context, logger *slog.Logger, config *oauth2.Config) (*oauth2.Token, error) {
+	da, err := config.DeviceAuth(ctx, oauth2.AccessTypeOffline)
+	if err != nil {
+		return nil, deviceAuthError("failed to start device authorization", err)
+	}
+
+	logger.Info("To authorize smog, please follow these steps:")
+	logger.Info("1. Open this URL on any device with a web browser:", "url", da.VerificationURI)
+	logger.Info("2. Enter this code:", "code", da.UserCode)
+	logger.Info("3. Authenticate with Google and grant permissions.")
+	if !da.Expiry.IsZero() {
+		logger.Info("Waiting for authorization...", "expires", da.Expiry.Local().Format("15:04:05"))
+	} else {
+		logger.Info("Waiting for authorization...")
+	}
+
+	tok, err := config.DeviceAccessToken(ctx, da)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("the device code expired before access was granted")
+		}
+		return nil, deviceAuthError("device authorization failed", err)
+	}
+	return tok, nil
+}
+
+// deviceAuthError explains the errors of the device authorization endpoints
+// that need action from the user.
+func deviceAuthError(msg string, err error) error {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		code := retrieveErr.ErrorCode
+		if code == "" {
+			// The device authorization endpoint's errors are not parsed.
+			var body struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(retrieveErr.Body, &body) == nil {
+				code = body.Error
+			}
+		}
+		switch code {
+		case "access_denied":
+			return fmt.Errorf("%s: access was denied", msg)
+		case "invalid_client", "unauthorized_client":
+			return fmt.Errorf("%s: the OAuth client does not support device authorization, create one of the \"TVs and Limited Input devices\" type: %w", msg, err)
+		case "invalid_scope":
+			return fmt.Errorf("%s: Google does not allow the requested scopes with device authorization, run 'smog auth login' without --device and paste the redirect URL instead: %w", msg, err)
+		}
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
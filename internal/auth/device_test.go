@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// newFakeDeviceServer starts a fake OAuth server for the device authorization
+// grant. Its token endpoint reports the authorization as pending until it has
+// been polled pending times, and then answers with result: a token, or an
+// error code.
+func newFakeDeviceServer(t *testing.T, pending int32, result string) (*httptest.Server, *int32) {
+	t.Helper()
+	var polls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "id", r.PostForm.Get("client_id"))
+		assert.Equal(t, "https://www.googleapis.com/auth/gmail.send", r.PostForm.Get("scope"))
+		w.Header().Set("Content-Type", "application/json")
+		// Google calls the verification URI verification_url.
+		json.NewEncoder(w).Encode(map[string]any{
+			"device_code":      "device-code",
+			"user_code":        "ABCD-EFGH",
+			"verification_url": "https://www.google.com/device",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:device_code", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "device-code", r.PostForm.Get("device_code"))
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.AddInt32(&polls, 1) <= pending {
+			w.WriteHeader(http.StatusPreconditionRequired)
+			json.NewEncoder(w).Encode(map[string]string{"error": "authorization_pending"})
+			return
+		}
+		if result != "" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": result})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "device-access",
+			"refresh_token": "device-refresh",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &polls
+}
+
+func deviceConfig(srv *httptest.Server) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Scopes:       []string{"https://www.googleapis.com/auth/gmail.send"},
+		Endpoint: oauth2.Endpoint{
+			DeviceAuthURL: srv.URL + "/device",
+			TokenURL:      srv.URL + "/token",
+			AuthStyle:     oauth2.AuthStyleInParams,
+		},
+	}
+}
+
+func TestGetTokenFromDevice(t *testing.T) {
+	srv, polls := newFakeDeviceServer(t, 1, "")
+
+	tok, err := getTokenFromDevice(context.Background(), discardLogger(), deviceConfig(srv))
+	require.NoError(t, err)
+	assert.Equal(t, "device-access", tok.AccessToken)
+	assert.Equal(t, "device-refresh", tok.RefreshToken)
+	assert.Equal(t, int32(2), atomic.LoadInt32(polls))
+}
+
+func TestGetTokenFromDevice_Denied(t *testing.T) {
+	srv, _ := newFakeDeviceServer(t, 0, "access_denied")
+
+	_, err := getTokenFromDevice(context.Background(), discardLogger(), deviceConfig(srv))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "access was denied")
+}
+
+func TestGetTokenFromDevice_InvalidScope(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_scope"})
+	}))
+	t.Cleanup(srv.Close)
+
+	_, err := getTokenFromDevice(context.Background(), discardLogger(), deviceConfig(srv))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "without --device")
+}
@@ -4,14 +4,18 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethanpil/smog/internal/config"
@@ -21,18 +25,39 @@ import (
 	"google.golang.org/api/gmail/v1"
 )
 
-func Login(logger *slog.Logger, cfg *config.Config) error {
-	b, err := ioutil.ReadFile(cfg.GoogleCredentialsPath)
-	if err != nil {
-		return fmt.Errorf("unable to read client secret file: %v", err)
+// Scopes returns the OAuth2 scopes smog needs for the configuration. Sending
+// needs gmail.send only; RewriteFrom also needs gmail.settings.basic to list
+// the send-as aliases, and CheckSentBeforeRetry gmail.readonly to search the
+// Sent folder.
+func Scopes(cfg *config.Config) []string {
+	scopes := []string{gmail.GmailSendScope}
+	if cfg.RewriteFrom {
+		scopes = append(scopes, gmail.GmailSettingsBasicScope)
+	}
+	if cfg.CheckSentBeforeRetry {
+		scopes = append(scopes, gmail.GmailReadonlyScope)
 	}
+	return scopes
+}
 
+// LoginOptions selects how Login obtains the token.
+type LoginOptions struct {
+	// Device uses the device authorization grant: the user enters a code on
+	// another device instead of being redirected back to smog.
+	Device bool
+}
+
+func Login(logger *slog.Logger, cfg *config.Config, opts LoginOptions) error {
 	// If modifying these scopes, delete your previously saved token.json.
-	oauthConfig, err := google.ConfigFromJSON(b, gmail.GmailSendScope)
+	oauthConfig, err := oauthConfigFromFile(cfg)
 	if err != nil {
-		return fmt.Errorf("unable to parse client secret file to config: %v", err)
+		return err
+	}
+	// The credentials file does not name the device authorization endpoint.
+	if oauthConfig.Endpoint.DeviceAuthURL == "" {
+		oauthConfig.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
 	}
-	client, err := getClientForLogin(logger, oauthConfig, cfg)
+	client, err := getClientForLogin(logger, oauthConfig, cfg, opts)
 	if err != nil {
 		return fmt.Errorf("unable to retrieve client: %v", err)
 	}
@@ -53,7 +78,7 @@ func Login(logger *slog.Logger, cfg *config.Config) error {
 
 // getClientForLogin retrieves a token, saves the token, then returns the generated client.
 // This is used for the interactive login flow.
-func getClientForLogin(logger *slog.Logger, oauthConfig *oauth2.Config, cfg *config.Config) (*http.Client, error) {
+func getClientForLogin(logger *slog.Logger, oauthConfig *oauth2.Config, cfg *config.Config, opts LoginOptions) (*http.Client, error) {
 	tok, err := LoadToken(logger, cfg)
 	if err != nil {
 		// If there's an error loading the token (e.g., corrupted file),
@@ -61,14 +86,24 @@ func getClientForLogin(logger *slog.Logger, oauthConfig *oauth2.Config, cfg *con
 		logger.Warn("could not load existing token, will request a new one", "err", err)
 	}
 
-	if tok == nil {
+	if tok == nil && opts.Device {
+		logger.Info("no token found, starting device authorization")
+		tok, err = getTokenFromDevice(context.Background(), logger, oauthConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get token with device authorization: %w", err)
+		}
+		logger.Info("saving token to file")
+		if err := saveToken(logger, cfg.GoogleTokenPath, tok); err != nil {
+			return nil, err
+		}
+	} else if tok == nil {
 		logger.Info("no token found, attempting to get one")
 		// Try browser-based flow first
 		tok, err = getTokenFromBrowser(logger, oauthConfig)
 		if err != nil {
 			logger.Warn("could not get token from browser, falling back to manual mode", "err", err)
 			// Fallback to manual copy-paste flow
-			tok, err = getTokenFromWeb(logger, oauthConfig)
+			tok, err = getTokenFromWeb(logger, oauthConfig, os.Stdin)
 			if err != nil {
 				return nil, fmt.Errorf("failed to get token manually: %w", err)
 			}
@@ -82,36 +117,127 @@ func getClientForLogin(logger *slog.Logger, oauthConfig *oauth2.Config, cfg *con
 	return oauthConfig.Client(context.Background(), tok), nil
 }
 
-// GetClient returns an authenticated http.Client and the corresponding token.
-// It's used by the server at startup. It requires a valid, pre-existing token.
-func GetClient(logger *slog.Logger, cfg *config.Config) (*http.Client, *oauth2.Token, error) {
-	b, err := ioutil.ReadFile(cfg.GoogleCredentialsPath)
+// GetClient returns an authenticated http.Client for the server. It requires a
+// valid, pre-existing token. The client refreshes the access token whenever it
+// expires and writes every refreshed token back to GoogleTokenPath, so a
+// long-running server keeps working until the refresh token itself is revoked.
+// It is meant to be shared by all sessions, which then reuse its connections.
+func GetClient(logger *slog.Logger, cfg *config.Config) (*http.Client, error) {
+	ts, err := NewTokenSource(logger, cfg)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to read client secret file: %v", err)
+		return nil, err
 	}
+	return &http.Client{
+		Transport: &oauth2.Transport{Source: ts, Base: newTransport(cfg)},
+	}, nil
+}
+
+// newTransport returns the transport for Gmail API requests, tuned with the
+// HTTP settings of the configuration. All requests go to the same host, so
+// every idle connection may be kept for it.
+func newTransport(cfg *config.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = time.Duration(cfg.HTTPResponseTimeout) * time.Second
+	t.IdleConnTimeout = time.Duration(cfg.HTTPIdleConnTimeout) * time.Second
+	t.MaxIdleConns = cfg.HTTPMaxIdleConns
+	t.MaxIdleConnsPerHost = cfg.HTTPMaxIdleConns
+	return t
+}
 
-	oauthConfig, err := google.ConfigFromJSON(b, gmail.GmailSendScope)
+// NewTokenSource returns a concurrency-safe token source built from the
+// credentials file and the stored token. Refreshed tokens are persisted to
+// GoogleTokenPath.
+func NewTokenSource(logger *slog.Logger, cfg *config.Config) (oauth2.TokenSource, error) {
+	oauthConfig, err := oauthConfigFromFile(cfg)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to parse client secret file to config: %v", err)
+		return nil, err
 	}
 
 	tok, err := LoadToken(logger, cfg)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to load token: %w", err)
+		return nil, fmt.Errorf("failed to load token: %w", err)
 	}
 	if tok == nil {
 		// This case is handled by the startup validation in main.go, but is here for safety.
-		return nil, nil, fmt.Errorf("token not found, please run 'smog auth login'")
+		return nil, fmt.Errorf("token not found, please run 'smog auth login'")
+	}
+
+	return newPersistingTokenSource(logger, oauthConfig, cfg.GoogleTokenPath, tok), nil
+}
+
+// oauthConfigFromFile reads the OAuth client from the credentials file and
+// requests the scopes the configuration needs.
+func oauthConfigFromFile(cfg *config.Config) (*oauth2.Config, error) {
+	b, err := ioutil.ReadFile(cfg.GoogleCredentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client secret file: %v", err)
+	}
+
+	oauthConfig, err := google.ConfigFromJSON(b, Scopes(cfg)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client secret file to config: %v", err)
+	}
+	return oauthConfig, nil
+}
+
+// persistingTokenSource wraps a refreshing token source and saves every new
+// token it hands out. The mutex serializes refreshes, so concurrent sessions
+// never refresh or write the token file at the same time.
+type persistingTokenSource struct {
+	log  *slog.Logger
+	path string
+	base oauth2.TokenSource
+
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+func newPersistingTokenSource(logger *slog.Logger, oauthConfig *oauth2.Config, path string, tok *oauth2.Token) *persistingTokenSource {
+	return &persistingTokenSource{
+		log:  logger,
+		path: path,
+		base: oauthConfig.TokenSource(context.Background(), tok),
+		last: tok,
+	}
+}
+
+// Token returns a valid token, refreshing and persisting it if necessary.
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tok, err := p.base.Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			p.log.Error("google refresh token was revoked or has expired, please run 'smog auth login'", "err", err)
+		}
+		return nil, fmt.Errorf("failed to refresh google api token: %w", err)
 	}
 
-	return oauthConfig.Client(context.Background(), tok), tok, nil
+	if p.last == nil || tok.AccessToken != p.last.AccessToken {
+		p.log.Info("google api access token refreshed", "expiry", tok.Expiry)
+		// A failed write is not fatal: the refreshed token is still valid in
+		// memory, and the next refresh will try to persist it again.
+		if err := saveToken(p.log, p.path, tok); err != nil {
+			p.log.Error("failed to save refreshed token", "path", p.path, "err", err)
+		}
+		p.last = tok
+	}
+	return tok, nil
 }
 
-// getTokenFromBrowser attempts to automatically open a browser for OAuth authentication.
+// openURL opens a URL in the user's browser. Tests replace it.
+var openURL = browser.OpenURL
+
+// getTokenFromBrowser attempts to automatically open a browser for OAuth
+// authentication. The consent page redirects to a temporary server on the
+// loopback address, which only accepts the redirect of this login.
 func getTokenFromBrowser(logger *slog.Logger, config *oauth2.Config) (*oauth2.Token, error) {
-	// Create a channel to receive the authorization code
-	codeChan := make(chan string)
-	errChan := make(chan error)
+	req, err := newAuthRequest()
+	if err != nil {
+		return nil, err
+	}
 
 	// Use a random available port for the callback server
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
@@ -121,108 +247,120 @@ func getTokenFromBrowser(logger *slog.Logger, config *oauth2.Config) (*oauth2.To
 	defer listener.Close()
 
 	port := listener.Addr().(*net.TCPAddr).Port
-	config.RedirectURL = fmt.Sprintf("http://127.0.0.1:%d", port)
+	config.RedirectURL = fmt.Sprintf("http://127.0.0.1:%d/", port)
 	logger.Debug("oauth callback listening", "url", config.RedirectURL)
 
 	// Setup a temporary HTTP server to handle the OAuth redirect
-	mux := http.NewServeMux()
+	handler := newCallbackHandler(logger, req)
 	server := &http.Server{
-		Handler: mux,
-	}
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Get the authorization code from the query parameters
-		code := r.URL.Query().Get("code")
-		if code == "" {
-			logger.Error("oauth callback received no code")
-			http.Error(w, "Error: Authorization code not found in request.", http.StatusBadRequest)
-			errChan <- fmt.Errorf("authorization code not found")
-			return
-		}
-		// Send the code to the channel
-		codeChan <- code
-		// Respond to the browser
-		fmt.Fprintln(w, "Authentication successful! You can close this window now.")
-	})
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
 
 	// Start the server in a goroutine
+	serveErr := make(chan error, 1)
 	go func() {
 		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			logger.Error("local http server failed", "err", err)
-			errChan <- fmt.Errorf("failed to start local server: %w", err)
+			serveErr <- fmt.Errorf("failed to start local server: %w", err)
 		}
 	}()
 
-	// Generate the authentication URL
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-
 	// Try to open the URL in a browser
-	err = browser.OpenURL(authURL)
-	if err != nil {
+	authURL := req.authCodeURL(config)
+	if err := openURL(authURL); err != nil {
 		logger.Warn("failed to open browser automatically", "err", err)
-		// If we can't open the browser, this flow has failed.
-		// We shut down the server and return an error, so the caller can fall back.
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		server.Shutdown(ctx)
+		// If we can't open the browser, this flow has failed, so the caller
+		// can fall back.
 		return nil, fmt.Errorf("could not open browser: %w", err)
 	}
 
 	logger.Info("Your browser has been opened to visit the Google authentication page.")
-	logger.Info("If your browser is on a different machine, please open the URL above.")
+	logger.Info("If it did not open, visit this URL on this machine:", "url", authURL)
 	logger.Info("Waiting for authorization...")
 
 	// Wait for the authorization code or an error
 	select {
-	case code := <-codeChan:
-		// Shutdown the server once the code is received
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		server.Shutdown(ctx)
-
-		// Exchange the code for a token
-		tok, err := config.Exchange(context.Background(), code)
-		if err != nil {
-			return nil, fmt.Errorf("unable to retrieve token from web: %w", err)
-		}
-		return tok, nil
-	case err := <-errChan:
-		// Shutdown the server on error
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		server.Shutdown(ctx)
+	case code := <-handler.codes:
+		return req.exchange(context.Background(), config, code)
+	case err := <-handler.errs:
+		return nil, err
+	case err := <-serveErr:
 		return nil, err
 	case <-time.After(5 * time.Minute): // Timeout after 5 minutes
-		// Shutdown the server on timeout
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		server.Shutdown(ctx)
 		return nil, fmt.Errorf("timed out waiting for authorization code")
 	}
 }
 
-// getTokenFromWeb handles the manual, copy-paste based token retrieval.
-func getTokenFromWeb(logger *slog.Logger, config *oauth2.Config) (*oauth2.Token, error) {
-	config.RedirectURL = "urn:ietf:wg:oauth:2.0:oob"
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+// manualRedirectURL is the redirect URL of the manual flow. Nothing listens
+// on it, so the browser shows an error page, but its address bar holds the
+// authorization code. Google accepts loopback redirects for desktop clients
+// on any port.
+const manualRedirectURL = "http://127.0.0.1"
+
+// getTokenFromWeb handles the manual, copy-paste based token retrieval. The
+// user opens the authorization URL on any machine and pastes the URL the
+// browser is redirected to, or just the code in it, into in.
+func getTokenFromWeb(logger *slog.Logger, config *oauth2.Config, in io.Reader) (*oauth2.Token, error) {
+	req, err := newAuthRequest()
+	if err != nil {
+		return nil, err
+	}
+	config.RedirectURL = manualRedirectURL
+	authURL := req.authCodeURL(config)
 
 	logger.Info("You are running in a headless environment or the browser could not be opened.")
 	logger.Info("Please follow these steps:")
 	logger.Info("1. Open this URL on any machine with a web browser:", "url", authURL)
 	logger.Info("2. Authenticate with Google and grant permissions.")
-	logger.Info("3. Google will show you an authorization code. Copy it.")
-	logger.Info("Enter the authorization code here:")
+	logger.Info("3. The browser is sent to " + manualRedirectURL + " and shows that the page cannot be reached. Copy the full URL from its address bar.")
+	logger.Info("Enter the URL here:")
 
-	reader := bufio.NewReader(os.Stdin)
-	authCode, err := reader.ReadString('\n')
+	reader := bufio.NewReader(in)
+	input, err := reader.ReadString('\n')
+	if err != nil && (err != io.EOF || input == "") {
+		return nil, fmt.Errorf("unable to read redirect url: %v", err)
+	}
+	code, err := codeFromRedirect(input, req)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read authorization code: %v", err)
+		return nil, err
+	}
+	return req.exchange(context.TODO(), config, code)
+}
+
+// codeFromRedirect returns the authorization code in the redirect URL pasted
+// by the user, which must carry the state of req. A bare code is accepted
+// too; the PKCE verifier still ties it to req.
+func codeFromRedirect(input string, req *authRequest) (string, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", fmt.Errorf("no redirect url entered")
+	}
+	if !strings.Contains(input, "://") && !strings.Contains(input, "?") {
+		return input, nil
 	}
 
-	tok, err := config.Exchange(context.TODO(), strings.TrimSpace(authCode))
+	u, err := url.Parse(input)
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve token from web: %v", err)
+		return "", fmt.Errorf("invalid redirect url: %w", err)
 	}
-	return tok, nil
+	query := u.Query()
+	if !req.validState(query.Get("state")) {
+		return "", fmt.Errorf("the redirect url does not belong to this login, open the url printed above")
+	}
+	if e := query.Get("error"); e != "" {
+		return "", fmt.Errorf("authorization failed: %s", e)
+	}
+	code := query.Get("code")
+	if code == "" {
+		return "", fmt.Errorf("redirect url has no authorization code")
+	}
+	return code, nil
 }
 
 // LoadToken retrieves a token from a file, if it doesn't exist it returns a nil token.
@@ -264,7 +402,9 @@ func tokenFromFile(logger *slog.Logger, file string) (*oauth2.Token, error) {
 	return tok, nil
 }
 
-// Saves a token to a file path.
+// Saves a token to a file path. The token is written to a temporary file that
+// is renamed over the old one, so readers never see a partially written token.
+// The previous token is kept as path + ".bak".
 func saveToken(logger *slog.Logger, path string, token *oauth2.Token) error {
 	logger.Info("caching oauth token", "path", path)
 
@@ -273,40 +413,175 @@ func saveToken(logger *slog.Logger, path string, token *oauth2.Token) error {
 		return fmt.Errorf("cannot create token directory: %w", err)
 	}
 
-	// Backup existing token
-	if _, err := os.Stat(path); err == nil {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath) // No-op once the file has been renamed.
+
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	if err := json.NewEncoder(f).Encode(token); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+
+	// Backup existing token. It is copied rather than renamed so that the
+	// token path always holds a complete token.
+	if existing, err := os.ReadFile(path); err == nil {
 		backupPath := path + ".bak"
 		logger.Info("backing up existing token", "path", backupPath)
-		if err := os.Rename(path, backupPath); err != nil {
+		if err := os.WriteFile(backupPath, existing, 0600); err != nil {
 			return fmt.Errorf("failed to backup token: %w", err)
 		}
 	}
 
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
+	if err := os.Rename(tmpPath, path); err != nil {
 		return fmt.Errorf("unable to cache oauth token: %v", err)
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(token)
+	return nil
 }
 
-// RevokeToken securely deletes the token file. It overwrites the file with zeros
-// to prevent recovery of the sensitive token data, then closes the file, and
-// finally removes it from the filesystem. This approach ensures that the file is
-// properly handled for secure deletion, particularly on systems like Windows
-// where a file must be closed before it can be removed.
-func RevokeToken(logger *slog.Logger, cfg *config.Config) error {
+// revokeURL is Google's OAuth token revocation endpoint.
+var revokeURL = "https://oauth2.googleapis.com/revoke"
+
+// RevokeOptions configures RevokeToken.
+type RevokeOptions struct {
+	// LocalOnly only deletes the token files and leaves the grant in the
+	// Google account in place.
+	LocalOnly bool
+}
+
+// RevokeToken revokes the stored token at Google and then securely deletes
+// the token file and the backup saveToken keeps next to it. Revoking the
+// refresh token ends the grant in the Google account, including any access
+// token issued for it. If Google cannot be reached, the files are kept so that
+// the revocation can be repeated.
+func RevokeToken(logger *slog.Logger, cfg *config.Config, opts RevokeOptions) error {
 	tokenPath := cfg.GoogleTokenPath
+	backupPath := tokenPath + ".bak"
 	logger.Info("revoking token", "path", tokenPath)
 
+	if !opts.LocalOnly {
+		if err := revokeRemote(logger, tokenPath, backupPath); err != nil {
+			return fmt.Errorf("%w; the token files were kept, run 'smog auth revoke' again or use --local-only", err)
+		}
+	}
+
+	removed := false
+	for _, path := range []string{tokenPath, backupPath} {
+		ok, err := shredFile(path)
+		if err != nil {
+			return err
+		}
+		if ok {
+			logger.Info("token file deleted", "path", path)
+			removed = true
+		}
+	}
+	if !removed {
+		logger.Info("token file not found, nothing to delete")
+	}
+	return nil
+}
+
+// revokeRemote revokes the tokens in the token file and its backup at
+// Google. The backup may hold an older refresh token, which is revoked as
+// well.
+func revokeRemote(logger *slog.Logger, paths ...string) error {
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		tok, err := tokenFromFile(logger, path)
+		if err != nil {
+			logger.Warn("could not read token, it cannot be revoked at google", "path", path, "err", err)
+			continue
+		}
+		if tok == nil {
+			continue
+		}
+		// Revoking the refresh token revokes its access tokens too.
+		value, kind := tok.RefreshToken, "refresh token"
+		if value == "" {
+			value, kind = tok.AccessToken, "access token"
+		}
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+
+		revoked, err := revokeAtGoogle(context.Background(), value)
+		if err != nil {
+			return fmt.Errorf("failed to revoke %s from %s at google: %w", kind, path, err)
+		}
+		if revoked {
+			logger.Info("token revoked at google", "path", path, "token", kind)
+		} else {
+			logger.Info("token was already invalid at google", "path", path, "token", kind)
+		}
+	}
+	return nil
+}
+
+// revokeAtGoogle calls the revocation endpoint for a token. It reports false
+// if Google no longer knows the token, because it expired or was revoked
+// before.
+func revokeAtGoogle(ctx context.Context, token string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL, strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return true, nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	var result struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	json.Unmarshal(body, &result)
+	if resp.StatusCode == http.StatusBadRequest && result.Error == "invalid_token" {
+		return false, nil
+	}
+	if result.Error != "" {
+		return false, fmt.Errorf("%s: %s (%s)", resp.Status, result.Error, result.Description)
+	}
+	return false, fmt.Errorf("unexpected response: %s", resp.Status)
+}
+
+// shredFile securely deletes a file. It overwrites the file with zeros to
+// prevent recovery of the sensitive token data, then closes the file, and
+// finally removes it from the filesystem. This approach ensures that the file
+// is properly handled for secure deletion, particularly on systems like
+// Windows where a file must be closed before it can be removed. It reports
+// false if the file did not exist.
+func shredFile(path string) (bool, error) {
 	// Open the file for reading and writing to avoid truncation on open.
-	f, err := os.OpenFile(tokenPath, os.O_RDWR, 0)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
 	if err != nil {
 		if os.IsNotExist(err) {
-			logger.Info("token file not found, nothing to revoke")
-			return nil
+			return false, nil
 		}
-		return fmt.Errorf("failed to open token file for writing: %w", err)
+		return false, fmt.Errorf("failed to open token file for writing: %w", err)
 	}
 
 	// Overwrite with zeros before closing.
@@ -314,24 +589,26 @@ func RevokeToken(logger *slog.Logger, cfg *config.Config) error {
 	stat, err := f.Stat()
 	if err != nil {
 		f.Close() // Attempt to close the file even if stat fails.
-		return fmt.Errorf("failed to get token file info: %w", err)
+		return false, fmt.Errorf("failed to get token file info: %w", err)
 	}
 
 	if _, err := f.Write(make([]byte, stat.Size())); err != nil {
 		f.Close() // Attempt to close the file even if write fails.
-		return fmt.Errorf("failed to overwrite token file: %w", err)
+		return false, fmt.Errorf("failed to overwrite token file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return false, fmt.Errorf("failed to overwrite token file: %w", err)
 	}
 
 	// Explicitly close the file before removing it.
 	if err := f.Close(); err != nil {
-		return fmt.Errorf("failed to close token file: %w", err)
+		return false, fmt.Errorf("failed to close token file: %w", err)
 	}
 
 	// Delete the file.
-	if err := os.Remove(tokenPath); err != nil {
-		return fmt.Errorf("failed to delete token file: %w", err)
+	if err := os.Remove(path); err != nil {
+		return false, fmt.Errorf("failed to delete token file: %w", err)
 	}
-
-	logger.Info("token revoked successfully")
-	return nil
+	return true, nil
 }
@@ -0,0 +1,451 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newFakeTokenServer returns a fake OAuth token endpoint that hands out a new
+// access token on every refresh and counts the refreshes.
+func newFakeTokenServer(t *testing.T, refreshes *int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "refresh_token", r.Form.Get("grant_type"))
+		n := atomic.AddInt32(refreshes, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("access-%d", n),
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPersistingTokenSource_RefreshesAndSaves(t *testing.T) {
+	var refreshes int32
+	srv := newFakeTokenServer(t, &refreshes)
+
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	expired := &oauth2.Token{
+		AccessToken:  "stale",
+		RefreshToken: "refresh-me",
+		Expiry:       time.Now().Add(-time.Hour),
+	}
+	require.NoError(t, saveToken(discardLogger(), tokenPath, expired))
+
+	oauthConfig := &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{TokenURL: srv.URL},
+	}
+	ts := newPersistingTokenSource(discardLogger(), oauthConfig, tokenPath, expired)
+
+	// Concurrent callers must share a single refresh.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tok, err := ts.Token()
+			assert.NoError(t, err)
+			assert.Equal(t, "access-1", tok.AccessToken)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshes))
+
+	// The refreshed token is written back and keeps the original refresh token.
+	saved, err := tokenFromFile(discardLogger(), tokenPath)
+	require.NoError(t, err)
+	assert.Equal(t, "access-1", saved.AccessToken)
+	assert.Equal(t, "refresh-me", saved.RefreshToken)
+
+	// The previous token is kept as a backup.
+	backup, err := tokenFromFile(discardLogger(), tokenPath+".bak")
+	require.NoError(t, err)
+	assert.Equal(t, "stale", backup.AccessToken)
+}
+
+func TestSaveToken_Permissions(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "nested", "token.json")
+	require.NoError(t, saveToken(discardLogger(), tokenPath, &oauth2.Token{AccessToken: "a"}))
+	require.NoError(t, saveToken(discardLogger(), tokenPath, &oauth2.Token{AccessToken: "b"}))
+
+	for _, path := range []string{tokenPath, tokenPath + ".bak"} {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), path)
+	}
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Dir(tokenPath))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestScopes(t *testing.T) {
+	assert.Equal(t, []string{gmail.GmailSendScope}, Scopes(&config.Config{}))
+	assert.Equal(t, []string{gmail.GmailSendScope, gmail.GmailSettingsBasicScope}, Scopes(&config.Config{RewriteFrom: true}))
+	assert.Equal(t, []string{gmail.GmailSendScope, gmail.GmailReadonlyScope}, Scopes(&config.Config{CheckSentBeforeRetry: true}))
+}
+
+func TestNewTransport(t *testing.T) {
+	tr := newTransport(&config.Config{HTTPResponseTimeout: 30, HTTPIdleConnTimeout: 45, HTTPMaxIdleConns: 8})
+	assert.Equal(t, 30*time.Second, tr.ResponseHeaderTimeout)
+	assert.Equal(t, 45*time.Second, tr.IdleConnTimeout)
+	assert.Equal(t, 8, tr.MaxIdleConns)
+	assert.Equal(t, 8, tr.MaxIdleConnsPerHost)
+	// The transport is a copy; the defaults are left alone.
+	assert.NotEqual(t, 8, http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost)
+}
+
+// newFakeCodeServer starts a fake OAuth token endpoint that exchanges the
+// authorization code "auth-code" for a token. The returned function reports
+// the PKCE verifier of the last exchange.
+func newFakeCodeServer(t *testing.T, redirectURL string) (*httptest.Server, func() string) {
+	t.Helper()
+	var mu sync.Mutex
+	var verifier string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "authorization_code", r.PostForm.Get("grant_type"))
+		assert.Equal(t, redirectURL, r.PostForm.Get("redirect_uri"))
+		mu.Lock()
+		verifier = r.PostForm.Get("code_verifier")
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("code") != "auth-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "web-access",
+			"refresh_token": "web-refresh",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return verifier
+	}
+}
+
+// urlHandler is a slog.Handler that passes the "url" attribute of every
+// record to a channel, so that a test can act on the URLs shown to the user.
+type urlHandler struct {
+	urls chan string
+}
+
+func (h urlHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h urlHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h urlHandler) WithGroup(string) slog.Handler            { return h }
+func (h urlHandler) Handle(_ context.Context, r slog.Record) error {
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "url" {
+			h.urls <- a.Value.String()
+		}
+		return true
+	})
+	return nil
+}
+
+// parseAuthURL checks the PKCE and state parameters of a consent page URL and
+// returns its redirect URL, state and code challenge.
+func parseAuthURL(t *testing.T, authURL string) (redirect, state, challenge string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	q := u.Query()
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+	assert.Equal(t, "offline", q.Get("access_type"))
+	require.NotEmpty(t, q.Get("state"))
+	require.NotEqual(t, "state-token", q.Get("state"))
+	return q.Get("redirect_uri"), q.Get("state"), q.Get("code_challenge")
+}
+
+// s256 returns the S256 PKCE challenge of a verifier.
+func s256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestGetTokenFromWeb_PastedRedirectURL(t *testing.T) {
+	srv, verifier := newFakeCodeServer(t, manualRedirectURL)
+	oauthConfig := &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{AuthURL: srv.URL + "/auth", TokenURL: srv.URL},
+	}
+
+	urls := make(chan string, 1)
+	pr, pw := io.Pipe()
+	var challenge string
+	go func() {
+		var redirect, state string
+		redirect, state, challenge = parseAuthURL(t, <-urls)
+		fmt.Fprintf(pw, "%s/?state=%s&code=auth-code&scope=https://www.googleapis.com/auth/gmail.send\n", redirect, url.QueryEscape(state))
+	}()
+
+	tok, err := getTokenFromWeb(slog.New(urlHandler{urls}), oauthConfig, pr)
+	require.NoError(t, err)
+	assert.Equal(t, "web-access", tok.AccessToken)
+	assert.Equal(t, "web-refresh", tok.RefreshToken)
+	assert.Equal(t, challenge, s256(verifier()), "the exchange must send the verifier of the challenge")
+}
+
+func TestGetTokenFromBrowser(t *testing.T) {
+	// The redirect URL has a random port, so the token server learns it from
+	// the consent URL.
+	var mu sync.Mutex
+	var redirect, challenge, verifier string
+	statuses := make(chan int, 4)
+
+	origOpenURL := openURL
+	t.Cleanup(func() { openURL = origOpenURL })
+	openURL = func(authURL string) error {
+		mu.Lock()
+		var state string
+		redirect, state, challenge = parseAuthURL(t, authURL)
+		target := redirect
+		mu.Unlock()
+		// Play the browser in the background, like the real one. Requests
+		// without the right state come first and must not end the login.
+		go func() {
+			for _, u := range []string{
+				target + "favicon.ico",
+				target + "?state=forged&code=evil-code",
+				target + "?code=evil-code",
+				target + "?state=" + url.QueryEscape(state) + "&code=auth-code",
+			} {
+				resp, err := http.Get(u)
+				if !assert.NoError(t, err) {
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}
+		}()
+		return nil
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		mu.Lock()
+		assert.Equal(t, "auth-code", r.PostForm.Get("code"))
+		assert.Equal(t, redirect, r.PostForm.Get("redirect_uri"))
+		verifier = r.PostForm.Get("code_verifier")
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "browser-access", "refresh_token": "browser-refresh", "token_type": "Bearer"})
+	}))
+	t.Cleanup(srv.Close)
+	oauthConfig := &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{AuthURL: srv.URL + "/auth", TokenURL: srv.URL},
+	}
+
+	tok, err := getTokenFromBrowser(discardLogger(), oauthConfig)
+	require.NoError(t, err)
+	assert.Equal(t, "browser-access", tok.AccessToken)
+	mu.Lock()
+	assert.Equal(t, challenge, s256(verifier), "the exchange must send the verifier of the challenge")
+	mu.Unlock()
+	for _, want := range []int{http.StatusNotFound, http.StatusBadRequest, http.StatusBadRequest, http.StatusOK} {
+		assert.Equal(t, want, <-statuses)
+	}
+}
+
+func TestCallbackHandler(t *testing.T) {
+	req, err := newAuthRequest()
+	require.NoError(t, err)
+	other, err := newAuthRequest()
+	require.NoError(t, err)
+	assert.NotEqual(t, req.state, other.state)
+	assert.NotEqual(t, req.verifier, other.verifier)
+
+	h := newCallbackHandler(discardLogger(), req)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		return w
+	}
+
+	w := get("state=" + url.QueryEscape(other.state) + "&code=evil")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Authorization failed")
+	assert.Empty(t, h.codes)
+
+	w = get("state=" + url.QueryEscape(req.state) + "&error=access_denied")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, w.Body.String(), "access_denied")
+	assert.EqualError(t, <-h.errs, "authorization failed: access_denied")
+
+	// Only the first redirect with the right state counts.
+	w = get("state=" + url.QueryEscape(req.state) + "&code=late")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Empty(t, h.codes)
+}
+
+func TestCallbackHandler_EscapesError(t *testing.T) {
+	req, err := newAuthRequest()
+	require.NoError(t, err)
+	h := newCallbackHandler(discardLogger(), req)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?state="+url.QueryEscape(req.state)+"&error=%3Cscript%3E", nil))
+	assert.NotContains(t, w.Body.String(), "<script>")
+}
+
+func TestCodeFromRedirect(t *testing.T) {
+	req := &authRequest{state: "s", verifier: "v"}
+	testCases := []struct {
+		input   string
+		code    string
+		wantErr bool
+	}{
+		{"http://127.0.0.1/?state=s&code=4/0Abc&scope=x\n", "4/0Abc", false},
+		{"  http://127.0.0.1:8085/?state=s&code=abc  ", "abc", false},
+		{"4/0Abc\n", "4/0Abc", false},
+		{"http://127.0.0.1/?code=abc", "", true},
+		{"http://127.0.0.1/?state=other&code=abc", "", true},
+		{"http://127.0.0.1/?state=s&error=access_denied", "", true},
+		{"http://127.0.0.1/?state=s", "", true},
+		{"\n", "", true},
+	}
+	for _, tc := range testCases {
+		code, err := codeFromRedirect(tc.input, req)
+		if tc.wantErr {
+			assert.Error(t, err, "input %q", tc.input)
+			continue
+		}
+		assert.NoError(t, err, "input %q", tc.input)
+		assert.Equal(t, tc.code, code, "input %q", tc.input)
+	}
+}
+
+// newFakeRevokeServer starts a fake token revocation endpoint that answers
+// every request with status and records the revoked tokens.
+func newFakeRevokeServer(t *testing.T, status int) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var revoked []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		mu.Lock()
+		revoked = append(revoked, r.PostForm.Get("token"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		switch status {
+		case http.StatusOK:
+			io.WriteString(w, "{}")
+		case http.StatusBadRequest:
+			io.WriteString(w, `{"error": "invalid_token", "error_description": "Token expired or revoked"}`)
+		default:
+			io.WriteString(w, `{"error": "server_error"}`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	orig := revokeURL
+	revokeURL = srv.URL
+	t.Cleanup(func() { revokeURL = orig })
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), revoked...)
+	}
+}
+
+// writeTokenFiles saves a token and a backup holding an older refresh token.
+func writeTokenFiles(t *testing.T) *config.Config {
+	t.Helper()
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	require.NoError(t, saveToken(discardLogger(), tokenPath, &oauth2.Token{AccessToken: "old-access", RefreshToken: "old-refresh"}))
+	require.NoError(t, saveToken(discardLogger(), tokenPath, &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}))
+	require.FileExists(t, tokenPath+".bak")
+	return &config.Config{GoogleTokenPath: tokenPath}
+}
+
+func TestRevokeToken(t *testing.T) {
+	testCases := []struct {
+		name   string
+		status int
+	}{
+		{"Revoked", http.StatusOK},
+		{"AlreadyInvalid", http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			revoked := newFakeRevokeServer(t, tc.status)
+			cfg := writeTokenFiles(t)
+
+			require.NoError(t, RevokeToken(discardLogger(), cfg, RevokeOptions{}))
+			assert.Equal(t, []string{"refresh", "old-refresh"}, revoked())
+			assert.NoFileExists(t, cfg.GoogleTokenPath)
+			assert.NoFileExists(t, cfg.GoogleTokenPath+".bak")
+		})
+	}
+}
+
+func TestRevokeToken_RemoteFailureKeepsFiles(t *testing.T) {
+	revoked := newFakeRevokeServer(t, http.StatusInternalServerError)
+	cfg := writeTokenFiles(t)
+
+	err := RevokeToken(discardLogger(), cfg, RevokeOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "--local-only")
+	assert.Len(t, revoked(), 1)
+	assert.FileExists(t, cfg.GoogleTokenPath)
+	assert.FileExists(t, cfg.GoogleTokenPath+".bak")
+}
+
+func TestRevokeToken_LocalOnly(t *testing.T) {
+	revoked := newFakeRevokeServer(t, http.StatusOK)
+	cfg := writeTokenFiles(t)
+
+	require.NoError(t, RevokeToken(discardLogger(), cfg, RevokeOptions{LocalOnly: true}))
+	assert.Empty(t, revoked())
+	assert.NoFileExists(t, cfg.GoogleTokenPath)
+	assert.NoFileExists(t, cfg.GoogleTokenPath+".bak")
+}
+
+func TestRevokeToken_NoToken(t *testing.T) {
+	revoked := newFakeRevokeServer(t, http.StatusOK)
+	cfg := &config.Config{GoogleTokenPath: filepath.Join(t.TempDir(), "token.json")}
+
+	require.NoError(t, RevokeToken(discardLogger(), cfg, RevokeOptions{}))
+	assert.Empty(t, revoked())
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethanpil/smog/internal/config"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// tokenInfoURL is Google's endpoint describing an access token.
+var tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// profileURL is the Gmail API endpoint returning the address of the account.
+var profileURL = "https://gmail.googleapis.com/gmail/v1/users/me/profile"
+
+// profileScopes are the scopes that allow reading the Gmail profile.
+var profileScopes = []string{
+	gmail.MailGoogleComScope,
+	gmail.GmailModifyScope,
+	gmail.GmailComposeScope,
+	gmail.GmailReadonlyScope,
+	gmail.GmailMetadataScope,
+}
+
+// Results of the refresh check in Status.Refresh.
+const (
+	RefreshOK           = "ok"
+	RefreshFailed       = "failed"
+	RefreshNotAttempted = "not_attempted" // There is no refresh token.
+)
+
+// Status describes the stored token, as reported by "smog auth status".
+type Status struct {
+	TokenPath string `json:"token_path"`
+	// TokenFound is false if there is no token file.
+	TokenFound bool `json:"token_found"`
+	// FileMode is the permission bits of the token file, e.g. "0600".
+	FileMode string `json:"file_mode,omitempty"`
+	// Account is the address of the Google account, if Google reports it
+	// for the scopes of the token.
+	Account string `json:"account,omitempty"`
+	// AccountNote says why Account is empty and how to have it reported.
+	AccountNote string `json:"account_note,omitempty"`
+	// Scopes are the scopes Google reports for the token.
+	Scopes []string `json:"scopes,omitempty"`
+	// MissingScopes are the scopes the configuration needs that were not
+	// granted.
+	MissingScopes []string `json:"missing_scopes,omitempty"`
+	// AccessTokenExpiry is the expiry of the stored access token.
+	AccessTokenExpiry *time.Time `json:"access_token_expiry,omitempty"`
+	HasRefreshToken   bool       `json:"has_refresh_token"`
+	// Refresh reports whether a new access token could be obtained just
+	// now: RefreshOK, RefreshFailed, or RefreshNotAttempted if there is no
+	// refresh token. RefreshError says why the refresh failed.
+	Refresh      string `json:"refresh"`
+	RefreshError string `json:"refresh_error,omitempty"`
+	// Problems lists everything that keeps smog from sending or puts the
+	// token at risk. The token is healthy if it is empty.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// OK reports whether no problems were found.
+func (s *Status) OK() bool {
+	return len(s.Problems) == 0
+}
+
+func (s *Status) problem(format string, args ...any) {
+	s.Problems = append(s.Problems, fmt.Sprintf(format, args...))
+}
+
+// TokenStatus inspects the token at GoogleTokenPath. It refreshes the access
+// token to check that the grant is still valid, without saving the new access
+// token, and asks Google which account and scopes it belongs to. Problems
+// with the token are reported in the Status; an error is returned only if the
+// credentials file cannot be read.
+func TokenStatus(ctx context.Context, logger *slog.Logger, cfg *config.Config) (*Status, error) {
+	oauthConfig, err := oauthConfigFromFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{TokenPath: cfg.GoogleTokenPath, Refresh: RefreshNotAttempted}
+	info, err := os.Stat(cfg.GoogleTokenPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			status.problem("no token found, run 'smog auth login'")
+			return status, nil
+		}
+		status.problem("cannot access token file: %v", err)
+		return status, nil
+	}
+	status.TokenFound = true
+	perm := info.Mode().Perm()
+	status.FileMode = fmt.Sprintf("%04o", perm)
+	// Windows does not report permission bits that mean anything here.
+	if runtime.GOOS != "windows" && perm&0077 != 0 {
+		status.problem("token file is accessible by other users (mode %04o), run 'chmod 600 %s'", perm, cfg.GoogleTokenPath)
+	}
+
+	tok, err := tokenFromFile(logger, cfg.GoogleTokenPath)
+	if err != nil {
+		status.problem("cannot read token: %v", err)
+		return status, nil
+	}
+	if tok == nil {
+		status.problem("no token found, run 'smog auth login'")
+		return status, nil
+	}
+	if !tok.Expiry.IsZero() {
+		expiry := tok.Expiry
+		status.AccessTokenExpiry = &expiry
+	}
+	status.HasRefreshToken = tok.RefreshToken != ""
+
+	// The access token to ask Google about: a fresh one if the refresh
+	// works, the stored one otherwise.
+	access := tok
+	if status.HasRefreshToken {
+		fresh, err := oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: tok.RefreshToken}).Token()
+		if err != nil {
+			status.Refresh = RefreshFailed
+			status.RefreshError = err.Error()
+			status.problem("refreshing the access token failed, run 'smog auth login': %v", err)
+		} else {
+			status.Refresh = RefreshOK
+			access = fresh
+		}
+	} else {
+		status.problem("token has no refresh token, run 'smog auth revoke' and 'smog auth login'")
+	}
+
+	if !access.Valid() {
+		return status, nil
+	}
+	account, scopes, err := tokenInfo(ctx, access.AccessToken)
+	if err != nil {
+		status.problem("cannot look up token information: %v", err)
+		return status, nil
+	}
+	status.Scopes = scopes
+	status.Account = account
+	switch {
+	case account != "":
+	case slices.ContainsFunc(scopes, func(s string) bool { return slices.Contains(profileScopes, s) }):
+		// The address is only part of the token information for tokens
+		// with the email scope, which smog does not ask for.
+		if status.Account, err = profileAddress(ctx, access.AccessToken); err != nil {
+			logger.Warn("could not look up the gmail profile", "error", err)
+			status.AccountNote = fmt.Sprintf("looking up the gmail profile failed: %v", err)
+		}
+	default:
+		status.AccountNote = fmt.Sprintf("the token's scopes do not allow reading the address; it is shown with the %s scope, e.g. set CheckSentBeforeRetry = true and run 'smog auth revoke' and 'smog auth login'", gmail.GmailReadonlyScope)
+	}
+	for _, scope := range Scopes(cfg) {
+		if !slices.Contains(scopes, scope) {
+			status.MissingScopes = append(status.MissingScopes, scope)
+		}
+	}
+	if len(status.MissingScopes) > 0 {
+		status.problem("token lacks scopes the configuration needs (%s), run 'smog auth revoke' and 'smog auth login'", strings.Join(status.MissingScopes, ", "))
+	}
+	return status, nil
+}
+
+// tokenInfo asks Google for the account and the scopes of an access token.
+// The account is only reported for tokens with the email scope.
+func tokenInfo(ctx context.Context, accessToken string) (account string, scopes []string, err error) {
+	body, err := getJSON(ctx, tokenInfoURL+"?"+url.Values{"access_token": {accessToken}}.Encode(), "")
+	if err != nil {
+		return "", nil, err
+	}
+
+	var result struct {
+		Email         string `json:"email"`
+		EmailVerified string `json:"email_verified"`
+		Scope         string `json:"scope"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", nil, fmt.Errorf("failed to decode token information: %w", err)
+	}
+	if verified, err := strconv.ParseBool(result.EmailVerified); err == nil && !verified {
+		result.Email += " (unverified)"
+	}
+	return result.Email, strings.Fields(result.Scope), nil
+}
+
+// profileAddress returns the address of the account from its Gmail profile.
+func profileAddress(ctx context.Context, accessToken string) (string, error) {
+	body, err := getJSON(ctx, profileURL, accessToken)
+	if err != nil {
+		return "", err
+	}
+	var profile struct {
+		EmailAddress string `json:"emailAddress"`
+	}
+	if err := json.Unmarshal(body, &profile); err != nil {
+		return "", fmt.Errorf("failed to decode gmail profile: %w", err)
+	}
+	return profile.EmailAddress, nil
+}
+
+// getJSON makes a GET request, authorized with accessToken if it is not
+// empty, and returns the body of a successful response.
+func getJSON(ctx context.Context, endpoint, accessToken string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// emailScope is the scope for which tokeninfo reports the account address.
+const emailScope = "https://www.googleapis.com/auth/userinfo.email"
+
+// newFakeStatusServer starts a fake Google token, tokeninfo and Gmail profile
+// endpoint. The token endpoint refreshes "refresh-ok" only; tokeninfo reports
+// scope for the refreshed access token, and the address if scope includes
+// the email scope. The profile endpoint counts its calls in profileCalls.
+func newFakeStatusServer(t *testing.T, scope string) (srv *httptest.Server, profileCalls *int) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("refresh_token") != "refresh-ok" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "Token has been expired or revoked."})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "fresh", "token_type": "Bearer", "expires_in": 3600})
+	})
+	mux.HandleFunc("/tokeninfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("access_token") != "fresh" {
+			http.Error(w, `{"error": "invalid_token"}`, http.StatusBadRequest)
+			return
+		}
+		info := map[string]string{"scope": scope, "expires_in": "3599"}
+		if strings.Contains(scope, emailScope) {
+			info["email"] = "relay@example.com"
+			info["email_verified"] = "true"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	})
+	profileCalls = new(int)
+	mux.HandleFunc("/profile", func(w http.ResponseWriter, r *http.Request) {
+		*profileCalls++
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			http.Error(w, `{"error": {"code": 401}}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"emailAddress": "relay@example.com"})
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	origTokenInfo, origProfile := tokenInfoURL, profileURL
+	tokenInfoURL, profileURL = srv.URL+"/tokeninfo", srv.URL+"/profile"
+	t.Cleanup(func() { tokenInfoURL, profileURL = origTokenInfo, origProfile })
+	return srv, profileCalls
+}
+
+// statusConfig writes a credentials file for srv and, if tok is not nil, a
+// token file with the given mode.
+func statusConfig(t *testing.T, srv *httptest.Server, tok *oauth2.Token, mode os.FileMode) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	credentials := fmt.Sprintf(`{"installed": {"client_id": "id", "client_secret": "secret", "auth_uri": "%[1]s/auth", "token_uri": "%[1]s/token", "redirect_uris": ["http://localhost"]}}`, srv.URL)
+	credentialsPath := filepath.Join(dir, "credentials.json")
+	require.NoError(t, os.WriteFile(credentialsPath, []byte(credentials), 0600))
+
+	cfg := &config.Config{GoogleCredentialsPath: credentialsPath, GoogleTokenPath: filepath.Join(dir, "token.json")}
+	if tok != nil {
+		require.NoError(t, saveToken(discardLogger(), cfg.GoogleTokenPath, tok))
+		require.NoError(t, os.Chmod(cfg.GoogleTokenPath, mode))
+	}
+	return cfg
+}
+
+func TestTokenStatus_Healthy(t *testing.T) {
+	srv, profileCalls := newFakeStatusServer(t, gmail.GmailSendScope+" "+gmail.GmailReadonlyScope)
+	expiry := time.Now().Add(-time.Hour).Round(time.Second)
+	cfg := statusConfig(t, srv, &oauth2.Token{AccessToken: "stale", RefreshToken: "refresh-ok", Expiry: expiry}, 0600)
+	cfg.CheckSentBeforeRetry = true
+
+	status, err := TokenStatus(context.Background(), discardLogger(), cfg)
+	require.NoError(t, err)
+	assert.True(t, status.OK(), "problems: %v", status.Problems)
+	assert.True(t, status.TokenFound)
+	assert.Equal(t, "0600", status.FileMode)
+	// Without the email scope the account comes from the Gmail profile.
+	assert.Equal(t, "relay@example.com", status.Account)
+	assert.Empty(t, status.AccountNote)
+	assert.Equal(t, 1, *profileCalls)
+	assert.Equal(t, []string{gmail.GmailSendScope, gmail.GmailReadonlyScope}, status.Scopes)
+	assert.Empty(t, status.MissingScopes)
+	require.NotNil(t, status.AccessTokenExpiry)
+	assert.True(t, expiry.Equal(*status.AccessTokenExpiry))
+	assert.True(t, status.HasRefreshToken)
+	assert.Equal(t, RefreshOK, status.Refresh)
+
+	// The status check does not write the refreshed token.
+	saved, err := tokenFromFile(discardLogger(), cfg.GoogleTokenPath)
+	require.NoError(t, err)
+	assert.Equal(t, "stale", saved.AccessToken)
+}
+
+func TestTokenStatus_AccountFromTokenInfo(t *testing.T) {
+	srv, profileCalls := newFakeStatusServer(t, gmail.GmailSendScope+" "+emailScope)
+	cfg := statusConfig(t, srv, &oauth2.Token{AccessToken: "stale", RefreshToken: "refresh-ok"}, 0600)
+
+	status, err := TokenStatus(context.Background(), discardLogger(), cfg)
+	require.NoError(t, err)
+	assert.True(t, status.OK(), "problems: %v", status.Problems)
+	assert.Equal(t, "relay@example.com", status.Account)
+	assert.Empty(t, status.AccountNote)
+	assert.Zero(t, *profileCalls, "the profile is not needed if tokeninfo reports the account")
+}
+
+func TestTokenStatus_Problems(t *testing.T) {
+	// A token lacking the scope RewriteFrom needs, in a file readable by
+	// everyone.
+	srv, profileCalls := newFakeStatusServer(t, gmail.GmailSendScope)
+	cfg := statusConfig(t, srv, &oauth2.Token{AccessToken: "stale", RefreshToken: "refresh-ok"}, 0644)
+	cfg.RewriteFrom = true
+
+	status, err := TokenStatus(context.Background(), discardLogger(), cfg)
+	require.NoError(t, err)
+	assert.False(t, status.OK())
+	// gmail.send alone allows neither tokeninfo nor the profile to name the account.
+	assert.Empty(t, status.Account)
+	assert.Contains(t, status.AccountNote, gmail.GmailReadonlyScope)
+	assert.Contains(t, status.AccountNote, "CheckSentBeforeRetry")
+	assert.Zero(t, *profileCalls)
+	assert.Equal(t, []string{gmail.GmailSettingsBasicScope}, status.MissingScopes)
+	wantProblems := 1
+	if runtime.GOOS != "windows" {
+		wantProblems++
+		assert.Contains(t, status.Problems[0], "0644")
+	}
+	require.Len(t, status.Problems, wantProblems)
+	assert.Contains(t, status.Problems[wantProblems-1], gmail.GmailSettingsBasicScope)
+}
+
+func TestTokenStatus_RefreshFails(t *testing.T) {
+	srv, _ := newFakeStatusServer(t, gmail.GmailSendScope)
+	cfg := statusConfig(t, srv, &oauth2.Token{AccessToken: "stale", RefreshToken: "revoked", Expiry: time.Now().Add(-time.Hour)}, 0600)
+
+	status, err := TokenStatus(context.Background(), discardLogger(), cfg)
+	require.NoError(t, err)
+	assert.False(t, status.OK())
+	assert.True(t, status.HasRefreshToken)
+	assert.Equal(t, RefreshFailed, status.Refresh)
+	assert.Contains(t, status.RefreshError, "invalid_grant")
+	assert.Empty(t, status.Scopes)
+}
+
+func TestTokenStatus_NoRefreshToken(t *testing.T) {
+	srv, _ := newFakeStatusServer(t, gmail.GmailSendScope)
+	cfg := statusConfig(t, srv, &oauth2.Token{AccessToken: "stale", Expiry: time.Now().Add(-time.Hour)}, 0600)
+
+	status, err := TokenStatus(context.Background(), discardLogger(), cfg)
+	require.NoError(t, err)
+	assert.False(t, status.OK())
+	assert.False(t, status.HasRefreshToken)
+	assert.Equal(t, RefreshNotAttempted, status.Refresh)
+	assert.Empty(t, status.RefreshError)
+}
+
+func TestTokenStatus_NoToken(t *testing.T) {
+	srv, _ := newFakeStatusServer(t, gmail.GmailSendScope)
+	cfg := statusConfig(t, srv, nil, 0)
+
+	status, err := TokenStatus(context.Background(), discardLogger(), cfg)
+	require.NoError(t, err)
+	assert.False(t, status.OK())
+	assert.False(t, status.TokenFound)
+
+	// The JSON output keeps the fields monitoring scripts check.
+	out, err := json.Marshal(status)
+	require.NoError(t, err)
+	assert.JSONEq(t, fmt.Sprintf(`{"token_path": %q, "token_found": false, "has_refresh_token": false, "refresh": "not_attempted", "problems": ["no token found, run 'smog auth login'"]}`, cfg.GoogleTokenPath), string(out))
+}
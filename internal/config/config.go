@@ -3,10 +3,16 @@ package config
 import (
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 
+	"github.com/ethanpil/smog/internal/message"
+	"github.com/ethanpil/smog/internal/netutil"
 	"github.com/spf13/viper"
 )
 
@@ -15,6 +21,106 @@ const (
 	DefaultSMTPPassword = "smoggmos"
 )
 
+// Bcc handling modes.
+const (
+	// BccModeLegacy writes every envelope recipient into the To header and sends a single message.
+	BccModeLegacy = "Legacy"
+	// BccModePrivate sends separate copies to recipients missing from the To and Cc headers.
+	BccModePrivate = "Private"
+)
+
+// TLS modes for a listener.
+const (
+	// TLSModeNone serves plaintext SMTP only.
+	TLSModeNone = "none"
+	// TLSModeStartTLS serves plaintext SMTP and offers STARTTLS.
+	TLSModeStartTLS = "starttls"
+	// TLSModeImplicit serves SMTP over TLS from the first byte (SMTPS).
+	TLSModeImplicit = "implicit"
+)
+
+// Received header modes.
+const (
+	// ReceivedHeaderFull records the client's HELO name, IP address and authenticated user.
+	ReceivedHeaderFull = "full"
+	// ReceivedHeaderAnonymous records only the relay, the protocol, the message ID and the time.
+	ReceivedHeaderAnonymous = "anonymous"
+	// ReceivedHeaderOff adds no Received header.
+	ReceivedHeaderOff = "off"
+)
+
+// SMTP AUTH mechanisms.
+const (
+	AuthPlain = "PLAIN"
+	AuthLogin = "LOGIN"
+	// AuthCRAMMD5 needs the plaintext password, so it only works for SMTPUser.
+	AuthCRAMMD5 = "CRAM-MD5"
+)
+
+// DefaultAuthMechanisms are offered on listeners that do not list their own.
+var DefaultAuthMechanisms = []string{AuthPlain, AuthLogin}
+
+// Listener configures a single SMTP listening socket and the policy applied to
+// the connections it accepts.
+type Listener struct {
+	// Address: The IP address to bind to. All interfaces are used if empty.
+	Address string `mapstructure:"Address"`
+	// Port: The TCP port to listen on.
+	Port int `mapstructure:"Port"`
+	// TLSMode: How TLS is offered. Options: "none", "starttls", "implicit".
+	TLSMode string `mapstructure:"TLSMode"`
+	// RequireAuth: Refuse MAIL until the client has authenticated. The global RequireAuth applies if unset.
+	RequireAuth bool `mapstructure:"RequireAuth"`
+	// AllowedSubnets: The client addresses allowed on this listener. The global AllowedSubnets apply if empty.
+	AllowedSubnets []string `mapstructure:"AllowedSubnets"`
+	// TrustedSubnets: The client addresses that may relay without AUTH on this listener. The global TrustedSubnets apply if empty.
+	TrustedSubnets []string `mapstructure:"TrustedSubnets"`
+	// AuthMechanisms: The AUTH mechanisms offered on this listener. The global AuthMechanisms apply if empty.
+	AuthMechanisms []string `mapstructure:"AuthMechanisms"`
+	// ReceivedHeader: The Received header added to messages from this listener. The global ReceivedHeader applies if empty.
+	ReceivedHeader string `mapstructure:"ReceivedHeader"`
+}
+
+// SenderRule restricts the sender addresses that the clients it applies to
+// may use, both in MAIL FROM and in the From header.
+type SenderRule struct {
+	// Users: The authenticated usernames the rule applies to.
+	Users []string `mapstructure:"Users"`
+	// Subnets: The client IP addresses or CIDR subnets the rule applies to. The rule applies to every client if both Users and Subnets are empty.
+	Subnets []string `mapstructure:"Subnets"`
+	// Senders: The allowed sender addresses. Entries are addresses, "@domain" or patterns with "*" and "?".
+	Senders []string `mapstructure:"Senders"`
+}
+
+// Rule changes the header of the messages it matches before they are sent.
+// All of its conditions that are set must match; a rule without conditions
+// matches every message.
+type Rule struct {
+	// Name: A name for the rule, used in logs.
+	Name string `mapstructure:"Name"`
+	// Subnets: Match clients with these IP addresses or CIDR subnets.
+	Subnets []string `mapstructure:"Subnets"`
+	// Users: Match clients authenticated as one of these usernames.
+	Users []string `mapstructure:"Users"`
+	// Senders: Match envelope senders. Entries are addresses, "@domain" or patterns with "*" and "?".
+	Senders []string `mapstructure:"Senders"`
+	// Recipients: Match messages with at least one such envelope recipient, in the same format as Senders.
+	Recipients []string `mapstructure:"Recipients"`
+	// Remove: Header fields to remove.
+	Remove []string `mapstructure:"Remove"`
+	// Set: "Name: value" header fields that replace any existing ones.
+	Set []string `mapstructure:"Set"`
+	// Prefix: "Name: prefix" entries that prefix the value of a header field, e.g. "Subject: [SCANNER]".
+	Prefix []string `mapstructure:"Prefix"`
+	// Add: "Name: value" header fields to add.
+	Add []string `mapstructure:"Add"`
+}
+
+// Addr returns the listener's address in host:port form.
+func (l Listener) Addr() string {
+	return net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+}
+
 // Config stores all configuration for the application.
 type Config struct {
 	// LogLevel: Set the detail level for logs. Options: "Disabled", "Minimal", "Verbose".
@@ -29,20 +135,84 @@ type Config struct {
 	SMTPUser string `mapstructure:"SMTPUser"`
 	// SMTPPassword: The password that SMTP clients must use.
 	SMTPPassword string `mapstructure:"SMTPPassword"`
+	// UsersPath: Path to the file of additional SMTP accounts managed with "smog user".
+	UsersPath string `mapstructure:"UsersPath"`
 	// SMTPPort: The TCP port for the SMTP server to listen on.
 	SMTPPort int `mapstructure:"SMTPPort"`
-	// MessageSizeLimitMB: The maximum email size (in Megabytes) to accept.
+	// SMTPSPort: The TCP port for an additional implicit TLS (SMTPS) listener. Disabled if 0.
+	SMTPSPort int `mapstructure:"SMTPSPort"`
+	// MessageSizeLimitMB: The maximum email size (in Megabytes) to accept. Capped at Gmail's limit of 35 MB.
 	MessageSizeLimitMB int `mapstructure:"MessageSizeLimitMB"`
+	// ResumableUploadThresholdMB: Messages larger than this (in Megabytes) are uploaded to Gmail with the resumable upload protocol, in chunks of 1 MB. Disabled if 0.
+	ResumableUploadThresholdMB int `mapstructure:"ResumableUploadThresholdMB"`
+	// SendRetries: The number of times a send that fails with a transient error or a rate limit is retried before the failure is reported. Disabled if 0.
+	SendRetries int `mapstructure:"SendRetries"`
+	// SendTimeout: The maximum duration in seconds for sending a message to Gmail, including retries.
+	SendTimeout int `mapstructure:"SendTimeout"`
+	// CheckSentBeforeRetry: Look for a message in the Sent folder before sending it again after an ambiguous failure. Needs the gmail.readonly scope.
+	CheckSentBeforeRetry bool `mapstructure:"CheckSentBeforeRetry"`
+	// HTTPResponseTimeout: The maximum duration in seconds to wait for the response of the Gmail API once a request has been sent.
+	HTTPResponseTimeout int `mapstructure:"HTTPResponseTimeout"`
+	// HTTPIdleConnTimeout: The duration in seconds an idle connection to the Gmail API is kept open for reuse.
+	HTTPIdleConnTimeout int `mapstructure:"HTTPIdleConnTimeout"`
+	// HTTPMaxIdleConns: The maximum number of idle connections to the Gmail API kept open for reuse.
+	HTTPMaxIdleConns int `mapstructure:"HTTPMaxIdleConns"`
 	// AllowedSubnets: A list of allowed client IP addresses or CIDR subnets.
 	AllowedSubnets []string `mapstructure:"AllowedSubnets"`
+	// RequireAuth: Refuse MAIL until the client has authenticated, unless it is in TrustedSubnets.
+	RequireAuth bool `mapstructure:"RequireAuth"`
+	// TrustedSubnets: Client IP addresses or CIDR subnets that may relay without authenticating.
+	TrustedSubnets []string `mapstructure:"TrustedSubnets"`
 	// ReadTimeout: The maximum duration in seconds for reading the entire request.
 	ReadTimeout int `mapstructure:"ReadTimeout"`
 	// WriteTimeout: The maximum duration in seconds for writing the response.
 	WriteTimeout int `mapstructure:"WriteTimeout"`
 	// MaxRecipients: The maximum number of recipients for a single email.
 	MaxRecipients int `mapstructure:"MaxRecipients"`
+	// RecipientAllow: The recipient addresses mail may be relayed to. Entries are addresses, "@domain" or patterns with "*" and "?". Any recipient is allowed if empty.
+	RecipientAllow []string `mapstructure:"RecipientAllow"`
+	// RecipientDeny: The recipient addresses mail is never relayed to, in the same format as RecipientAllow. It takes precedence over RecipientAllow.
+	RecipientDeny []string `mapstructure:"RecipientDeny"`
+	// AuthMechanisms: The AUTH mechanisms offered to clients. Options: "PLAIN", "LOGIN", "CRAM-MD5".
+	AuthMechanisms []string `mapstructure:"AuthMechanisms"`
 	// AllowInsecureAuth: Allow insecure authentication methods.
 	AllowInsecureAuth bool `mapstructure:"AllowInsecureAuth"`
+	// TLSCertPath: Path to a PEM certificate (chain) for STARTTLS. TLS is disabled if empty.
+	TLSCertPath string `mapstructure:"TLSCertPath"`
+	// TLSKeyPath: Path to the PEM private key matching TLSCertPath.
+	TLSKeyPath string `mapstructure:"TLSKeyPath"`
+	// TLSMinVersion: The minimum accepted TLS version. Options: "1.0", "1.1", "1.2", "1.3".
+	TLSMinVersion string `mapstructure:"TLSMinVersion"`
+	// TLSCipherSuites: The allowed TLS 1.0-1.2 cipher suites. The Go defaults are used if empty.
+	TLSCipherSuites []string `mapstructure:"TLSCipherSuites"`
+	// RequireTLS: Refuse AUTH and MAIL until the client has issued STARTTLS.
+	RequireTLS bool `mapstructure:"RequireTLS"`
+	// BccMode: How envelope-only (Bcc) recipients are handled. Options: "Legacy", "Private".
+	BccMode string `mapstructure:"BccMode"`
+	// RepairMessages: Fix bare LF line endings, missing Date, Message-ID and MIME-Version headers, and raw 8-bit header text before relaying.
+	RepairMessages bool `mapstructure:"RepairMessages"`
+	// LegacyCharset: The charset of raw 8-bit header text that is not UTF-8, e.g. "windows-1252" or "shift_jis".
+	LegacyCharset string `mapstructure:"LegacyCharset"`
+	// ReceivedHeader: The Received trace header added to relayed messages. Options: "anonymous" (default), "full", "off".
+	ReceivedHeader string `mapstructure:"ReceivedHeader"`
+	// RewriteFrom: Replace From headers the Gmail account may not send as with a verified send-as alias, moving the original sender to Reply-To.
+	RewriteFrom bool `mapstructure:"RewriteFrom"`
+	// FromAlias: The send-as alias RewriteFrom uses. The account's default send-as address is used if empty.
+	FromAlias string `mapstructure:"FromAlias"`
+	// Listeners: SMTP listeners, configured as [[Listener]] tables. SMTPPort and SMTPSPort are ignored if set.
+	Listeners []Listener `mapstructure:"Listener"`
+	// SenderRules: Restrictions on the sender addresses clients may use, configured as [[SenderRule]] tables.
+	SenderRules []SenderRule `mapstructure:"SenderRule"`
+	// Rules: Header rewriting rules, configured as [[Rule]] tables and applied in order.
+	Rules []Rule `mapstructure:"Rule"`
+	// SpoolPath: Directory for the persistent delivery queue. Messages are relayed synchronously if empty.
+	SpoolPath string `mapstructure:"SpoolPath"`
+	// SpoolWorkers: The number of concurrent delivery workers.
+	SpoolWorkers int `mapstructure:"SpoolWorkers"`
+	// SpoolMaxAttempts: The number of delivery attempts before a message is moved to the dead-letter directory.
+	SpoolMaxAttempts int `mapstructure:"SpoolMaxAttempts"`
+	// SpoolRetryInterval: The delay in seconds before the first retry. It doubles after every failed attempt.
+	SpoolRetryInterval int `mapstructure:"SpoolRetryInterval"`
 }
 
 // getDefaultTokenPath returns the default path for the token file.
@@ -107,6 +277,11 @@ func LoadConfig(path string) (config Config, err error) {
 		}
 	}
 
+	// If UsersPath is not set, keep the users file next to the config file.
+	if config.UsersPath == "" {
+		config.UsersPath = filepath.Join(getDefaultConfigDir(), "users.toml")
+	}
+
 	// GoogleCredentialsPath is mandatory.
 	if config.GoogleCredentialsPath == "" {
 		return config, fmt.Errorf("mandatory configuration field 'GoogleCredentialsPath' is not set")
@@ -122,16 +297,297 @@ func LoadConfig(path string) (config Config, err error) {
 	if config.MaxRecipients <= 0 {
 		config.MaxRecipients = 50
 	}
+	if config.SpoolWorkers <= 0 {
+		config.SpoolWorkers = 2
+	}
+	if config.SpoolMaxAttempts <= 0 {
+		config.SpoolMaxAttempts = 10
+	}
+	if config.SpoolRetryInterval <= 0 {
+		config.SpoolRetryInterval = 60
+	}
+	// 0 disables resumable uploads, so only a missing value gets the default.
+	if !viper.IsSet("ResumableUploadThresholdMB") {
+		config.ResumableUploadThresholdMB = 5
+	}
+	if config.ResumableUploadThresholdMB < 0 {
+		return config, fmt.Errorf("invalid 'ResumableUploadThresholdMB': %d is negative", config.ResumableUploadThresholdMB)
+	}
+	// 0 disables retries, so only a missing value gets the default.
+	if !viper.IsSet("SendRetries") {
+		config.SendRetries = 3
+	}
+	if config.SendRetries < 0 {
+		return config, fmt.Errorf("invalid 'SendRetries': %d is negative", config.SendRetries)
+	}
+	if config.SendTimeout <= 0 {
+		config.SendTimeout = 120
+	}
+	if config.HTTPResponseTimeout <= 0 {
+		config.HTTPResponseTimeout = 60
+	}
+	if config.HTTPIdleConnTimeout <= 0 {
+		config.HTTPIdleConnTimeout = 90
+	}
+	if config.HTTPMaxIdleConns <= 0 {
+		config.HTTPMaxIdleConns = 10
+	}
+
+	switch config.BccMode {
+	case "":
+		config.BccMode = BccModeLegacy
+	case BccModeLegacy, BccModePrivate:
+	default:
+		return config, fmt.Errorf("invalid BccMode %q: must be %q or %q", config.BccMode, BccModeLegacy, BccModePrivate)
+	}
+
+	if (config.TLSCertPath == "") != (config.TLSKeyPath == "") {
+		return config, fmt.Errorf("'TLSCertPath' and 'TLSKeyPath' must be set together")
+	}
+	if config.RequireTLS && config.TLSCertPath == "" {
+		return config, fmt.Errorf("'RequireTLS' needs a certificate: set 'TLSCertPath' and 'TLSKeyPath'")
+	}
+	if config.SMTPSPort > 0 && config.TLSCertPath == "" {
+		return config, fmt.Errorf("'SMTPSPort' needs a certificate: set 'TLSCertPath' and 'TLSKeyPath'")
+	}
+	if len(config.AuthMechanisms) == 0 {
+		config.AuthMechanisms = DefaultAuthMechanisms
+	}
+	if config.AuthMechanisms, err = normalizeAuthMechanisms(config.AuthMechanisms); err != nil {
+		return config, err
+	}
+
+	if err := netutil.ValidateSubnets(config.TrustedSubnets); err != nil {
+		return config, fmt.Errorf("invalid 'TrustedSubnets': %w", err)
+	}
+
+	config.ReceivedHeader = strings.ToLower(config.ReceivedHeader)
+	if config.ReceivedHeader == "" {
+		config.ReceivedHeader = ReceivedHeaderAnonymous
+	}
+	if err := validateReceivedHeader(config.ReceivedHeader); err != nil {
+		return config, err
+	}
+
+	for i := range config.Listeners {
+		l := &config.Listeners[i]
+		l.TLSMode = strings.ToLower(l.TLSMode)
+		l.ReceivedHeader = strings.ToLower(l.ReceivedHeader)
+		if l.TLSMode == "" {
+			l.TLSMode = TLSModeNone
+		}
+		if err := l.validate(config.TLSCertPath != ""); err != nil {
+			return config, fmt.Errorf("invalid listener %d: %w", i+1, err)
+		}
+		if l.AuthMechanisms, err = normalizeAuthMechanisms(l.AuthMechanisms); err != nil {
+			return config, fmt.Errorf("invalid listener %d: %w", i+1, err)
+		}
+		if err := netutil.ValidateSubnets(l.TrustedSubnets); err != nil {
+			return config, fmt.Errorf("invalid listener %d: invalid 'TrustedSubnets': %w", i+1, err)
+		}
+	}
+	if err := validateAddressPatterns(config.RecipientAllow); err != nil {
+		return config, fmt.Errorf("invalid 'RecipientAllow': %w", err)
+	}
+	if err := validateAddressPatterns(config.RecipientDeny); err != nil {
+		return config, fmt.Errorf("invalid 'RecipientDeny': %w", err)
+	}
+	for i, rule := range config.SenderRules {
+		if err := rule.validate(); err != nil {
+			return config, fmt.Errorf("invalid sender rule %d: %w", i+1, err)
+		}
+	}
+	for i := range config.Rules {
+		if err := config.Rules[i].validate(); err != nil {
+			return config, fmt.Errorf("invalid rule %d: %w", i+1, err)
+		}
+	}
+	if config.TLSMinVersion == "" {
+		config.TLSMinVersion = "1.2"
+	}
 
 	// If AllowInsecureAuth is not set, default it to true for consistency
 	// with the default configuration files.
 	if !viper.IsSet("AllowInsecureAuth") {
 		config.AllowInsecureAuth = true
 	}
+	if config.LegacyCharset == "" {
+		config.LegacyCharset = "windows-1252"
+	}
+	if _, err := message.LookupCharset(config.LegacyCharset); err != nil {
+		return config, fmt.Errorf("invalid 'LegacyCharset': %w", err)
+	}
+	// Clients must authenticate unless RequireAuth is explicitly disabled.
+	if !viper.IsSet("RequireAuth") {
+		config.RequireAuth = true
+	}
+	// A [[Listener]] table without RequireAuth inherits the global setting,
+	// so that adding a listener never turns authentication off by omission.
+	tables, _ := viper.Get("Listener").([]any)
+	for i := range config.Listeners {
+		if i >= len(tables) || !hasKey(tables[i], "RequireAuth") {
+			config.Listeners[i].RequireAuth = config.RequireAuth
+		}
+	}
 
 	return config, nil
 }
 
+// hasKey reports whether table, a TOML table decoded by viper, sets key.
+// Keys are matched case-insensitively, like viper does.
+func hasKey(table any, key string) bool {
+	m, ok := table.(map[string]any)
+	if !ok {
+		return false
+	}
+	for k := range m {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks a listener's settings. hasCert reports whether a TLS
+// certificate is configured.
+func (l *Listener) validate(hasCert bool) error {
+	if l.Port <= 0 || l.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", l.Port)
+	}
+	switch l.TLSMode {
+	case TLSModeNone:
+	case TLSModeStartTLS, TLSModeImplicit:
+		if !hasCert {
+			return fmt.Errorf("TLSMode %q needs a certificate: set 'TLSCertPath' and 'TLSKeyPath'", l.TLSMode)
+		}
+	default:
+		return fmt.Errorf("invalid TLSMode %q: must be %q, %q or %q", l.TLSMode, TLSModeNone, TLSModeStartTLS, TLSModeImplicit)
+	}
+	if l.Address != "" && net.ParseIP(l.Address) == nil {
+		return fmt.Errorf("address %q is not an IP address", l.Address)
+	}
+	if l.ReceivedHeader != "" {
+		if err := validateReceivedHeader(l.ReceivedHeader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateReceivedHeader checks a ReceivedHeader mode.
+func validateReceivedHeader(mode string) error {
+	switch mode {
+	case ReceivedHeaderFull, ReceivedHeaderAnonymous, ReceivedHeaderOff:
+		return nil
+	}
+	return fmt.Errorf("invalid ReceivedHeader %q: must be %q, %q or %q", mode, ReceivedHeaderFull, ReceivedHeaderAnonymous, ReceivedHeaderOff)
+}
+
+// validate checks a sender rule's settings.
+func (r *SenderRule) validate() error {
+	if len(r.Senders) == 0 {
+		return fmt.Errorf("'Senders' must not be empty")
+	}
+	if err := validateAddressPatterns(r.Senders); err != nil {
+		return fmt.Errorf("invalid 'Senders': %w", err)
+	}
+	if err := netutil.ValidateSubnets(r.Subnets); err != nil {
+		return fmt.Errorf("invalid 'Subnets': %w", err)
+	}
+	return nil
+}
+
+// validate checks a header rule's settings.
+func (r *Rule) validate() error {
+	if err := netutil.ValidateSubnets(r.Subnets); err != nil {
+		return fmt.Errorf("invalid 'Subnets': %w", err)
+	}
+	if err := validateAddressPatterns(r.Senders); err != nil {
+		return fmt.Errorf("invalid 'Senders': %w", err)
+	}
+	if err := validateAddressPatterns(r.Recipients); err != nil {
+		return fmt.Errorf("invalid 'Recipients': %w", err)
+	}
+	for _, name := range r.Remove {
+		if !message.ValidFieldName(name) {
+			return fmt.Errorf("invalid 'Remove': %q is not a header field name", name)
+		}
+	}
+	for _, entries := range [][]string{r.Set, r.Prefix, r.Add} {
+		for _, entry := range entries {
+			if _, _, err := message.ParseField(entry); err != nil {
+				return err
+			}
+		}
+	}
+	if len(r.Remove)+len(r.Set)+len(r.Prefix)+len(r.Add) == 0 {
+		return fmt.Errorf("the rule has no actions: set 'Remove', 'Set', 'Prefix' or 'Add'")
+	}
+	return nil
+}
+
+// validateAddressPatterns checks the syntax of address patterns.
+func validateAddressPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid address pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// EffectiveListeners returns the listeners to serve. If no [[Listener]] tables
+// are configured they are derived from SMTPPort and SMTPSPort, and take
+// RequireAuth from the global setting. Listeners without their own
+// AllowedSubnets, TrustedSubnets, AuthMechanisms or ReceivedHeader inherit the
+// global settings.
+func (c *Config) EffectiveListeners() []Listener {
+	listeners := make([]Listener, 0, len(c.Listeners))
+	if len(c.Listeners) > 0 {
+		listeners = append(listeners, c.Listeners...)
+	} else {
+		mode := TLSModeNone
+		if c.TLSCertPath != "" {
+			mode = TLSModeStartTLS
+		}
+		listeners = append(listeners, Listener{Port: c.SMTPPort, TLSMode: mode, RequireAuth: c.RequireAuth})
+		if c.SMTPSPort > 0 {
+			listeners = append(listeners, Listener{Port: c.SMTPSPort, TLSMode: TLSModeImplicit, RequireAuth: c.RequireAuth})
+		}
+	}
+
+	for i := range listeners {
+		if len(listeners[i].AllowedSubnets) == 0 {
+			listeners[i].AllowedSubnets = c.AllowedSubnets
+		}
+		if len(listeners[i].TrustedSubnets) == 0 {
+			listeners[i].TrustedSubnets = c.TrustedSubnets
+		}
+		if len(listeners[i].AuthMechanisms) == 0 {
+			listeners[i].AuthMechanisms = c.AuthMechanisms
+		}
+		if listeners[i].ReceivedHeader == "" {
+			listeners[i].ReceivedHeader = c.ReceivedHeader
+		}
+	}
+	return listeners
+}
+
+// normalizeAuthMechanisms upper-cases the mechanism names and rejects unknown ones.
+func normalizeAuthMechanisms(mechanisms []string) ([]string, error) {
+	var normalized []string
+	for _, mech := range mechanisms {
+		mech = strings.ToUpper(strings.TrimSpace(mech))
+		switch mech {
+		case AuthPlain, AuthLogin, AuthCRAMMD5:
+			normalized = append(normalized, mech)
+		default:
+			return nil, fmt.Errorf("invalid auth mechanism %q: must be %q, %q or %q", mech, AuthPlain, AuthLogin, AuthCRAMMD5)
+		}
+	}
+	return normalized, nil
+}
+
 // defaultConfigDirOverride is used for testing to override the default config directory.
 var defaultConfigDirOverride string
 
@@ -43,6 +43,7 @@ GoogleCredentialsPath = "/etc/smog/credentials.json"
 GoogleTokenPath = "/etc/smog/token.json"
 SMTPUser = "testuser"
 SMTPPassword = "testpassword"
+UsersPath = "/etc/smog/users.toml"
 SMTPPort = 2526
 MessageSizeLimitMB = 20
 AllowedSubnets = ["192.168.1.0/24", "10.0.0.1"]
@@ -64,19 +65,35 @@ AllowInsecureAuth = false
 		assert.NoError(t, err)
 
 		expected := Config{
-			LogLevel:              "Verbose",
-			LogPath:               "/var/log/smog.log",
-			GoogleCredentialsPath: "/etc/smog/credentials.json",
-			GoogleTokenPath:       "/etc/smog/token.json",
-			SMTPUser:              "testuser",
-			SMTPPassword:          "testpassword",
-			SMTPPort:              2526,
-			MessageSizeLimitMB:    20,
-			AllowedSubnets:        []string{"192.168.1.0/24", "10.0.0.1"},
-			ReadTimeout:           20,
-			WriteTimeout:          20,
-			MaxRecipients:         100,
-			AllowInsecureAuth:     false,
+			LogLevel:                   "Verbose",
+			LogPath:                    "/var/log/smog.log",
+			GoogleCredentialsPath:      "/etc/smog/credentials.json",
+			GoogleTokenPath:            "/etc/smog/token.json",
+			SMTPUser:                   "testuser",
+			SMTPPassword:               "testpassword",
+			UsersPath:                  "/etc/smog/users.toml",
+			SMTPPort:                   2526,
+			MessageSizeLimitMB:         20,
+			ResumableUploadThresholdMB: 5,
+			SendRetries:                3,
+			SendTimeout:                120,
+			HTTPResponseTimeout:        60,
+			HTTPIdleConnTimeout:        90,
+			HTTPMaxIdleConns:           10,
+			AllowedSubnets:             []string{"192.168.1.0/24", "10.0.0.1"},
+			RequireAuth:                true,
+			LegacyCharset:              "windows-1252",
+			ReceivedHeader:             ReceivedHeaderAnonymous,
+			ReadTimeout:                20,
+			WriteTimeout:               20,
+			MaxRecipients:              100,
+			AuthMechanisms:             []string{AuthPlain, AuthLogin},
+			AllowInsecureAuth:          false,
+			TLSMinVersion:              "1.2",
+			BccMode:                    BccModeLegacy,
+			SpoolWorkers:               2,
+			SpoolMaxAttempts:           10,
+			SpoolRetryInterval:         60,
 		}
 
 		assert.Equal(t, expected, config)
@@ -104,6 +121,208 @@ GoogleCredentialsPath = "/etc/smog/credentials.json"
 		assert.Equal(t, 50, config.MaxRecipients)
 		// Check that AllowInsecureAuth defaults to true when not specified.
 		assert.Equal(t, true, config.AllowInsecureAuth)
+		// Check that RequireAuth defaults to true when not specified.
+		assert.Equal(t, true, config.RequireAuth)
+		// Check that messages are relayed unchanged by default.
+		assert.Equal(t, false, config.RepairMessages)
+		assert.Equal(t, "windows-1252", config.LegacyCharset)
+		// Check that an anonymous Received header is added by default.
+		assert.Equal(t, ReceivedHeaderAnonymous, config.ReceivedHeader)
+		// Check that large messages use resumable uploads by default.
+		assert.Equal(t, 5, config.ResumableUploadThresholdMB)
+		assert.Equal(t, 3, config.SendRetries)
+		assert.Equal(t, 120, config.SendTimeout)
+		assert.Equal(t, 60, config.HTTPResponseTimeout)
+		assert.Equal(t, 90, config.HTTPIdleConnTimeout)
+		assert.Equal(t, 10, config.HTTPMaxIdleConns)
+	})
+
+	t.Run("TLSSettings", func(t *testing.T) {
+		testCases := []struct {
+			name    string
+			content string
+		}{
+			{"CertWithoutKey", `TLSCertPath = "/etc/smog/cert.pem"`},
+			{"KeyWithoutCert", `TLSKeyPath = "/etc/smog/key.pem"`},
+			{"RequireTLSWithoutCert", `RequireTLS = true`},
+			{"SMTPSPortWithoutCert", `SMTPSPort = 465`},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				tmpfile, err := os.CreateTemp("", "smog.toml")
+				assert.NoError(t, err)
+				defer os.Remove(tmpfile.Name())
+
+				_, err = tmpfile.WriteString("GoogleCredentialsPath = \"/etc/smog/credentials.json\"\n" + tc.content + "\n")
+				assert.NoError(t, err)
+				err = tmpfile.Close()
+				assert.NoError(t, err)
+
+				_, err = LoadConfig(tmpfile.Name())
+				assert.Error(t, err)
+			})
+		}
+	})
+
+	t.Run("Listeners", func(t *testing.T) {
+		content := `
+GoogleCredentialsPath = "/etc/smog/credentials.json"
+TLSCertPath = "/etc/smog/cert.pem"
+TLSKeyPath = "/etc/smog/key.pem"
+
+[[Listener]]
+Address = "127.0.0.1"
+Port = 25
+AllowedSubnets = ["127.0.0.1"]
+
+[[Listener]]
+Port = 2525
+requireauth = false
+
+[[Listener]]
+Port = 465
+TLSMode = "Implicit"
+RequireAuth = true
+AuthMechanisms = ["login", "cram-md5"]
+ReceivedHeader = "Anonymous"
+`
+		tmpfile, err := os.CreateTemp("", "smog.toml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.WriteString(content)
+		assert.NoError(t, err)
+		err = tmpfile.Close()
+		assert.NoError(t, err)
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.NoError(t, err)
+
+		expected := []Listener{
+			// A listener without RequireAuth inherits the global setting.
+			{Address: "127.0.0.1", Port: 25, TLSMode: TLSModeNone, RequireAuth: true, AllowedSubnets: []string{"127.0.0.1"}},
+			{Port: 2525, TLSMode: TLSModeNone},
+			{Port: 465, TLSMode: TLSModeImplicit, RequireAuth: true, AuthMechanisms: []string{AuthLogin, AuthCRAMMD5}, ReceivedHeader: ReceivedHeaderAnonymous},
+		}
+		assert.Equal(t, expected, config.Listeners)
+	})
+
+	t.Run("ListenerInheritsDisabledRequireAuth", func(t *testing.T) {
+		content := `
+GoogleCredentialsPath = "/etc/smog/credentials.json"
+RequireAuth = false
+
+[[Listener]]
+Port = 25
+`
+		tmpfile, err := os.CreateTemp("", "smog.toml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+		_, err = tmpfile.WriteString(content)
+		assert.NoError(t, err)
+		assert.NoError(t, tmpfile.Close())
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, []Listener{{Port: 25, TLSMode: TLSModeNone}}, config.Listeners)
+	})
+
+	t.Run("InvalidListeners", func(t *testing.T) {
+		testCases := []struct {
+			name    string
+			content string
+		}{
+			{"MissingPort", "[[Listener]]\nAddress = \"127.0.0.1\"\n"},
+			{"UnknownTLSMode", "[[Listener]]\nPort = 25\nTLSMode = \"always\"\n"},
+			{"TLSWithoutCert", "[[Listener]]\nPort = 465\nTLSMode = \"implicit\"\n"},
+			{"HostnameAddress", "[[Listener]]\nAddress = \"localhost\"\nPort = 25\n"},
+			{"UnknownAuthMechanism", "[[Listener]]\nPort = 25\nAuthMechanisms = [\"DIGEST-MD5\"]\n"},
+			{"InvalidTrustedSubnet", "[[Listener]]\nPort = 25\nTrustedSubnets = [\"192.168.1.0/33\"]\n"},
+			{"InvalidGlobalTrustedSubnet", "TrustedSubnets = [\"printers.lan\"]\n"},
+			{"UnknownReceivedHeader", "[[Listener]]\nPort = 25\nReceivedHeader = \"minimal\"\n"},
+			{"UnknownGlobalReceivedHeader", "ReceivedHeader = \"none\"\n"},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				tmpfile, err := os.CreateTemp("", "smog.toml")
+				assert.NoError(t, err)
+				defer os.Remove(tmpfile.Name())
+
+				_, err = tmpfile.WriteString("GoogleCredentialsPath = \"/etc/smog/credentials.json\"\n" + tc.content)
+				assert.NoError(t, err)
+				err = tmpfile.Close()
+				assert.NoError(t, err)
+
+				_, err = LoadConfig(tmpfile.Name())
+				assert.Error(t, err)
+			})
+		}
+	})
+
+	t.Run("SenderRules", func(t *testing.T) {
+		content := `
+GoogleCredentialsPath = "/etc/smog/credentials.json"
+
+[[SenderRule]]
+Subnets = ["192.168.1.0/24"]
+Senders = ["scanner-*@example.com"]
+
+[[SenderRule]]
+Users = ["alice"]
+Senders = ["@example.com"]
+`
+		tmpfile, err := os.CreateTemp("", "smog.toml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.WriteString(content)
+		assert.NoError(t, err)
+		err = tmpfile.Close()
+		assert.NoError(t, err)
+
+		config, err := LoadConfig(tmpfile.Name())
+		assert.NoError(t, err)
+
+		expected := []SenderRule{
+			{Subnets: []string{"192.168.1.0/24"}, Senders: []string{"scanner-*@example.com"}},
+			{Users: []string{"alice"}, Senders: []string{"@example.com"}},
+		}
+		assert.Equal(t, expected, config.SenderRules)
+	})
+
+	t.Run("InvalidPolicies", func(t *testing.T) {
+		testCases := []struct {
+			name    string
+			content string
+		}{
+			{"NoSenders", "[[SenderRule]]\nUsers = [\"alice\"]\n"},
+			{"BadPattern", "[[SenderRule]]\nSenders = [\"[a-@example.com\"]\n"},
+			{"BadSubnet", "[[SenderRule]]\nSubnets = [\"lan\"]\nSenders = [\"@example.com\"]\n"},
+			{"BadRecipientAllow", "RecipientAllow = [\"[example.com\"]\n"},
+			{"BadRecipientDeny", "RecipientDeny = [\"@[.com\"]\n"},
+			{"UnknownLegacyCharset", "LegacyCharset = \"klingon\"\n"},
+			{"NegativeResumableUploadThreshold", "ResumableUploadThresholdMB = -1\n"},
+			{"NegativeSendRetries", "SendRetries = -1\n"},
+			{"RuleWithoutActions", "[[Rule]]\nSubnets = [\"192.168.1.20\"]\n"},
+			{"RuleBadField", "[[Rule]]\nAdd = [\"X-Device scanner\"]\n"},
+			{"RuleBadRemove", "[[Rule]]\nRemove = [\"X Mailer\"]\n"},
+			{"RuleBadSubnet", "[[Rule]]\nSubnets = [\"scanner\"]\nRemove = [\"X-Mailer\"]\n"},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				tmpfile, err := os.CreateTemp("", "smog.toml")
+				assert.NoError(t, err)
+				defer os.Remove(tmpfile.Name())
+
+				_, err = tmpfile.WriteString("GoogleCredentialsPath = \"/etc/smog/credentials.json\"\n" + tc.content)
+				assert.NoError(t, err)
+				err = tmpfile.Close()
+				assert.NoError(t, err)
+
+				_, err = LoadConfig(tmpfile.Name())
+				assert.Error(t, err)
+			})
+		}
 	})
 
 	t.Run("NonExistentConfigFile", func(t *testing.T) {
@@ -158,3 +377,51 @@ AllowedSubnets = ["3.3.3.3"]
 		assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, config.AllowedSubnets)
 	})
 }
+
+func TestEffectiveListeners(t *testing.T) {
+	t.Run("DerivedFromPorts", func(t *testing.T) {
+		cfg := &Config{
+			SMTPPort:       2525,
+			SMTPSPort:      465,
+			TLSCertPath:    "/etc/smog/cert.pem",
+			AllowedSubnets: []string{"192.168.1.0/24"},
+			RequireAuth:    true,
+			TrustedSubnets: []string{"192.168.1.50"},
+			ReceivedHeader: ReceivedHeaderFull,
+		}
+		expected := []Listener{
+			{Port: 2525, TLSMode: TLSModeStartTLS, RequireAuth: true, AllowedSubnets: []string{"192.168.1.0/24"}, TrustedSubnets: []string{"192.168.1.50"}, ReceivedHeader: ReceivedHeaderFull},
+			{Port: 465, TLSMode: TLSModeImplicit, RequireAuth: true, AllowedSubnets: []string{"192.168.1.0/24"}, TrustedSubnets: []string{"192.168.1.50"}, ReceivedHeader: ReceivedHeaderFull},
+		}
+		assert.Equal(t, expected, cfg.EffectiveListeners())
+	})
+
+	t.Run("PlaintextWithoutCert", func(t *testing.T) {
+		cfg := &Config{SMTPPort: 2525}
+		assert.Equal(t, []Listener{{Port: 2525, TLSMode: TLSModeNone}}, cfg.EffectiveListeners())
+	})
+
+	t.Run("ConfiguredListenersWin", func(t *testing.T) {
+		cfg := &Config{
+			SMTPPort:       2525,
+			AllowedSubnets: []string{"10.0.0.0/8"},
+			AuthMechanisms: []string{AuthPlain},
+			ReceivedHeader: ReceivedHeaderFull,
+			Listeners: []Listener{
+				{Address: "127.0.0.1", Port: 25, TLSMode: TLSModeNone, AllowedSubnets: []string{"127.0.0.1"}, AuthMechanisms: []string{AuthCRAMMD5}, ReceivedHeader: ReceivedHeaderOff},
+				{Port: 587, TLSMode: TLSModeStartTLS, RequireAuth: true},
+			},
+		}
+		expected := []Listener{
+			{Address: "127.0.0.1", Port: 25, TLSMode: TLSModeNone, AllowedSubnets: []string{"127.0.0.1"}, AuthMechanisms: []string{AuthCRAMMD5}, ReceivedHeader: ReceivedHeaderOff},
+			{Port: 587, TLSMode: TLSModeStartTLS, RequireAuth: true, AllowedSubnets: []string{"10.0.0.0/8"}, AuthMechanisms: []string{AuthPlain}, ReceivedHeader: ReceivedHeaderFull},
+		}
+		assert.Equal(t, expected, cfg.EffectiveListeners())
+		// The configured listeners are not modified.
+		assert.Nil(t, cfg.Listeners[1].AllowedSubnets)
+	})
+
+	assert.Equal(t, "127.0.0.1:25", Listener{Address: "127.0.0.1", Port: 25}.Addr())
+	assert.Equal(t, "[::1]:25", Listener{Address: "::1", Port: 25}.Addr())
+	assert.Equal(t, ":2525", Listener{Port: 2525}.Addr())
+}
@@ -33,22 +33,145 @@ GoogleTokenPath = ""
 
 # --- SMTP Server Settings ---
 # SMTPUser: The username that SMTP clients must use to authenticate.
+# This account is only enabled while both SMTPUser and SMTPPassword are set. Leave
+# SMTPPassword empty to use only the accounts in UsersPath.
 SMTPUser = "smog"
 
 # SMTPPassword: The password that SMTP clients must use.
 # IMPORTANT: Change this from the default value before running!
 SMTPPassword = "%s"
 
+# UsersPath: Path to a file of additional SMTP accounts with hashed (bcrypt or argon2id)
+# passwords, optional allowed envelope senders and recipient limits. Manage it with the
+# "smog user add/remove/passwd/list" commands; changes are picked up without a restart.
+# If empty, it defaults to users.toml in the configuration directory.
+# Example: UsersPath = "C:\\ProgramData\\smog\\users.toml"
+UsersPath = ""
+
 # SMTPPort: The TCP port for the SMTP server to listen on.
 SMTPPort = 2525
 
-# MessageSizeLimitMB: The maximum email size (in Megabytes) to accept.
+# SMTPSPort: The TCP port for an additional listener that speaks implicit TLS (SMTPS),
+# for clients that cannot use STARTTLS. The conventional port is 465.
+# Requires TLSCertPath and TLSKeyPath. Set to 0 to disable.
+SMTPSPort = 0
+
+# MessageSizeLimitMB: The maximum email size (in Megabytes) to accept. Gmail accepts
+# messages up to 35 MB; larger values are capped at that limit.
 MessageSizeLimitMB = 10
 
+# ResumableUploadThresholdMB: Messages larger than this (in Megabytes) are uploaded to
+# Gmail in chunks of 1 MB with the resumable upload protocol, so that an upload
+# interrupted by a network error continues where it stopped instead of starting over.
+# Messages over 1 MB up to this size are streamed in a single request. Each upload
+# holds up to this much of the message in memory. Set to 0 to stream every message
+# in a single request instead.
+ResumableUploadThresholdMB = 5
+
+# SendRetries: The number of times a send that fails with a network error, a Gmail
+# server error or a rate limit is retried before the failure is reported. Retries
+# wait with exponential backoff, or as long as Gmail asks with a Retry-After header.
+# Set to 0 to disable retries.
+SendRetries = 3
+
+# SendTimeout: The maximum duration in seconds for sending a message to Gmail,
+# including retries. The SMTP client waits this long at most for its reply.
+SendTimeout = 120
+
+# CheckSentBeforeRetry: When a send fails in a way that leaves it unclear whether
+# Gmail received the message, e.g. a dropped connection, look for its Message-ID in
+# the Sent folder before sending it again, so that it is not delivered twice.
+# Messages without a Message-ID are given one.
+# Requires the gmail.readonly scope: run 'smog auth revoke' and 'smog auth login'
+# after enabling it.
+CheckSentBeforeRetry = false
+
+# HTTPResponseTimeout: The maximum duration in seconds to wait for the response of
+# the Gmail API once a request, including the message upload, has been sent.
+HTTPResponseTimeout = 60
+
+# HTTPIdleConnTimeout: The duration in seconds an idle connection to the Gmail API
+# is kept open, so that the next message does not have to set up a new one.
+HTTPIdleConnTimeout = 90
+
+# HTTPMaxIdleConns: The maximum number of idle connections to the Gmail API kept
+# open for reuse. Set it to about the number of messages sent at the same time,
+# e.g. SpoolWorkers or the number of concurrent SMTP clients.
+HTTPMaxIdleConns = 10
+
 # AllowedSubnets: A list of allowed client IP addresses or CIDR subnets.
 # Example: AllowedSubnets = ["192.168.1.0/24", "127.0.0.1"]
 AllowedSubnets = []
 
+# RequireAuth: Refuse to accept mail until the client has authenticated with
+# SMTPUser or an account from UsersPath. Clients in TrustedSubnets are exempt.
+RequireAuth = true
+
+# TrustedSubnets: Client IP addresses or CIDR subnets that may relay without
+# authenticating, for devices that have no way to enter SMTP credentials. Clients
+# outside these networks must still authenticate if RequireAuth is set. Keep this
+# list as narrow as possible: anyone on a trusted network can send as your account.
+# Example: TrustedSubnets = ["192.168.1.20", "10.10.0.0/24"]
+TrustedSubnets = []
+
+# RecipientAllow: The recipient addresses mail may be relayed to. Entries are
+# addresses, "@domain" for a whole domain, "@*.domain" for its subdomains, or
+# patterns such as "alerts-*@example.com". Any recipient is allowed if empty.
+# Refused recipients get a 550 reply; the message still goes to the others.
+# Example: RecipientAllow = ["@example.com", "@*.example.com"]
+RecipientAllow = []
+
+# RecipientDeny: The recipient addresses mail is never relayed to, in the same
+# format as RecipientAllow. It takes precedence over RecipientAllow.
+# Example: RecipientDeny = ["@competitor.example", "all-staff@example.com"]
+RecipientDeny = []
+
+# BccMode: How recipients that are in the SMTP envelope (RCPT TO) but not in the
+# message's To or Cc headers, i.e. Bcc recipients, are handled.
+#   "Legacy"  - All envelope recipients are written into the To header and a single
+#               message is sent. Bcc recipients are visible to everyone.
+#   "Private" - The message is sent unchanged to the To and Cc recipients, and a
+#               separate copy is sent to each Bcc recipient. This keeps Bcc private
+#               but uses one additional Gmail API call per Bcc recipient.
+BccMode = "Legacy"
+
+# RewriteFrom: Gmail replaces a From header the account is not allowed to send as
+# with the account's address, which confuses recipients and breaks replies. When
+# enabled, smog looks up the account's verified send-as aliases at startup and
+# rewrites such From headers to FromAlias itself, moving the original sender into
+# Reply-To (unless the message already has one).
+# Enabling this adds the gmail.settings.basic scope: run "smog auth revoke" and
+# "smog auth login" again afterwards.
+RewriteFrom = false
+
+# FromAlias: The send-as address RewriteFrom uses. It must be the account's address
+# or a verified send-as alias. If empty, the account's default send-as address is used.
+# Example: FromAlias = "devices@example.com"
+FromAlias = ""
+
+# RepairMessages: Fixes messages from older devices before they are relayed:
+# bare LF line endings, a missing header block, missing Date, Message-ID and
+# MIME-Version fields, and raw 8-bit text in headers, which is encoded as
+# RFC 2047. The repairs applied to each message are logged. Leave it off to relay
+# well-formed mail byte for byte; turn it on if a device's mail is rejected or
+# garbled.
+RepairMessages = false
+
+# LegacyCharset: The character set of raw 8-bit header text that is not valid
+# UTF-8, used by RepairMessages. Examples: "windows-1252", "iso-8859-1", "shift_jis".
+LegacyCharset = "windows-1252"
+
+# ReceivedHeader: The Received trace header added to the top of every relayed
+# message, which shows recipients where and when it entered the mail system.
+# Options:
+#   "full"      - Records the client's HELO name and IP address, the authenticated
+#                 user, the recipient (for single-recipient messages) and a queue ID
+#                 that also appears in the log.
+#   "anonymous" - Records only this host, the protocol, the queue ID and the time.
+#   "off"       - Adds no Received header.
+# The client details in "full" are visible to every recipient, so it is opt-in.
+ReceivedHeader = "anonymous"
+
 
 # --- Advanced SMTP Settings ---
 # ReadTimeout: The maximum duration in seconds for reading an entire SMTP request.
@@ -66,4 +189,151 @@ MaxRecipients = 50
 # non-TLS connections. This is not recommended and should only be enabled for
 # legacy clients that do not support STARTTLS.
 AllowInsecureAuth = true
+
+# AuthMechanisms: The SMTP AUTH mechanisms offered to clients.
+#   "PLAIN"    - The standard mechanism, supported by nearly all clients.
+#   "LOGIN"    - An older mechanism still required by some copiers and applications.
+#   "CRAM-MD5" - A challenge-response mechanism that never sends the password. It needs
+#                the plaintext password, so it only works for the SMTPUser account.
+# PLAIN and LOGIN send the password unencrypted unless TLS is used.
+AuthMechanisms = ["PLAIN", "LOGIN"]
+
+
+# --- TLS Settings ---
+# TLSCertPath: Path to a PEM encoded certificate, optionally followed by its chain.
+# When set together with TLSKeyPath, STARTTLS is offered to clients. The files are
+# reloaded automatically when they change, so certificates can be renewed without
+# restarting smog.
+# Example: TLSCertPath = "C:\\ProgramData\\smog\\cert.pem"
+TLSCertPath = ""
+
+# TLSKeyPath: Path to the PEM encoded private key for TLSCertPath.
+# Example: TLSKeyPath = "C:\\ProgramData\\smog\\key.pem"
+TLSKeyPath = ""
+
+# TLSMinVersion: The minimum TLS version accepted from clients.
+# Options: "1.0", "1.1", "1.2", "1.3". Only lower this for old devices that need it.
+TLSMinVersion = "1.2"
+
+# TLSCipherSuites: The cipher suites allowed for TLS 1.2 and older, using the Go names.
+# If empty, a secure default list is used. TLS 1.3 suites cannot be changed.
+# Example: TLSCipherSuites = ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"]
+TLSCipherSuites = []
+
+# RequireTLS: Refuse AUTH and MAIL commands until the client has issued STARTTLS.
+# Requires TLSCertPath and TLSKeyPath. Enabling it also disables AllowInsecureAuth.
+RequireTLS = false
+
+
+# --- Delivery Queue Settings ---
+# SpoolPath: Directory for the persistent delivery queue. When set, accepted messages
+# are written to disk before the client is answered and are delivered by background
+# workers that retry failed sends. If empty, messages are relayed synchronously and
+# the client must retry on failure.
+# Example: SpoolPath = "C:\\ProgramData\\smog\\spool"
+SpoolPath = ""
+
+# SpoolWorkers: The number of messages delivered concurrently from the queue.
+SpoolWorkers = 2
+
+# SpoolMaxAttempts: The number of delivery attempts before a message is moved to the
+# "dead" sub-directory of SpoolPath for manual inspection.
+SpoolMaxAttempts = 10
+
+# SpoolRetryInterval: The delay in seconds before the first retry. The delay doubles
+# after every failed attempt, up to one hour.
+SpoolRetryInterval = 60
+
+# The [[SenderRule]], [[Rule]] and [[Listener]] sections below are TOML arrays of
+# tables. Keep them after all top-level settings: every key that follows a table
+# header belongs to that table.
+
+# --- Sender Rules ---
+# By default a client may use any sender address, and an account from UsersPath any
+# address allowed by its AllowedSenders. [[SenderRule]] tables restrict the envelope
+# sender (MAIL FROM) and the From header addresses further. Messages that break a
+# rule are refused with a 550 reply naming the address, and the mismatch is logged.
+#
+# Each rule accepts the following settings:
+#   Users   - The authenticated usernames the rule applies to.
+#   Subnets - The client IP addresses or CIDR subnets the rule applies to.
+#             A rule without Users and Subnets applies to every client.
+#   Senders - The allowed sender addresses: an address, "@domain" for a whole
+#             domain, or a pattern such as "scanner-*@example.com".
+# A client must satisfy every rule that applies to it.
+#
+# Example: devices on the local network may only send as a device address, and the
+# account "alice" only from her own domain.
+# [[SenderRule]]
+# Subnets = ["192.168.1.0/24"]
+# Senders = ["scanner-*@example.com", "printer@example.com"]
+#
+# [[SenderRule]]
+# Users = ["alice"]
+# Senders = ["@example.com"]
+
+# --- Header Rules ---
+# [[Rule]] tables change the header of matching messages before they are sent, e.g.
+# to tag the mail of a device. Rules are applied in order, and every rule whose
+# conditions all match is applied. Test them with "smog rules test <file.eml>".
+#
+# Conditions (a rule without conditions matches every message):
+#   Subnets    - The client IP addresses or CIDR subnets.
+#   Users      - The authenticated usernames.
+#   Senders    - The envelope sender: an address, "@domain" or a pattern.
+#   Recipients - At least one envelope recipient, in the same format as Senders.
+# Actions, applied in this order:
+#   Remove     - Header fields to remove, e.g. ["X-Mailer"].
+#   Set        - "Name: value" fields that replace any existing ones.
+#   Prefix     - "Name: prefix" entries that prefix a field, unless it already
+#                contains the prefix.
+#   Add        - "Name: value" fields to add.
+#
+# Example: tag the mail of a scanner and send replies to the help desk.
+# [[Rule]]
+# Name = "scanner"
+# Subnets = ["192.168.1.20"]
+# Prefix = ["Subject: [SCANNER]"]
+# Set = ["Reply-To: helpdesk@example.com"]
+# Remove = ["X-Mailer"]
+# Add = ["X-Smog-Device: scanner"]
+
+# --- Listeners ---
+# By default smog listens on SMTPPort (and SMTPSPort, if set) on all interfaces, with
+# the global RequireAuth, AllowedSubnets and TrustedSubnets. To serve several ports
+# with different policies, add one [[Listener]] table per socket instead. SMTPPort
+# and SMTPSPort are then ignored.
+#
+# Each listener accepts the following settings:
+#   Address        - The IP address to bind to. All interfaces are used if empty.
+#   Port           - The TCP port to listen on.
+#   TLSMode        - "none" (plaintext only), "starttls" (STARTTLS is offered) or
+#                    "implicit" (SMTPS). TLS modes need TLSCertPath and TLSKeyPath.
+#   RequireAuth    - Refuse to accept mail until the client has authenticated.
+#                    The global RequireAuth applies if unset.
+#   AllowedSubnets - The clients allowed on this listener. The global AllowedSubnets
+#                    apply if empty.
+#   TrustedSubnets - The clients that may relay on this listener without
+#                    authenticating. The global TrustedSubnets apply if empty.
+#   AuthMechanisms - The AUTH mechanisms offered on this listener. The global
+#                    AuthMechanisms apply if empty.
+#   ReceivedHeader - The Received header added to messages from this listener. The
+#                    global ReceivedHeader applies if empty.
+# RequireTLS applies to "starttls" listeners only.
+#
+# Example: an unauthenticated port for printers on the local network, and an
+# authenticated TLS port for everything else.
+# [[Listener]]
+# Address = "192.168.1.10"
+# Port = 25
+# TLSMode = "none"
+# RequireAuth = false
+# AllowedSubnets = ["192.168.1.0/24"]
+# AuthMechanisms = ["PLAIN", "LOGIN", "CRAM-MD5"]
+# ReceivedHeader = "full"
+#
+# [[Listener]]
+# Port = 465
+# TLSMode = "implicit"
+# RequireAuth = true
 `, filepath.Join(os.Getenv("ProgramData"), "smog", "credentials.json"), DefaultSMTPPassword)
@@ -1,6 +1,7 @@
 package gmail
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/base64"
@@ -9,98 +10,514 @@ import (
 	"log/slog"
 	"net/http"
 	"net/mail"
+	"sort"
 	"strings"
+	"time"
 
-	"golang.org/x/oauth2"
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/ethanpil/smog/internal/message"
 	gapi "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
+// mediaUploadThreshold is the message size above which messages are streamed
+// to the media upload endpoint instead of being sent base64-encoded in the Raw
+// field of a JSON request, which needs the whole message in memory twice.
+const mediaUploadThreshold = 1 << 20
+
+// resumableChunkSize is the size of the chunks of a resumable upload. It is
+// not larger than any ResumableUploadThresholdMB, so that every message above
+// the threshold takes more than one chunk, which is what makes the upload
+// resumable.
+const resumableChunkSize = 1 << 20
+
+// MaxMessageSize is the largest message the Gmail API accepts.
+const MaxMessageSize = 35 << 20
+
+// MessageSizeLimit returns the size limit in bytes for relayed messages:
+// limitMB megabytes, capped at MaxMessageSize. Messages above
+// mediaUploadThreshold are uploaded without base64 encoding, and smaller ones
+// stay far below the limit even when encoded, so the limit applies to the raw
+// message size.
+func MessageSizeLimit(limitMB int) int64 {
+	limit := int64(limitMB) << 20
+	if limit <= 0 || limit > MaxMessageSize {
+		return MaxMessageSize
+	}
+	return limit
+}
+
 // Service is the interface for the Gmail client.
 type Service interface {
-	Send(ctx context.Context, token *oauth2.Token, recipients []string, rawEmail io.Reader) (*gapi.Message, error)
+	Send(ctx context.Context, recipients []string, src Source) (*gapi.Message, error)
 }
 
-// Client is a wrapper around the Gmail API client.
+// Source opens a raw email for reading. It returns a new reader for the whole
+// email each time it is called, since every delivery and every retry reads the
+// email again.
+type Source func() (io.Reader, error)
+
+// ReaderAtSource returns a Source that reads the first size bytes of r, such
+// as a file holding the email.
+func ReaderAtSource(r io.ReaderAt, size int64) Source {
+	return func() (io.Reader, error) {
+		return io.NewSectionReader(r, 0, size), nil
+	}
+}
+
+// Client is a wrapper around the Gmail API client. The http.Client it is given
+// must authenticate its requests, e.g. one created by auth.GetClient.
 type Client struct {
 	logger *slog.Logger
-	client *http.Client
+	cfg    *config.Config
+
+	// srv is the Gmail API service shared by all sends, or nil if it could
+	// not be created, in which case srvErr says why.
+	srv    *gapi.Service
+	srvErr error
+
+	// sendAs holds the lower-cased addresses the account may send as, and
+	// fromAlias the address RewriteFrom puts in their place. Both are set by
+	// LoadSendAs before the client is used.
+	sendAs    map[string]bool
+	fromAlias *mail.Address
+
+	// retryBase is the delay before the first retry of a failed send.
+	retryBase time.Duration
 }
 
-// New creates a new Gmail client.
-func New(logger *slog.Logger, client *http.Client) Service {
-	return &Client{
-		logger: logger,
-		client: client,
+// New creates a new Gmail client. The Gmail API service is created once and
+// shared by all calls, so that concurrent sessions reuse the connections of
+// the http.Client.
+func New(logger *slog.Logger, client *http.Client, cfg *config.Config) *Client {
+	c := &Client{
+		logger:    logger,
+		cfg:       cfg,
+		retryBase: defaultRetryBase,
 	}
+	c.srv, c.srvErr = newService(client)
+	if c.srvErr != nil {
+		logger.Error("failed to create gmail service", "error", c.srvErr)
+	}
+	return c
 }
 
-// replaceToHeader parses a raw email from a reader, replaces its 'To' header
-// with the given recipients, and returns the reconstructed raw email as bytes.
-func replaceToHeader(logger *slog.Logger, recipients []string, rawEmail io.Reader) ([]byte, error) {
-	msg, err := mail.ReadMessage(rawEmail)
+// newService creates a Gmail API service that makes its calls with client.
+func newService(client *http.Client) (*gapi.Service, error) {
+	srv, err := gapi.NewService(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gmail service: %w", err)
+	}
+	return srv, nil
+}
+
+// PartialError is returned by Send when a message that had to be split into
+// several deliveries reached some of its recipients but not all of them.
+type PartialError struct {
+	// Delivered lists the envelope recipients that received the message.
+	Delivered []string
+	Err       error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("message delivered to %d recipient(s) only: %v", len(e.Delivered), e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// LoadSendAs looks up the addresses the account may send as: its primary
+// address and the send-as aliases whose verification has been accepted. From
+// then on Send rewrites the From header of messages that use any other
+// address to FromAlias, or to the account's default send-as address. Listing
+// the aliases needs the gmail.settings.basic scope.
+func (c *Client) LoadSendAs(ctx context.Context) error {
+	if c.srvErr != nil {
+		return c.srvErr
+	}
+	resp, err := c.srv.Users.Settings.SendAs.List("me").Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to list send-as aliases (run 'smog auth revoke' and 'smog auth login' if the token lacks the gmail.settings.basic scope): %w", err)
+	}
+
+	sendAs := make(map[string]bool)
+	var alias *mail.Address
+	for _, a := range resp.SendAs {
+		if !a.IsPrimary && a.VerificationStatus != "accepted" {
+			c.logger.Debug("ignoring unverified send-as alias", "address", a.SendAsEmail)
+			continue
+		}
+		email := strings.ToLower(a.SendAsEmail)
+		sendAs[email] = true
+		addr := &mail.Address{Name: a.DisplayName, Address: a.SendAsEmail}
+		if c.cfg.FromAlias != "" {
+			if email == strings.ToLower(c.cfg.FromAlias) {
+				alias = addr
+			}
+		} else if a.IsDefault || (alias == nil && a.IsPrimary) {
+			alias = addr
+		}
+	}
+	if alias == nil {
+		if c.cfg.FromAlias != "" {
+			return fmt.Errorf("FromAlias %s is not a verified send-as address of the account", c.cfg.FromAlias)
+		}
+		return fmt.Errorf("the account has no default send-as address")
+	}
+
+	c.sendAs = sendAs
+	c.fromAlias = alias
+	c.logger.Info("loaded gmail send-as aliases", "aliases", len(sendAs), "from_alias", alias.Address)
+	return nil
+}
+
+// fromEdit returns the edit that replaces a From header with addresses the
+// account may not send as by the send-as alias, and keeps the original sender
+// reachable by moving it to Reply-To, unless the message already has one.
+// Gmail would otherwise replace such a From header itself, without a
+// Reply-To. The edit is empty if LoadSendAs has not been called.
+func (c *Client) fromEdit(header *message.Header) headerEdit {
+	if c.fromAlias == nil {
+		return headerEdit{}
+	}
+	from := strings.Join(header.Values("From"), ", ")
+	if c.maySendAs(from) {
+		return headerEdit{}
+	}
+
+	edit := headerEdit{set: map[string]string{"From": c.fromAlias.String()}}
+	if from != "" && !header.Has("Reply-To") {
+		edit.set["Reply-To"] = from
+	}
+	c.logger.Info("rewrote from header to send-as alias", "from", from, "alias", c.fromAlias.Address)
+	return edit
+}
+
+// maySendAs reports whether every address in a From header value is one of
+// the account's send-as addresses.
+func (c *Client) maySendAs(from string) bool {
+	if from == "" {
+		return false
+	}
+	addrs, err := mail.ParseAddressList(from)
+	if err != nil {
+		c.logger.Warn("could not parse from header", "from", from, "error", err)
+		return false
+	}
+	for _, addr := range addrs {
+		if !c.sendAs[strings.ToLower(addr.Address)] {
+			return false
+		}
+	}
+	return true
+}
+
+// headerEdit describes the changes rewriteHeaders makes to a message header.
+type headerEdit struct {
+	// set replaces every existing instance of a header with a single value.
+	set map[string]string
+	// remove deletes every instance of a header.
+	remove []string
+}
+
+// merge returns an edit that applies both e and other. Fields set by other
+// take precedence.
+func (e headerEdit) merge(other headerEdit) headerEdit {
+	merged := headerEdit{
+		set:    make(map[string]string, len(e.set)+len(other.set)),
+		remove: append(append([]string(nil), e.remove...), other.remove...),
+	}
+	for name, value := range e.set {
+		merged.set[name] = value
+	}
+	for name, value := range other.set {
+		merged.set[name] = value
+	}
+	return merged
+}
+
+// rewriteHeaders reads the header of a raw email from a reader, applies the
+// edit to it, and returns the reconstructed raw email. Only the fields named
+// in the edit are touched; every other field keeps its position, repetitions,
+// folding and encoding. The body is streamed unchanged from rawEmail.
+func rewriteHeaders(logger *slog.Logger, rawEmail io.Reader, edit headerEdit) (io.Reader, error) {
+	br := bufio.NewReader(rawEmail)
+	header, err := message.ReadHeader(br)
 	if err != nil {
 		logger.Error("failed to parse raw email for header replacement", "error", err)
 		return nil, fmt.Errorf("failed to parse raw email: %w", err)
 	}
 
-	// Replace the 'To' header.
-	if len(recipients) > 0 {
-		msg.Header["To"] = []string{strings.Join(recipients, ", ")}
-	} else {
-		// If there are no recipients, remove the 'To' header to avoid ambiguity.
-		delete(msg.Header, "To")
+	for _, name := range edit.remove {
+		header.Del(name)
 	}
-
-	var newEmailBuffer bytes.Buffer
-	for k, v := range msg.Header {
-		// TODO: This is a simplified header writer. A more robust implementation
-		// would handle multi-line headers and proper encoding.
-		newEmailBuffer.WriteString(fmt.Sprintf("%s: %s\r\n", k, strings.Join(v, ", ")))
+	// Apply the edits in a fixed order so the output is deterministic.
+	names := make([]string, 0, len(edit.set))
+	for name := range edit.set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header.Set(name, edit.set[name])
 	}
-	newEmailBuffer.WriteString("\r\n")
 
-	if _, err := io.Copy(&newEmailBuffer, msg.Body); err != nil {
-		logger.Error("failed to copy email body during reconstruction", "error", err)
+	var headerBuffer bytes.Buffer
+	if _, err := header.WriteTo(&headerBuffer); err != nil {
 		return nil, fmt.Errorf("failed to reconstruct email: %w", err)
 	}
+	return io.MultiReader(&headerBuffer, br), nil
+}
 
-	return newEmailBuffer.Bytes(), nil
+// replaceToHeader parses a raw email from a reader, replaces its 'To' header
+// with the given recipients, and returns the reconstructed raw email.
+func replaceToHeader(logger *slog.Logger, recipients []string, rawEmail io.Reader) (io.Reader, error) {
+	return rewriteHeaders(logger, rawEmail, toEdit(recipients))
 }
 
-// Send sends a raw email stream to the Gmail API. It parses the raw email,
-// replaces the "To" header with the provided recipients, and then sends it.
-func (c *Client) Send(ctx context.Context, token *oauth2.Token, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
-	c.logger.Info("sending email via gmail api", "recipients", recipients)
+// toEdit returns the edit that replaces the 'To' header with recipients.
+func toEdit(recipients []string) headerEdit {
+	if len(recipients) == 0 {
+		// If there are no recipients, remove the 'To' header to avoid ambiguity.
+		return headerEdit{remove: []string{"To"}}
+	}
+	return headerEdit{set: map[string]string{"To": strings.Join(recipients, ", ")}}
+}
 
-	// The `replaceToHeader` function now reads from the stream and returns bytes.
-	modifiedEmail, err := replaceToHeader(c.logger, recipients, rawEmail)
-	if err != nil {
-		return nil, err // Error is already logged in replaceToHeader
+// splitRecipients separates the envelope recipients into those that appear in
+// the message's To or Cc headers (visible) and those that do not (hidden, i.e.
+// Bcc recipients).
+func splitRecipients(logger *slog.Logger, header *message.Header, recipients []string) (visible, hidden []string) {
+	listed := make(map[string]bool)
+	for _, name := range []string{"To", "Cc"} {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		addrs, err := mail.ParseAddressList(strings.Join(values, ", "))
+		if err != nil {
+			logger.Warn("could not parse recipient header, treating its recipients as hidden", "header", name, "error", err)
+			continue
+		}
+		for _, addr := range addrs {
+			listed[strings.ToLower(addr.Address)] = true
+		}
+	}
+
+	for _, rcpt := range recipients {
+		if listed[strings.ToLower(rcpt)] {
+			visible = append(visible, rcpt)
+		} else {
+			hidden = append(hidden, rcpt)
+		}
 	}
+	return visible, hidden
+}
 
-	// Create a new Gmail service using the provided token.
-	srv, err := gapi.NewService(ctx,
-		option.WithHTTPClient(c.client),
-		option.WithTokenSource(oauth2.StaticTokenSource(token)),
-	)
+// Send sends a raw email to the Gmail API. A failed API call is reported as
+// an *Error, possibly wrapped in a *PartialError. Calls that fail with a
+// transient error or a rate limit are retried as long as ctx allows. The
+// email is read from src again for every delivery and every retry; only its
+// header is held in memory.
+//
+// In the legacy Bcc mode it replaces the "To" header with all the envelope
+// recipients and sends a single message. In the private Bcc mode it sends the
+// message unchanged to the recipients listed in its To and Cc headers, and a
+// separate copy addressed only to each envelope recipient that is not listed
+// there, so that Bcc recipients stay hidden.
+func (c *Client) Send(ctx context.Context, recipients []string, src Source) (*gapi.Message, error) {
+	c.logger.Info("sending email via gmail api", "recipients", recipients, "bcc_mode", c.cfg.BccMode)
+
+	r, err := src()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gmail service: %w", err)
+		return nil, fmt.Errorf("failed to read raw email: %w", err)
+	}
+	header, err := message.ReadHeader(bufio.NewReader(r))
+	if err != nil {
+		c.logger.Error("failed to parse raw email", "error", err)
+		return nil, fmt.Errorf("failed to parse raw email: %w", err)
+	}
+	messageID := header.Get("Message-ID")
+	from := c.fromEdit(header)
+	if messageID == "" && c.cfg.CheckSentBeforeRetry {
+		// The Sent folder is searched by Message-ID before a retry.
+		if messageID, err = message.NewMessageID(""); err != nil {
+			return nil, err
+		}
+		from = from.merge(headerEdit{set: map[string]string{"Message-ID": messageID}})
+	}
+
+	if c.cfg.BccMode == config.BccModePrivate {
+		return c.sendPrivate(ctx, recipients, src, header, from, messageID)
 	}
 
-	// Base64url-encode the *new* raw email.
-	encodedEmail := base64.RawURLEncoding.EncodeToString(modifiedEmail)
+	return c.sendRaw(ctx, delivery{messageID: messageID, open: c.edited(src, from.merge(toEdit(recipients)))})
+}
 
-	// Create a new message.
-	message := &gapi.Message{
-		Raw: encodedEmail,
+// edited returns a function that opens src with edit applied to its header.
+func (c *Client) edited(src Source, edit headerEdit) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		r, err := src()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read raw email: %w", err)
+		}
+		return rewriteHeaders(c.logger, r, edit)
+	}
+}
+
+// sendPrivate fans a message out into one delivery for the visible recipients
+// and one per hidden recipient. The result is reported as a single outcome:
+// the first sent message on success, or an error that is a *PartialError if
+// some of the deliveries succeeded. from is applied to every delivery.
+func (c *Client) sendPrivate(ctx context.Context, recipients []string, src Source, header *message.Header, from headerEdit, messageID string) (*gapi.Message, error) {
+	visible, hidden := splitRecipients(c.logger, header, recipients)
+	c.logger.Debug("split recipients for private bcc delivery", "visible", visible, "hidden", hidden)
+
+	var first *gapi.Message
+	var delivered []string
+	fail := func(err error) (*gapi.Message, error) {
+		if len(delivered) > 0 {
+			return nil, &PartialError{Delivered: delivered, Err: err}
+		}
+		return nil, err
+	}
+
+	if len(visible) > 0 {
+		// Gmail delivers to every address in the To, Cc and Bcc headers. A Bcc
+		// header left in by the client would duplicate the separate copies.
+		sent, err := c.sendRaw(ctx, delivery{messageID: messageID, open: c.edited(src, from.merge(headerEdit{remove: []string{"Bcc"}}))})
+		if err != nil {
+			return fail(err)
+		}
+		first = sent
+		delivered = append(delivered, visible...)
+	}
+
+	for _, rcpt := range hidden {
+		// The copies share the Message-ID, so a copy is identified by the
+		// one recipient it is addressed to.
+		sent, err := c.sendRaw(ctx, delivery{messageID: messageID, to: rcpt, open: c.edited(src, from.merge(headerEdit{
+			set:    map[string]string{"To": rcpt},
+			remove: []string{"Cc", "Bcc"},
+		}))})
+		if err != nil {
+			return fail(err)
+		}
+		if first == nil {
+			first = sent
+		}
+		delivered = append(delivered, rcpt)
+	}
+
+	if first == nil {
+		return nil, fmt.Errorf("message has no recipients")
+	}
+	return first, nil
+}
+
+// delivery is a single message sendRaw sends to Gmail.
+type delivery struct {
+	// open returns the raw email. It is called again for every attempt.
+	open func() (io.Reader, error)
+	// messageID is the Message-ID of the email, used to look for it in the
+	// Sent folder before a retry. to is set for copies that share the
+	// Message-ID with other copies and are addressed to a single recipient.
+	messageID string
+	to        string
+}
+
+// sendRaw sends a complete raw email through the Gmail API, retrying
+// transient failures and rate limits with jittered exponential backoff, or
+// after the delay the API asks for with Retry-After. It gives up early when
+// the next attempt would not start before the deadline of ctx. Before it
+// repeats a call that may have reached Gmail, it looks for the email in the
+// Sent folder if CheckSentBeforeRetry is set, so that it is not sent twice.
+func (c *Client) sendRaw(ctx context.Context, d delivery) (*gapi.Message, error) {
+	if c.srvErr != nil {
+		return nil, c.srvErr
+	}
+
+	for attempt := 1; ; attempt++ {
+		email, err := d.open()
+		if err != nil {
+			return nil, err
+		}
+		sentMsg, err := c.sendOnce(ctx, email)
+		if err == nil {
+			return sentMsg, nil
+		}
+
+		gerr := classify(fmt.Errorf("failed to send email: %w", err))
+		c.logger.Error("failed to send email", "kind", gerr.Kind.String(), "status", gerr.Status, "reason", gerr.Reason, "attempt", attempt, "error", err)
+		if !gerr.retryable() || attempt > c.cfg.SendRetries {
+			return nil, gerr
+		}
+
+		delay := retryDelay(c.retryBase, attempt, gerr.RetryAfter)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			c.logger.Warn("not retrying send, the deadline is too close", "retry_in", delay.String())
+			return nil, gerr
+		}
+		c.logger.Warn("retrying send", "attempt", attempt, "retry_in", delay.String())
+		select {
+		case <-ctx.Done():
+			return nil, gerr
+		case <-time.After(delay):
+		}
+
+		if gerr.Kind == ErrTransient && c.cfg.CheckSentBeforeRetry {
+			// The failed call may have sent the email before the connection
+			// broke down.
+			sent, err := c.findSent(ctx, d)
+			if err != nil {
+				c.logger.Warn("could not check sent folder, sending again", "message_id", d.messageID, "error", err)
+			} else if sent != nil {
+				c.logger.Info("email was sent before the failure, not sending it again", "message_id", d.messageID, "id", sent.Id)
+				return sent, nil
+			}
+		}
+	}
+}
+
+// sendOnce makes a single send call. Messages up to mediaUploadThreshold are
+// sent in the Raw field; larger ones go to the media upload endpoint, so that
+// memory use does not grow with the message size. Messages larger than
+// ResumableUploadThresholdMB are uploaded with the resumable upload protocol
+// in chunks of resumableChunkSize; a chunk that fails with a transient error
+// is sent again and the upload resumes from there. The others, and every
+// message if the threshold is 0, are streamed in a single multipart request.
+func (c *Client) sendOnce(ctx context.Context, email io.Reader) (*gapi.Message, error) {
+	threshold := c.cfg.ResumableUploadThresholdMB << 20
+	head, err := io.ReadAll(io.LimitReader(email, int64(max(mediaUploadThreshold, threshold))+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read raw email: %w", err)
+	}
+
+	var call *gapi.UsersMessagesSendCall
+	if len(head) <= mediaUploadThreshold {
+		call = c.srv.Users.Messages.Send("me", &gapi.Message{
+			Raw: base64.RawURLEncoding.EncodeToString(head),
+		})
+	} else {
+		// The chunk size selects the protocol: 0 streams the media in one
+		// request, anything smaller than the message makes it resumable.
+		chunkSize := 0
+		if threshold > 0 && len(head) > threshold {
+			chunkSize = resumableChunkSize
+		}
+		c.logger.Debug("uploading large email to the media upload endpoint", "resumable", chunkSize > 0)
+		call = c.srv.Users.Messages.Send("me", &gapi.Message{}).Media(
+			io.MultiReader(bytes.NewReader(head), email),
+			googleapi.ContentType("message/rfc822"),
+			googleapi.ChunkSize(chunkSize),
+		)
 	}
 
 	// Send the message.
-	sentMsg, err := srv.Users.Messages.Send("me", message).Do()
+	sentMsg, err := call.Context(ctx).Do()
 	if err != nil {
-		c.logger.Error("failed to send email", "error", err)
-		return nil, fmt.Errorf("failed to send email: %w", err)
+		return nil, err
 	}
 
 	c.logger.Info("email sent successfully", "message_id", sentMsg.Id)
@@ -1,14 +1,33 @@
 package gmail
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
 	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/ethanpil/smog/internal/message"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	gapi "google.golang.org/api/gmail/v1"
 )
 
 func TestReplaceToHeader(t *testing.T) {
@@ -71,11 +90,11 @@ func TestReplaceToHeader(t *testing.T) {
 			rawEmail.WriteString("This is the body.")
 
 			// 2. Call the function
-			modifiedEmailBytes, err := replaceToHeader(logger, tc.newRecipients, strings.NewReader(rawEmail.String()))
+			modifiedEmail, err := replaceToHeader(logger, tc.newRecipients, strings.NewReader(rawEmail.String()))
 			require.NoError(t, err)
 
 			// 3. Parse the result and assert
-			msg, err := mail.ReadMessage(strings.NewReader(string(modifiedEmailBytes)))
+			msg, err := mail.ReadMessage(modifiedEmail)
 			require.NoError(t, err)
 
 			toHeader, ok := msg.Header["To"]
@@ -93,3 +112,512 @@ func TestReplaceToHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitRecipients(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	header, err := message.ReadHeader(bufio.NewReader(strings.NewReader(
+		"To: Alice <alice@example.com>,\r\n bob@example.com\r\n" +
+			"Cc: =?UTF-8?Q?Caf=C3=A9?= <Carol@Example.com>\r\n" +
+			"\r\nbody")))
+	require.NoError(t, err)
+
+	visible, hidden := splitRecipients(logger, header, []string{
+		"alice@example.com", "carol@example.com", "dave@example.com", "eve@example.com",
+	})
+	assert.Equal(t, []string{"alice@example.com", "carol@example.com"}, visible)
+	assert.Equal(t, []string{"dave@example.com", "eve@example.com"}, hidden)
+}
+
+// redirectTransport sends every request to a test server instead of Google,
+// through base or, if it is nil, http.DefaultTransport.
+type redirectTransport struct {
+	target *url.URL
+	base   http.RoundTripper
+}
+
+func (rt *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	if rt.base != nil {
+		return rt.base.RoundTrip(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newFakeGmail starts a fake Gmail API server and returns a client for it along
+// with a function returning the raw messages it received so far.
+func newFakeGmail(t *testing.T, handler func(n int, raw string) int) (*http.Client, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var received []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := readSentMessage(t, r)
+
+		mu.Lock()
+		received = append(received, string(raw))
+		n := len(received)
+		mu.Unlock()
+
+		if status := handler(n, string(raw)); status != http.StatusOK {
+			http.Error(w, fmt.Sprintf(`{"error": {"code": %d, "message": "backend error"}}`, status), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&gapi.Message{Id: fmt.Sprintf("msg-%d", n)})
+	}))
+	t.Cleanup(srv.Close)
+
+	target, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	return &http.Client{Transport: &redirectTransport{target: target}}, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), received...)
+	}
+}
+
+// readSentMessage returns the raw message of a send request, which is either
+// a JSON message with a Raw field or a media upload.
+func readSentMessage(t *testing.T, r *http.Request) []byte {
+	t.Helper()
+	if strings.HasPrefix(r.URL.Path, "/upload/") {
+		assert.Equal(t, "multipart", r.URL.Query().Get("uploadType"))
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		_, err = mr.NextPart() // The JSON metadata
+		require.NoError(t, err)
+		media, err := mr.NextPart()
+		require.NoError(t, err)
+		assert.Equal(t, "message/rfc822", media.Header.Get("Content-Type"))
+		raw, err := io.ReadAll(media)
+		require.NoError(t, err)
+		return raw
+	}
+
+	var msg gapi.Message
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		raw, err = base64.RawURLEncoding.DecodeString(msg.Raw)
+	}
+	require.NoError(t, err)
+	return raw
+}
+
+// source returns a Source for a raw email held in a string.
+func source(raw string) Source {
+	return ReaderAtSource(strings.NewReader(raw), int64(len(raw)))
+}
+
+// largeMessage returns a message with a body of about size bytes.
+func largeMessage(size int) string {
+	line := strings.Repeat("0123456789", 7) + "\r\n"
+	return "To: to@example.com\r\nSubject: Large\r\n\r\n" + strings.Repeat(line, size/len(line))
+}
+
+func TestSend_LargeMessageUsesMediaUpload(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var uploads int
+	httpClient, received := newFakeGmail(t, func(int, string) int { return http.StatusOK })
+	countingClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if strings.HasPrefix(r.URL.Path, "/upload/") {
+			uploads++
+		}
+		return httpClient.Transport.RoundTrip(r)
+	})}
+
+	for _, mode := range []string{config.BccModeLegacy, config.BccModePrivate} {
+		// Below ResumableUploadThresholdMB, readSentMessage checks that the
+		// message is sent in a single multipart request.
+		client := New(logger, countingClient, &config.Config{BccMode: mode, ResumableUploadThresholdMB: 5})
+		raw := largeMessage(3 * mediaUploadThreshold)
+		_, err := client.Send(context.Background(), []string{"to@example.com"}, source(raw))
+		require.NoError(t, err)
+
+		msgs := received()
+		msg, err := mail.ReadMessage(strings.NewReader(msgs[len(msgs)-1]))
+		require.NoError(t, err)
+		body, err := io.ReadAll(msg.Body)
+		require.NoError(t, err)
+		assert.Equal(t, raw[strings.Index(raw, "\r\n\r\n")+4:], string(body), "bcc mode %s", mode)
+	}
+	assert.Equal(t, 2, uploads)
+
+	// Small messages still use the Raw field.
+	client := New(logger, countingClient, &config.Config{})
+	_, err := client.Send(context.Background(), []string{"to@example.com"}, source(largeMessage(1024)))
+	require.NoError(t, err)
+	assert.Equal(t, 2, uploads)
+}
+
+func TestSend_ResumableUpload(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// The fake server implements the resumable upload protocol and fails the
+	// second chunk once with a transient error.
+	var mu sync.Mutex
+	var uploaded bytes.Buffer
+	var chunks, failures int
+	var uploadType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/session" {
+			uploadType = r.URL.Query().Get("uploadType")
+			w.Header().Set("Location", "https://gmail.googleapis.com/session")
+			return
+		}
+
+		chunks++
+		if chunks == 2 && failures == 0 {
+			failures++
+			io.Copy(io.Discard, r.Body)
+			http.Error(w, "backend error", http.StatusServiceUnavailable)
+			return
+		}
+		var start, end int64
+		_, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/", &start, &end)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, int64(uploaded.Len()), start, "chunks must arrive in order")
+		assert.LessOrEqual(t, len(data), resumableChunkSize)
+		uploaded.Write(data)
+
+		if strings.HasSuffix(r.Header.Get("Content-Range"), "/*") {
+			w.Header().Set("X-HTTP-Status-Code-Override", "308")
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", end))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&gapi.Message{Id: "msg-1"})
+	}))
+	t.Cleanup(srv.Close)
+	target, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	httpClient := &http.Client{Transport: &redirectTransport{target: target}}
+
+	client := New(logger, httpClient, &config.Config{ResumableUploadThresholdMB: 2})
+	raw := largeMessage(3 << 20)
+	sent, err := client.Send(context.Background(), []string{"to@example.com"}, source(raw))
+	require.NoError(t, err)
+	assert.Equal(t, "msg-1", sent.Id)
+
+	assert.Equal(t, "resumable", uploadType)
+	assert.Equal(t, 1, failures)
+	assert.Greater(t, chunks, 3)
+	msg, err := mail.ReadMessage(&uploaded)
+	require.NoError(t, err)
+	body, err := io.ReadAll(msg.Body)
+	require.NoError(t, err)
+	assert.Equal(t, raw[strings.Index(raw, "\r\n\r\n")+4:], string(body))
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	assert.Equal(t, int64(10<<20), MessageSizeLimit(10))
+	assert.Equal(t, int64(MaxMessageSize), MessageSizeLimit(0))
+	assert.Equal(t, int64(MaxMessageSize), MessageSizeLimit(50))
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// BenchmarkSend_LargeMessage sends a 25 MB message to a fake Gmail API that
+// discards it. The allocations reported per operation stay far below the
+// message size because the message is streamed, not buffered.
+func BenchmarkSend_LargeMessage(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "msg-1"}`))
+	}))
+	defer srv.Close()
+	target, err := url.Parse(srv.URL)
+	require.NoError(b, err)
+	httpClient := &http.Client{Transport: &redirectTransport{target: target}}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	client := New(logger, httpClient, &config.Config{BccMode: config.BccModeLegacy})
+	raw := []byte(largeMessage(25 << 20))
+
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for b.Loop() {
+		_, err := client.Send(context.Background(), []string{"to@example.com"}, ReaderAtSource(bytes.NewReader(raw), int64(len(raw))))
+		require.NoError(b, err)
+	}
+}
+
+// BenchmarkSend_SmallMessage measures the per-message overhead of sending a
+// small message with the service and transport the client shares between
+// messages, and with a new transport and service for every message, as the
+// client used to do. A new transport cannot reuse a kept-alive connection, so
+// every message pays for a new connection.
+func BenchmarkSend_SmallMessage(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "msg-1"}`))
+	}))
+	defer srv.Close()
+	target, err := url.Parse(srv.URL)
+	require.NoError(b, err)
+	newHTTPClient := func() (*http.Client, *http.Transport) {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		return &http.Client{Transport: &redirectTransport{target: target, base: tr}}, tr
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	raw := []byte("To: to@example.com\r\nSubject: Small\r\n\r\nBody\r\n")
+	src := ReaderAtSource(bytes.NewReader(raw), int64(len(raw)))
+
+	b.Run("SharedService", func(b *testing.B) {
+		httpClient, tr := newHTTPClient()
+		defer tr.CloseIdleConnections()
+		client := New(logger, httpClient, &config.Config{BccMode: config.BccModeLegacy})
+		b.ReportAllocs()
+		for b.Loop() {
+			_, err := client.Send(context.Background(), []string{"to@example.com"}, src)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("ServicePerMessage", func(b *testing.B) {
+		client := New(logger, http.DefaultClient, &config.Config{BccMode: config.BccModeLegacy})
+		b.ReportAllocs()
+		for b.Loop() {
+			httpClient, tr := newHTTPClient()
+			client.srv, client.srvErr = newService(httpClient)
+			_, err := client.Send(context.Background(), []string{"to@example.com"}, src)
+			require.NoError(b, err)
+			tr.CloseIdleConnections()
+		}
+	})
+}
+
+func TestSend_PrivateBcc(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	httpClient, received := newFakeGmail(t, func(int, string) int { return http.StatusOK })
+	client := New(logger, httpClient, &config.Config{BccMode: config.BccModePrivate})
+
+	raw := "From: sender@example.com\r\n" +
+		"To: to@example.com\r\n" +
+		"Cc: cc@example.com\r\n" +
+		"Subject: Private\r\n" +
+		"\r\n" +
+		"Body"
+	sent, err := client.Send(context.Background(),
+		[]string{"to@example.com", "cc@example.com", "bcc1@example.com", "bcc2@example.com"},
+		source(raw))
+	require.NoError(t, err)
+	assert.Equal(t, "msg-1", sent.Id)
+
+	msgs := received()
+	require.Len(t, msgs, 3)
+
+	// The visible copy keeps its headers and mentions no Bcc recipient.
+	visible, err := mail.ReadMessage(strings.NewReader(msgs[0]))
+	require.NoError(t, err)
+	assert.Equal(t, "to@example.com", visible.Header.Get("To"))
+	assert.Equal(t, "cc@example.com", visible.Header.Get("Cc"))
+	assert.NotContains(t, msgs[0], "bcc")
+
+	// Each Bcc recipient gets a copy addressed only to them.
+	for i, rcpt := range []string{"bcc1@example.com", "bcc2@example.com"} {
+		copyMsg, err := mail.ReadMessage(strings.NewReader(msgs[i+1]))
+		require.NoError(t, err)
+		assert.Equal(t, rcpt, copyMsg.Header.Get("To"))
+		assert.Empty(t, copyMsg.Header.Get("Cc"))
+		assert.Equal(t, "Private", copyMsg.Header.Get("Subject"))
+		body, err := io.ReadAll(copyMsg.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "Body", string(body))
+	}
+}
+
+func TestSend_PrivateBccPartialFailure(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	// The visible copy is sent, the Bcc copy fails.
+	httpClient, _ := newFakeGmail(t, func(n int, raw string) int {
+		if n == 1 {
+			return http.StatusOK
+		}
+		return http.StatusBadRequest
+	})
+	client := New(logger, httpClient, &config.Config{BccMode: config.BccModePrivate})
+
+	raw := "To: to@example.com\r\nSubject: Partial\r\n\r\nBody"
+	_, err := client.Send(context.Background(), []string{"to@example.com", "bcc@example.com"}, source(raw))
+	require.Error(t, err)
+
+	var partial *PartialError
+	require.True(t, errors.As(err, &partial), "expected a PartialError, got %v", err)
+	assert.Equal(t, []string{"to@example.com"}, partial.Delivered)
+}
+
+func TestSend_LegacyBcc(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	httpClient, received := newFakeGmail(t, func(int, string) int { return http.StatusOK })
+	client := New(logger, httpClient, &config.Config{BccMode: config.BccModeLegacy})
+
+	raw := "To: to@example.com\r\nSubject: Legacy\r\n\r\nBody"
+	_, err := client.Send(context.Background(), []string{"to@example.com", "bcc@example.com"}, source(raw))
+	require.NoError(t, err)
+
+	msgs := received()
+	require.Len(t, msgs, 1)
+	msg, err := mail.ReadMessage(strings.NewReader(msgs[0]))
+	require.NoError(t, err)
+	assert.Equal(t, "to@example.com, bcc@example.com", msg.Header.Get("To"))
+}
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// stripFields removes every header field with the given name from a raw
+// message, leaving all other bytes untouched.
+func stripFields(t *testing.T, raw []byte, name string) []byte {
+	t.Helper()
+	br := bufio.NewReader(bytes.NewReader(raw))
+	header, err := message.ReadHeader(br)
+	require.NoError(t, err)
+	header.Del(name)
+
+	var buf bytes.Buffer
+	_, err = header.WriteTo(&buf)
+	require.NoError(t, err)
+	_, err = io.Copy(&buf, br)
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+// TestReplaceToHeader_Golden rewrites the To header of real device messages
+// and compares the result byte for byte with the golden files. Run the test
+// with -update to regenerate them after an intended change.
+func TestReplaceToHeader_Golden(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	recipients := []string{"relay-one@example.com", "relay-two@example.com"}
+
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.eml"))
+	require.NoError(t, err)
+	require.NotEmpty(t, inputs)
+
+	for _, input := range inputs {
+		t.Run(filepath.Base(input), func(t *testing.T) {
+			raw, err := os.ReadFile(input)
+			require.NoError(t, err)
+
+			email, err := replaceToHeader(logger, recipients, bytes.NewReader(raw))
+			require.NoError(t, err)
+			got, err := io.ReadAll(email)
+			require.NoError(t, err)
+
+			golden := strings.TrimSuffix(input, ".eml") + ".golden"
+			if *update {
+				require.NoError(t, os.WriteFile(golden, got, 0644))
+			}
+			want, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(t, string(want), string(got))
+
+			// Apart from the To header, the message must be unchanged.
+			assert.Equal(t, string(stripFields(t, raw, "To")), string(stripFields(t, got, "To")))
+		})
+	}
+}
+
+// newFakeGmailWithSendAs is like newFakeGmail, but also answers the send-as
+// alias list request with the given aliases.
+func newFakeGmailWithSendAs(t *testing.T, aliases []*gapi.SendAs) (*http.Client, func() []string) {
+	t.Helper()
+	sendClient, received := newFakeGmail(t, func(int, string) int { return http.StatusOK })
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/settings/sendAs") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&gapi.ListSendAsResponse{SendAs: aliases})
+			return
+		}
+		resp, err := sendClient.Transport.RoundTrip(r.Clone(r.Context()))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(srv.Close)
+
+	target, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	return &http.Client{Transport: &redirectTransport{target: target}}, received
+}
+
+func TestSend_RewriteFrom(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	aliases := []*gapi.SendAs{
+		{SendAsEmail: "office@example.com", DisplayName: "Office", IsPrimary: true, IsDefault: true},
+		{SendAsEmail: "alerts@example.com", DisplayName: "Alerts", VerificationStatus: "accepted"},
+		{SendAsEmail: "pending@example.com", VerificationStatus: "pending"},
+	}
+
+	testCases := []struct {
+		name        string
+		fromAlias   string
+		raw         string
+		wantFrom    string
+		wantReplyTo string
+	}{
+		{
+			name:     "Permitted sender is kept",
+			raw:      "From: Alerts <alerts@example.com>\r\nSubject: Test\r\n\r\nBody",
+			wantFrom: "Alerts <alerts@example.com>",
+		},
+		{
+			name:        "Unknown sender is rewritten",
+			raw:         "From: Scanner <scanner@device.lan>\r\nSubject: Test\r\n\r\nBody",
+			wantFrom:    `"Office" <office@example.com>`,
+			wantReplyTo: "Scanner <scanner@device.lan>",
+		},
+		{
+			name:        "Unverified alias is rewritten to FromAlias",
+			fromAlias:   "Alerts@example.com",
+			raw:         "From: pending@example.com\r\nSubject: Test\r\n\r\nBody",
+			wantFrom:    `"Alerts" <alerts@example.com>`,
+			wantReplyTo: "pending@example.com",
+		},
+		{
+			name:        "Existing Reply-To is kept",
+			raw:         "From: scanner@device.lan\r\nReply-To: helpdesk@example.com\r\n\r\nBody",
+			wantFrom:    `"Office" <office@example.com>`,
+			wantReplyTo: "helpdesk@example.com",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			httpClient, received := newFakeGmailWithSendAs(t, aliases)
+			client := New(logger, httpClient, &config.Config{RewriteFrom: true, FromAlias: tc.fromAlias})
+			require.NoError(t, client.LoadSendAs(context.Background()))
+
+			_, err := client.Send(context.Background(), []string{"to@example.com"}, source(tc.raw))
+			require.NoError(t, err)
+
+			msgs := received()
+			require.Len(t, msgs, 1)
+			msg, err := mail.ReadMessage(strings.NewReader(msgs[0]))
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantFrom, msg.Header.Get("From"))
+			assert.Equal(t, tc.wantReplyTo, msg.Header.Get("Reply-To"))
+			body, err := io.ReadAll(msg.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "Body", string(body))
+		})
+	}
+
+	t.Run("Unknown FromAlias", func(t *testing.T) {
+		httpClient, _ := newFakeGmailWithSendAs(t, aliases)
+		client := New(logger, httpClient, &config.Config{RewriteFrom: true, FromAlias: "pending@example.com"})
+		assert.Error(t, client.LoadSendAs(context.Background()))
+	})
+}
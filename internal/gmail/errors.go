@@ -0,0 +1,186 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrorKind classifies why a Gmail API call failed.
+type ErrorKind int
+
+const (
+	// ErrTransient is a network failure or a server error that may go away
+	// if the call is repeated.
+	ErrTransient ErrorKind = iota
+	// ErrAuthExpired means the stored token was revoked or has expired and
+	// "smog auth login" has to be run again.
+	ErrAuthExpired
+	// ErrRateLimited means too many requests were made in a short time.
+	ErrRateLimited
+	// ErrQuotaExhausted means the daily sending or API quota is used up.
+	ErrQuotaExhausted
+	// ErrInvalidRecipient means Gmail refused a recipient address.
+	ErrInvalidRecipient
+	// ErrMessageTooLarge means the message exceeds Gmail's size limit.
+	ErrMessageTooLarge
+	// ErrRejected means Gmail refused the message for any other reason and
+	// sending it again will fail the same way.
+	ErrRejected
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrTransient:
+		return "transient failure"
+	case ErrAuthExpired:
+		return "authorization expired"
+	case ErrRateLimited:
+		return "rate limited"
+	case ErrQuotaExhausted:
+		return "quota exhausted"
+	case ErrInvalidRecipient:
+		return "invalid recipient"
+	case ErrMessageTooLarge:
+		return "message too large"
+	case ErrRejected:
+		return "message rejected"
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// Error is returned by Send when the Gmail API call fails.
+type Error struct {
+	Kind ErrorKind
+	// Status is the HTTP status code of the response, 0 if there was none.
+	Status int
+	// Reason is the reason of the first error in the response, if any, e.g.
+	// "rateLimitExceeded".
+	Reason string
+	// RetryAfter is the delay the API asked for with a Retry-After header
+	// before the call is repeated, 0 if it did not ask for one.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether sending the message again later may succeed.
+func (e *Error) Temporary() bool {
+	switch e.Kind {
+	case ErrInvalidRecipient, ErrMessageTooLarge, ErrRejected:
+		return false
+	}
+	return true
+}
+
+// IsPermanent reports whether err is an *Error that sending the message again
+// will not fix.
+func IsPermanent(err error) bool {
+	var gerr *Error
+	return errors.As(err, &gerr) && !gerr.Temporary()
+}
+
+// The error reasons of the Gmail API that classify an error beyond its status
+// code.
+var (
+	rateLimitReasons = []string{"rateLimitExceeded", "userRateLimitExceeded"}
+	quotaReasons     = []string{"dailyLimitExceeded", "quotaExceeded", "dailyLimitExceededUnreg"}
+	tooLargeReasons  = []string{"uploadTooLarge", "messageTooLarge"}
+	authReasons      = []string{"authError", "insufficientPermissions"}
+)
+
+// classify turns an error returned by a Gmail API call into an *Error.
+func classify(err error) *Error {
+	var gerr *Error
+	if errors.As(err, &gerr) {
+		return gerr
+	}
+
+	// A token that cannot be refreshed fails the call before it is sent.
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		e := &Error{Kind: ErrAuthExpired, Reason: retrieveErr.ErrorCode, Err: err}
+		if retrieveErr.Response != nil {
+			e.Status = retrieveErr.Response.StatusCode
+			if e.Status >= 500 {
+				e.Kind = ErrTransient
+			}
+		}
+		return e
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		// Without a response from the API the call failed on the way, e.g.
+		// because of a network failure or a timeout.
+		return &Error{Kind: ErrTransient, Err: err}
+	}
+
+	e := &Error{Status: apiErr.Code, Err: err}
+	e.RetryAfter = parseRetryAfter(apiErr.Header.Get("Retry-After"), time.Now())
+	if len(apiErr.Errors) > 0 {
+		e.Reason = apiErr.Errors[0].Reason
+	}
+	switch {
+	case hasReason(apiErr, quotaReasons):
+		e.Kind = ErrQuotaExhausted
+	case apiErr.Code == http.StatusTooManyRequests || hasReason(apiErr, rateLimitReasons):
+		e.Kind = ErrRateLimited
+	case apiErr.Code == http.StatusUnauthorized || hasReason(apiErr, authReasons):
+		e.Kind = ErrAuthExpired
+	case apiErr.Code == http.StatusRequestEntityTooLarge || hasReason(apiErr, tooLargeReasons):
+		e.Kind = ErrMessageTooLarge
+	case apiErr.Code == http.StatusRequestTimeout || apiErr.Code >= 500:
+		e.Kind = ErrTransient
+	case apiErr.Code == http.StatusBadRequest && invalidRecipient(apiErr):
+		e.Kind = ErrInvalidRecipient
+	default:
+		e.Kind = ErrRejected
+	}
+	return e
+}
+
+// hasReason reports whether any of the errors in the response has one of
+// the reasons.
+func hasReason(apiErr *googleapi.Error, reasons []string) bool {
+	for _, item := range apiErr.Errors {
+		if slices.Contains(reasons, item.Reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidRecipient reports whether a 400 response refuses a recipient. The
+// Gmail API uses the generic "invalidArgument" reason for these, so only the
+// message tells them apart, e.g. "Invalid To header" or "Recipient address
+// required".
+func invalidRecipient(apiErr *googleapi.Error) bool {
+	messages := []string{apiErr.Message}
+	for _, item := range apiErr.Errors {
+		messages = append(messages, item.Message)
+	}
+	for _, msg := range messages {
+		msg = strings.ToLower(msg)
+		if strings.Contains(msg, "recipient") ||
+			strings.Contains(msg, "invalid to header") ||
+			strings.Contains(msg, "invalid cc header") ||
+			strings.Contains(msg, "invalid bcc header") {
+			return true
+		}
+	}
+	return false
+}
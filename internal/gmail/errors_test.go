@@ -0,0 +1,79 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func apiError(code int, reason, message string) error {
+	return &googleapi.Error{
+		Code:    code,
+		Message: message,
+		Errors:  []googleapi.ErrorItem{{Reason: reason, Message: message}},
+	}
+}
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		name      string
+		err       error
+		kind      ErrorKind
+		temporary bool
+	}{
+		{"RateLimited", apiError(429, "rateLimitExceeded", "Too many requests"), ErrRateLimited, true},
+		{"UserRateLimited", apiError(403, "userRateLimitExceeded", "User-rate limit exceeded"), ErrRateLimited, true},
+		{"DailyQuota", apiError(403, "dailyLimitExceeded", "Daily Limit Exceeded"), ErrQuotaExhausted, true},
+		{"QuotaOn429", apiError(429, "quotaExceeded", "Quota exceeded"), ErrQuotaExhausted, true},
+		{"Unauthorized", apiError(401, "authError", "Invalid Credentials"), ErrAuthExpired, true},
+		{"MissingScope", apiError(403, "insufficientPermissions", "Insufficient Permission"), ErrAuthExpired, true},
+		{"InvalidTo", apiError(400, "invalidArgument", "Invalid To header"), ErrInvalidRecipient, false},
+		{"NoRecipient", apiError(400, "invalidArgument", "Recipient address required"), ErrInvalidRecipient, false},
+		{"TooLarge", apiError(413, "uploadTooLarge", "Request entity too large"), ErrMessageTooLarge, false},
+		{"BadRequest", apiError(400, "invalidArgument", "Invalid value for ByteString"), ErrRejected, false},
+		{"Forbidden", apiError(403, "forbidden", "Delegation denied"), ErrRejected, false},
+		{"BackendError", apiError(503, "backendError", "Backend Error"), ErrTransient, true},
+		{"Network", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, ErrTransient, true},
+		{"Timeout", context.DeadlineExceeded, ErrTransient, true},
+		{"RevokedToken", fmt.Errorf("failed to refresh google api token: %w", &oauth2.RetrieveError{
+			Response: &http.Response{StatusCode: 400}, ErrorCode: "invalid_grant",
+		}), ErrAuthExpired, true},
+		{"TokenEndpointDown", &oauth2.RetrieveError{Response: &http.Response{StatusCode: 502}}, ErrTransient, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gerr := classify(fmt.Errorf("failed to send email: %w", tc.err))
+			assert.Equal(t, tc.kind, gerr.Kind, "kind is %s", gerr.Kind)
+			assert.Equal(t, tc.temporary, gerr.Temporary())
+			assert.Equal(t, !tc.temporary, IsPermanent(gerr))
+			assert.ErrorIs(t, gerr, tc.err)
+		})
+	}
+}
+
+func TestSend_ReturnsTypedError(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	httpClient, _ := newFakeGmail(t, func(int, string) int { return http.StatusTooManyRequests })
+	client := New(logger, httpClient, &config.Config{BccMode: config.BccModePrivate})
+
+	raw := "To: to@example.com\r\nSubject: Limited\r\n\r\nBody"
+	_, err := client.Send(context.Background(), []string{"to@example.com"}, source(raw))
+	require.Error(t, err)
+
+	var gerr *Error
+	require.True(t, errors.As(err, &gerr), "expected a gmail.Error, got %T", err)
+	assert.Equal(t, ErrRateLimited, gerr.Kind)
+	assert.Equal(t, http.StatusTooManyRequests, gerr.Status)
+}
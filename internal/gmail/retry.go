@@ -0,0 +1,84 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gapi "google.golang.org/api/gmail/v1"
+)
+
+const (
+	// defaultRetryBase is the delay before the first retry of a failed send.
+	// It doubles with every further retry, up to retryMax.
+	defaultRetryBase = time.Second
+	retryMax         = 30 * time.Second
+)
+
+// retryable reports whether the call that failed with e should be repeated
+// right away, rather than the message being sent again later.
+func (e *Error) retryable() bool {
+	return e.Kind == ErrTransient || e.Kind == ErrRateLimited
+}
+
+// retryDelay returns how long to wait before the retry that follows the given
+// attempt: retryAfter if the API asked for a delay, or else a jittered
+// exponential backoff between half and all of base * 2^(attempt-1), capped at
+// retryMax.
+func retryDelay(base time.Duration, attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	d := base
+	for i := 1; i < attempt && d < retryMax; i++ {
+		d *= 2
+	}
+	d = min(d, retryMax)
+	return d/2 + rand.N(d/2+1)
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date. It returns 0 if the value is missing or
+// invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// findSent looks for an email that was already sent by an earlier attempt in
+// the Sent folder, by its Message-ID and, for a copy addressed to a single
+// recipient, by that recipient. It returns nil if it found none. The search
+// needs the gmail.readonly scope.
+func (c *Client) findSent(ctx context.Context, d delivery) (*gapi.Message, error) {
+	if d.messageID == "" {
+		return nil, nil
+	}
+	query := fmt.Sprintf("in:sent rfc822msgid:%s", strings.Trim(d.messageID, "<>"))
+	if d.to != "" {
+		query += fmt.Sprintf(` to:"%s"`, d.to)
+	}
+	resp, err := c.srv.Users.Messages.List("me").Q(query).MaxResults(1).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to search sent folder: %w", err)
+	}
+	if len(resp.Messages) == 0 {
+		return nil, nil
+	}
+	return resp.Messages[0], nil
+}
@@ -0,0 +1,248 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gapi "google.golang.org/api/gmail/v1"
+)
+
+func TestSend_RetriesTransientFailure(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	httpClient, received := newFakeGmail(t, func(n int, raw string) int {
+		if n == 1 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	client := New(logger, httpClient, &config.Config{SendRetries: 2})
+	client.retryBase = time.Millisecond
+
+	raw := "To: to@example.com\r\nSubject: Retry\r\n\r\nBody"
+	opens := 0
+	src := func() (io.Reader, error) {
+		opens++
+		return source(raw)()
+	}
+	sent, err := client.Send(context.Background(), []string{"to@example.com"}, src)
+	require.NoError(t, err)
+	assert.Equal(t, "msg-2", sent.Id)
+	// The header is read once, and every attempt reads the message from the
+	// source again instead of from a copy.
+	assert.Equal(t, 3, opens)
+	// The retry sends the same message again.
+	messages := received()
+	require.Len(t, messages, 2)
+	assert.Equal(t, messages[0], messages[1])
+}
+
+func TestSend_GivesUpAfterRetries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	httpClient, received := newFakeGmail(t, func(int, string) int { return http.StatusTooManyRequests })
+	client := New(logger, httpClient, &config.Config{SendRetries: 2})
+	client.retryBase = time.Millisecond
+
+	raw := "To: to@example.com\r\nSubject: Retry\r\n\r\nBody"
+	_, err := client.Send(context.Background(), []string{"to@example.com"}, source(raw))
+	var gerr *Error
+	require.True(t, errors.As(err, &gerr), "expected a gmail.Error, got %v", err)
+	assert.Equal(t, ErrRateLimited, gerr.Kind)
+	assert.Len(t, received(), 3)
+}
+
+func TestSend_DoesNotRetryPermanentFailure(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	httpClient, received := newFakeGmail(t, func(int, string) int { return http.StatusBadRequest })
+	client := New(logger, httpClient, &config.Config{SendRetries: 2})
+	client.retryBase = time.Millisecond
+
+	raw := "To: to@example.com\r\nSubject: Rejected\r\n\r\nBody"
+	_, err := client.Send(context.Background(), []string{"to@example.com"}, source(raw))
+	assert.True(t, IsPermanent(err), "expected a permanent error, got %v", err)
+	assert.Len(t, received(), 1)
+}
+
+// newFakeGmailHandler starts a test server with the given handler and returns
+// a client that sends every Gmail API request to it.
+func newFakeGmailHandler(t *testing.T, handler http.HandlerFunc) *http.Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	target, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	return &http.Client{Transport: &redirectTransport{target: target}}
+}
+
+func TestSend_RetryAfter(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var mu sync.Mutex
+	var sends []time.Time
+	httpClient := newFakeGmailHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sends = append(sends, time.Now())
+		n := len(sends)
+		mu.Unlock()
+		if n == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, `{"error": {"code": 429, "message": "slow down"}}`, http.StatusTooManyRequests)
+			return
+		}
+		json.NewEncoder(w).Encode(&gapi.Message{Id: "msg-2"})
+	})
+	client := New(logger, httpClient, &config.Config{SendRetries: 1})
+	client.retryBase = time.Millisecond
+
+	raw := "To: to@example.com\r\nSubject: Retry-After\r\n\r\nBody"
+	_, err := client.Send(context.Background(), []string{"to@example.com"}, source(raw))
+	require.NoError(t, err)
+	require.Len(t, sends, 2)
+	assert.GreaterOrEqual(t, sends[1].Sub(sends[0]), time.Second, "the retry must wait as long as Retry-After asks")
+}
+
+func TestSend_RetryAfterBeyondDeadline(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var mu sync.Mutex
+	sends := 0
+	httpClient := newFakeGmailHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sends++
+		mu.Unlock()
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, `{"error": {"code": 503, "message": "unavailable"}}`, http.StatusServiceUnavailable)
+	})
+	client := New(logger, httpClient, &config.Config{SendRetries: 3})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	raw := "To: to@example.com\r\nSubject: Deadline\r\n\r\nBody"
+	_, err := client.Send(ctx, []string{"to@example.com"}, source(raw))
+
+	var gerr *Error
+	require.True(t, errors.As(err, &gerr), "expected a gmail.Error, got %v", err)
+	assert.Equal(t, ErrTransient, gerr.Kind)
+	assert.Equal(t, time.Minute, gerr.RetryAfter)
+	assert.Equal(t, 1, sends)
+	assert.Less(t, time.Since(start), time.Second, "Send must not wait for a retry it cannot make")
+}
+
+func TestSend_ChecksSentBeforeRetry(t *testing.T) {
+	testCases := []struct {
+		name       string
+		bccMode    string
+		raw        string
+		recipients []string
+		// wantQuery returns the expected search for the message that was sent.
+		wantQuery func(t *testing.T, sent *mail.Message) string
+	}{
+		{
+			name:       "Message-ID",
+			raw:        "To: to@example.com\r\nMessage-ID: <abc@example.com>\r\nSubject: Once\r\n\r\nBody",
+			recipients: []string{"to@example.com"},
+			wantQuery: func(t *testing.T, sent *mail.Message) string {
+				return "in:sent rfc822msgid:abc@example.com"
+			},
+		},
+		{
+			name:       "Generated Message-ID",
+			raw:        "To: to@example.com\r\nSubject: Once\r\n\r\nBody",
+			recipients: []string{"to@example.com"},
+			wantQuery: func(t *testing.T, sent *mail.Message) string {
+				id := sent.Header.Get("Message-ID")
+				require.NotEmpty(t, id, "a Message-ID must be added to search the Sent folder by")
+				return "in:sent rfc822msgid:" + strings.Trim(id, "<>")
+			},
+		},
+		{
+			name:       "Hidden recipient",
+			bccMode:    config.BccModePrivate,
+			raw:        "To: to@example.com\r\nMessage-ID: <abc@example.com>\r\nSubject: Once\r\n\r\nBody",
+			recipients: []string{"hidden@example.com"},
+			wantQuery: func(t *testing.T, sent *mail.Message) string {
+				return `in:sent rfc822msgid:abc@example.com to:"hidden@example.com"`
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			var mu sync.Mutex
+			var sent []byte
+			sends := 0
+			var query string
+			httpClient := newFakeGmailHandler(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					mu.Lock()
+					query = r.URL.Query().Get("q")
+					mu.Unlock()
+					json.NewEncoder(w).Encode(&gapi.ListMessagesResponse{Messages: []*gapi.Message{{Id: "sent-1"}}})
+					return
+				}
+				raw := readSentMessage(t, r)
+				mu.Lock()
+				sends++
+				sent = raw
+				mu.Unlock()
+				// The message is received, but the connection drops before the
+				// response, so the client cannot tell whether it was sent.
+				conn, _, err := w.(http.Hijacker).Hijack()
+				require.NoError(t, err)
+				conn.Close()
+			})
+			client := New(logger, httpClient, &config.Config{SendRetries: 2, CheckSentBeforeRetry: true, BccMode: tc.bccMode})
+			client.retryBase = time.Millisecond
+
+			msg, err := client.Send(context.Background(), tc.recipients, source(tc.raw))
+			require.NoError(t, err)
+			assert.Equal(t, "sent-1", msg.Id)
+			assert.Equal(t, 1, sends, "a message found in the Sent folder must not be sent again")
+
+			parsed, err := mail.ReadMessage(bytes.NewReader(sent))
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantQuery(t, parsed), query)
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		full := min(time.Second<<(attempt-1), retryMax)
+		d := retryDelay(time.Second, attempt, 0)
+		assert.GreaterOrEqual(t, d, full/2, "attempt %d", attempt)
+		assert.LessOrEqual(t, d, full, "attempt %d", attempt)
+	}
+	assert.Equal(t, 90*time.Second, retryDelay(time.Second, 1, 90*time.Second))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"-5", 0},
+		{"Wed, 01 May 2024 12:00:10 GMT", 10 * time.Second},
+		{"Wed, 01 May 2024 11:59:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, parseRetryAfter(tc.value, now), "Retry-After: %q", tc.value)
+	}
+}
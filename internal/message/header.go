@@ -0,0 +1,260 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxLineLength is the line length at which new header fields are folded, as
+// recommended by RFC 5322 section 2.1.1.
+const maxLineLength = 78
+
+// ErrMalformedHeader is returned by ReadHeader when the header block contains a
+// line that is neither a header field nor a continuation line.
+var ErrMalformedHeader = errors.New("malformed message header")
+
+// Field is a single header field exactly as it appeared in the message.
+type Field struct {
+	// Name is the field name as written, without the colon.
+	Name string
+	// Raw holds the complete field, including folded continuation lines and
+	// the original line endings.
+	Raw []byte
+}
+
+// Value returns the unfolded field value with surrounding whitespace removed.
+// Encoded words are returned as is.
+func (f *Field) Value() string {
+	v := f.Raw[len(f.Name)+1:]
+	v = bytes.ReplaceAll(v, []byte("\r\n"), nil)
+	v = bytes.ReplaceAll(v, []byte("\n"), nil)
+	return strings.TrimSpace(string(v))
+}
+
+// Header is the raw header block of a message. Unlike net/mail.Header it keeps
+// the order, repetitions, folding and encoding of every field, so that fields
+// that are not modified are written back byte for byte.
+type Header struct {
+	Fields []*Field
+	// eol is the line ending used by the message, reused for new fields.
+	eol string
+	// sep is the empty line that terminated the header block, if any.
+	sep []byte
+}
+
+// ReadHeader reads a header block from r up to and including the empty line
+// that separates it from the body. The body can then be read from r.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	h, _, err := readHeaderBlock(r, false)
+	return h, err
+}
+
+// readHeaderBlock implements ReadHeader. If lenient is set, a line that cannot
+// belong to the header block ends it instead of being an error, and is
+// returned as the first line of the body.
+func readHeaderBlock(r *bufio.Reader, lenient bool) (*Header, []byte, error) {
+	h := &Header{eol: "\r\n"}
+	first := true
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if len(line) == 0 {
+			// End of input without a separator line: the message has no body.
+			return h, nil, nil
+		}
+
+		if first {
+			if !bytes.HasSuffix(line, []byte("\r\n")) && bytes.HasSuffix(line, []byte("\n")) {
+				h.eol = "\n"
+			}
+			first = false
+		}
+
+		if isBlank(line) {
+			h.sep = line
+			return h, nil, nil
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(h.Fields) == 0 {
+				if lenient {
+					return h, line, nil
+				}
+				return nil, nil, fmt.Errorf("%w: continuation line before first field", ErrMalformedHeader)
+			}
+			last := h.Fields[len(h.Fields)-1]
+			last.Raw = append(last.Raw, line...)
+		} else {
+			colon := bytes.IndexByte(line, ':')
+			if colon <= 0 || !isFieldName(line[:colon]) {
+				if lenient {
+					return h, line, nil
+				}
+				return nil, nil, fmt.Errorf("%w: %q", ErrMalformedHeader, bytes.TrimRight(line, "\r\n"))
+			}
+			h.Fields = append(h.Fields, &Field{Name: string(line[:colon]), Raw: line})
+		}
+
+		if err == io.EOF {
+			// Terminate the last line so that the separator written by
+			// WriteTo does not end up on the same line.
+			last := h.Fields[len(h.Fields)-1]
+			if !bytes.HasSuffix(last.Raw, []byte("\n")) {
+				last.Raw = append(last.Raw, h.eol...)
+			}
+			return h, nil, nil
+		}
+	}
+}
+
+// Get returns the value of the first field with the given name, or "" if there
+// is none. Names are matched case-insensitively.
+func (h *Header) Get(name string) string {
+	for _, f := range h.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value()
+		}
+	}
+	return ""
+}
+
+// Values returns the values of all fields with the given name, in order.
+func (h *Header) Values(name string) []string {
+	var values []string
+	for _, f := range h.Fields {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Value())
+		}
+	}
+	return values
+}
+
+// Has reports whether the header contains a field with the given name.
+func (h *Header) Has(name string) bool {
+	for _, f := range h.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set replaces the first field with the given name by a new field holding
+// value, and removes any further fields with that name. If there is no such
+// field, the new field is added at the end of the header.
+func (h *Header) Set(name, value string) {
+	field := h.newField(name, value)
+	for i, f := range h.Fields {
+		if strings.EqualFold(f.Name, name) {
+			h.Fields[i] = field
+			h.delFrom(name, i+1)
+			return
+		}
+	}
+	h.Fields = append(h.Fields, field)
+}
+
+// Add appends a new field at the end of the header.
+func (h *Header) Add(name, value string) {
+	h.Fields = append(h.Fields, h.newField(name, value))
+}
+
+// Prepend inserts a new field at the top of the header, where trace fields
+// such as Received belong.
+func (h *Header) Prepend(name, value string) {
+	h.Fields = append([]*Field{h.newField(name, value)}, h.Fields...)
+}
+
+// Del removes all fields with the given name.
+func (h *Header) Del(name string) {
+	h.delFrom(name, 0)
+}
+
+func (h *Header) delFrom(name string, start int) {
+	kept := h.Fields[:start]
+	for _, f := range h.Fields[start:] {
+		if !strings.EqualFold(f.Name, name) {
+			kept = append(kept, f)
+		}
+	}
+	h.Fields = kept
+}
+
+// WriteTo writes the header block, including the separator line, to w.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for _, f := range h.Fields {
+		m, err := w.Write(f.Raw)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	sep := h.sep
+	if sep == nil {
+		sep = []byte(h.eol)
+	}
+	m, err := w.Write(sep)
+	n += int64(m)
+	return n, err
+}
+
+// newField formats a field, folding it at whitespace so that lines stay within
+// maxLineLength where possible.
+func (h *Header) newField(name, value string) *Field {
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteString(":")
+
+	lineLen := len(name) + 1
+	for i, word := range strings.Fields(value) {
+		if i > 0 && lineLen+1+len(word) > maxLineLength {
+			b.WriteString(h.eol)
+			lineLen = 0
+		}
+		b.WriteString(" ")
+		b.WriteString(word)
+		lineLen += 1 + len(word)
+	}
+	b.WriteString(h.eol)
+
+	return &Field{Name: name, Raw: []byte(b.String())}
+}
+
+// ParseField splits a "Name: value" string, as used in configuration files,
+// into a field name and a value with surrounding whitespace removed.
+func ParseField(s string) (name, value string, err error) {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok || !ValidFieldName(name) {
+		return "", "", fmt.Errorf("%w: %q is not a \"Name: value\" header field", ErrMalformedHeader, s)
+	}
+	return name, strings.TrimSpace(value), nil
+}
+
+// ValidFieldName reports whether name can be used as a header field name.
+func ValidFieldName(name string) bool {
+	return name != "" && isFieldName([]byte(name))
+}
+
+func isBlank(line []byte) bool {
+	return string(line) == "\r\n" || string(line) == "\n"
+}
+
+// isFieldName reports whether b is a valid field name: printable US-ASCII
+// characters other than colon and space (RFC 5322 section 3.6.8).
+func isFieldName(b []byte) bool {
+	for _, c := range b {
+		if c <= ' ' || c > '~' || c == ':' {
+			return false
+		}
+	}
+	return true
+}
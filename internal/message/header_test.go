@@ -0,0 +1,163 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readHeader(t *testing.T, raw string) (*Header, string) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(raw))
+	h, err := ReadHeader(br)
+	require.NoError(t, err)
+	body, err := io.ReadAll(br)
+	require.NoError(t, err)
+	return h, string(body)
+}
+
+func writeHeader(t *testing.T, h *Header) string {
+	t.Helper()
+	var buf bytes.Buffer
+	_, err := h.WriteTo(&buf)
+	require.NoError(t, err)
+	return buf.String()
+}
+
+func TestReadHeader_RoundTrip(t *testing.T) {
+	testCases := []struct {
+		name string
+		raw  string
+	}{
+		{
+			name: "Folded and repeated fields",
+			raw: "Received: from a\r\n\tby b; Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+				"Received: from c by d; Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+				"Subject: =?UTF-8?Q?H=C3=A9llo?=\r\n =?UTF-8?Q?_world?=\r\n" +
+				"\r\n",
+		},
+		{
+			name: "Bare LF line endings",
+			raw:  "from: a@example.com\nsubject: hi\n\n",
+		},
+		{
+			name: "Unusual spacing is kept",
+			raw:  "X-Custom:no-space\r\nX-Other:    lots\r\n\r\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, body := readHeader(t, tc.raw+"body\r\n")
+			assert.Equal(t, "body\r\n", body)
+			assert.Equal(t, tc.raw, writeHeader(t, h))
+		})
+	}
+}
+
+func TestReadHeader_Values(t *testing.T) {
+	h, _ := readHeader(t, "Received: one\r\nsubject: Folded\r\n line\r\nRECEIVED: two\r\n\r\n")
+
+	assert.Equal(t, "Folded line", h.Get("Subject"))
+	assert.Equal(t, []string{"one", "two"}, h.Values("Received"))
+	assert.True(t, h.Has("received"))
+	assert.False(t, h.Has("To"))
+	assert.Equal(t, "", h.Get("To"))
+}
+
+func TestReadHeader_NoBody(t *testing.T) {
+	h, body := readHeader(t, "Subject: only a header")
+	assert.Empty(t, body)
+	assert.Equal(t, "Subject: only a header\r\n\r\n", writeHeader(t, h))
+}
+
+func TestReadHeader_Malformed(t *testing.T) {
+	for _, raw := range []string{
+		"This is not a header\r\n\r\nbody",
+		" continuation first\r\n\r\n",
+		"Bad Name: value\r\n\r\n",
+	} {
+		_, err := ReadHeader(bufio.NewReader(strings.NewReader(raw)))
+		assert.True(t, errors.Is(err, ErrMalformedHeader), "expected ErrMalformedHeader for %q, got %v", raw, err)
+	}
+}
+
+func TestHeader_Edits(t *testing.T) {
+	raw := "Received: r1\r\n" +
+		"To: old@example.com\r\n" +
+		"X-Mailer: Device\r\n" +
+		"to: duplicate@example.com\r\n" +
+		"Subject: Test\r\n" +
+		"\r\n"
+
+	t.Run("Set replaces in place and drops duplicates", func(t *testing.T) {
+		h, _ := readHeader(t, raw)
+		h.Set("To", "new@example.com")
+		assert.Equal(t, "Received: r1\r\nTo: new@example.com\r\nX-Mailer: Device\r\nSubject: Test\r\n\r\n", writeHeader(t, h))
+	})
+
+	t.Run("Set appends a missing field", func(t *testing.T) {
+		h, _ := readHeader(t, raw)
+		h.Set("Reply-To", "reply@example.com")
+		assert.True(t, strings.HasSuffix(writeHeader(t, h), "Subject: Test\r\nReply-To: reply@example.com\r\n\r\n"))
+	})
+
+	t.Run("Del removes every instance", func(t *testing.T) {
+		h, _ := readHeader(t, raw)
+		h.Del("TO")
+		assert.Equal(t, "Received: r1\r\nX-Mailer: Device\r\nSubject: Test\r\n\r\n", writeHeader(t, h))
+	})
+
+	t.Run("Add and Prepend", func(t *testing.T) {
+		h, _ := readHeader(t, raw)
+		h.Add("X-Tracking", "abc")
+		h.Prepend("Received", "r0")
+		out := writeHeader(t, h)
+		assert.True(t, strings.HasPrefix(out, "Received: r0\r\nReceived: r1\r\n"))
+		assert.True(t, strings.HasSuffix(out, "Subject: Test\r\nX-Tracking: abc\r\n\r\n"))
+	})
+
+	t.Run("New fields use the message line ending", func(t *testing.T) {
+		h, _ := readHeader(t, "Subject: lf\n\n")
+		h.Set("To", "a@example.com")
+		assert.Equal(t, "Subject: lf\nTo: a@example.com\n\n", writeHeader(t, h))
+	})
+}
+
+func TestHeader_SetFoldsLongValues(t *testing.T) {
+	h, _ := readHeader(t, "Subject: x\r\n\r\n")
+	var rcpts []string
+	for i := 0; i < 10; i++ {
+		rcpts = append(rcpts, "recipient-number-"+string(rune('a'+i))+"@example.com")
+	}
+	h.Set("To", strings.Join(rcpts, ", "))
+
+	out := writeHeader(t, h)
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n\r\n"), "\r\n") {
+		assert.LessOrEqual(t, len(line), maxLineLength, "line too long: %q", line)
+	}
+	assert.Equal(t, strings.Join(rcpts, ", "), h.Get("To"))
+}
+
+func TestParseField(t *testing.T) {
+	name, value, err := ParseField("X-Device:  scanner 3 ")
+	require.NoError(t, err)
+	assert.Equal(t, "X-Device", name)
+	assert.Equal(t, "scanner 3", value)
+
+	name, value, err = ParseField("Subject:[SCANNER]")
+	require.NoError(t, err)
+	assert.Equal(t, "Subject", name)
+	assert.Equal(t, "[SCANNER]", value)
+
+	for _, bad := range []string{"X-Device scanner", ": value", "X Device: scanner"} {
+		_, _, err := ParseField(bad)
+		assert.ErrorIs(t, err, ErrMalformedHeader, bad)
+	}
+}
@@ -0,0 +1,242 @@
+package message
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// The repairs Repair can apply, as reported in its result.
+const (
+	RepairLineEndings    = "line-endings"
+	RepairMissingHeader  = "missing-header"
+	RepairSeparator      = "header-separator"
+	RepairDate           = "date"
+	RepairMessageID      = "message-id"
+	RepairMIMEVersion    = "mime-version"
+	RepairHeaderEncoding = "header-encoding"
+)
+
+// addressFields are the header fields holding address lists. Their display
+// names are encoded separately so that the addresses stay readable.
+var addressFields = []string{"From", "Sender", "Reply-To", "To", "Cc", "Bcc"}
+
+// RepairOptions configures Repair.
+type RepairOptions struct {
+	// LegacyCharset is the charset of raw 8-bit header text that is not valid
+	// UTF-8, e.g. "windows-1252". Such text is left as is if it is empty.
+	LegacyCharset string
+	// Domain is the right-hand side of generated Message-IDs. The host name
+	// is used if it is empty.
+	Domain string
+	// Now returns the time used for a generated Date; time.Now if nil.
+	Now func() time.Time
+}
+
+// LookupCharset returns the decoder for a charset name such as "iso-8859-1",
+// "windows-1252" or "shift_jis".
+func LookupCharset(name string) (encoding.Encoding, error) {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %q: %w", name, err)
+	}
+	return enc, nil
+}
+
+// Repair copies the message in r to w and fixes the problems that legacy
+// devices are known for: bare LF line endings, a missing header block or
+// separator line, missing Date, Message-ID and MIME-Version fields, and raw
+// 8-bit text in header fields, which is encoded as RFC 2047 encoded words. It
+// returns the repairs that were applied. The body is only changed by the line
+// ending repair.
+func Repair(w io.Writer, r io.Reader, opts RepairOptions) ([]string, error) {
+	var charset encoding.Encoding
+	if opts.LegacyCharset != "" {
+		var err error
+		if charset, err = LookupCharset(opts.LegacyCharset); err != nil {
+			return nil, err
+		}
+	}
+
+	var repairs []string
+	crlf := &crlfReader{r: r}
+	br := bufio.NewReader(crlf)
+
+	// The header block ends at the first line that is not a header field,
+	// even if the empty separator line is missing.
+	header, body, err := readHeaderBlock(br, true)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		if len(header.Fields) == 0 {
+			repairs = append(repairs, RepairMissingHeader)
+		} else {
+			repairs = append(repairs, RepairSeparator)
+		}
+	}
+
+	encoded := false
+	for i, f := range header.Fields {
+		if isASCII(f.Raw) {
+			continue
+		}
+		value := []byte(f.Value())
+		if !utf8.Valid(value) && charset != nil {
+			decoded, err := charset.NewDecoder().Bytes(value)
+			if err != nil {
+				continue
+			}
+			value = decoded
+		}
+		if !utf8.Valid(value) {
+			continue
+		}
+		header.Fields[i] = header.newField(f.Name, encodeValue(f.Name, string(value)))
+		encoded = true
+	}
+	if encoded {
+		repairs = append(repairs, RepairHeaderEncoding)
+	}
+
+	if !header.Has("Date") {
+		now := time.Now
+		if opts.Now != nil {
+			now = opts.Now
+		}
+		header.Add("Date", now().Format(time.RFC1123Z))
+		repairs = append(repairs, RepairDate)
+	}
+	if !header.Has("Message-ID") {
+		id, err := NewMessageID(opts.Domain)
+		if err != nil {
+			return nil, err
+		}
+		header.Add("Message-ID", id)
+		repairs = append(repairs, RepairMessageID)
+	}
+	if !header.Has("MIME-Version") {
+		header.Add("MIME-Version", "1.0")
+		repairs = append(repairs, RepairMIMEVersion)
+	}
+
+	if _, err := header.WriteTo(w); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, br); err != nil {
+		return nil, err
+	}
+	if crlf.fixed {
+		repairs = append([]string{RepairLineEndings}, repairs...)
+	}
+	return repairs, nil
+}
+
+// encodeValue encodes a UTF-8 header value as RFC 2047 encoded words. In
+// address fields only the display names are encoded.
+func encodeValue(name, value string) string {
+	for _, field := range addressFields {
+		if !strings.EqualFold(name, field) {
+			continue
+		}
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			// Keep the UTF-8 text rather than hide the addresses.
+			return value
+		}
+		formatted := make([]string, len(addrs))
+		for i, addr := range addrs {
+			formatted[i] = addr.String()
+		}
+		return strings.Join(formatted, ", ")
+	}
+	return mime.QEncoding.Encode("utf-8", value)
+}
+
+// NewMessageID returns a unique Message-ID in the given domain, or in the
+// host name if domain is empty.
+func NewMessageID(domain string) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate message id: %w", err)
+	}
+	if domain == "" {
+		var err error
+		if domain, err = os.Hostname(); err != nil || domain == "" {
+			domain = "localhost"
+		}
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b[:]), domain), nil
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// crlfReader turns bare LF line endings into CRLF and records whether it had
+// to.
+type crlfReader struct {
+	r      io.Reader
+	buf    []byte
+	prevCR bool
+	// pending is a LF still to be returned after an inserted CR.
+	pending bool
+	fixed   bool
+}
+
+func (c *crlfReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n := 0
+	if c.pending {
+		p[0] = '\n'
+		n = 1
+		c.pending = false
+	}
+
+	// Leave room for the CRs that may have to be inserted.
+	size := (len(p) - n + 1) / 2
+	if cap(c.buf) < size {
+		c.buf = make([]byte, size)
+	}
+	m, err := c.r.Read(c.buf[:size])
+	for _, b := range c.buf[:m] {
+		if b == '\n' && !c.prevCR {
+			c.fixed = true
+			p[n] = '\r'
+			n++
+			if n == len(p) {
+				c.pending = true
+				c.prevCR = false
+				continue
+			}
+		}
+		p[n] = b
+		n++
+		c.prevCR = b == '\r'
+	}
+	if err == io.EOF && c.pending {
+		err = nil
+	}
+	return n, err
+}
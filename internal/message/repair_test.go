@@ -0,0 +1,131 @@
+package message
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var repairTime = time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+
+func repair(t *testing.T, raw string, opts RepairOptions) (string, []string) {
+	t.Helper()
+	opts.Now = func() time.Time { return repairTime }
+	if opts.Domain == "" {
+		opts.Domain = "relay.example.com"
+	}
+	var buf bytes.Buffer
+	repairs, err := Repair(&buf, strings.NewReader(raw), opts)
+	require.NoError(t, err)
+	return buf.String(), repairs
+}
+
+func TestRepair_WellFormedMessageIsUnchanged(t *testing.T) {
+	raw := "From: a@example.com\r\n" +
+		"Date: Tue, 04 Mar 2025 05:06:07 +0000\r\n" +
+		"Message-ID: <1@example.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n" +
+		"\r\n" +
+		"Body\r\n"
+	out, repairs := repair(t, raw, RepairOptions{LegacyCharset: "windows-1252"})
+	assert.Empty(t, repairs)
+	assert.Equal(t, raw, out)
+}
+
+func TestRepair_LegacyDevice(t *testing.T) {
+	// Bare LF line endings, no Date, Message-ID or MIME-Version, and raw
+	// Latin-1 in the Subject and the display name.
+	raw := "From: Dr\xfccker <printer@example.com>\n" +
+		"Subject: Gr\xfc\xdfe vom Drucker\n" +
+		"\n" +
+		"Line 1\nLine 2\n"
+	out, repairs := repair(t, raw, RepairOptions{LegacyCharset: "iso-8859-1"})
+	assert.Equal(t, []string{RepairLineEndings, RepairHeaderEncoding, RepairDate, RepairMessageID, RepairMIMEVersion}, repairs)
+
+	assert.NotContains(t, strings.ReplaceAll(out, "\r\n", ""), "\n", "every line ends in CRLF")
+	msg, err := mail.ReadMessage(strings.NewReader(out))
+	require.NoError(t, err)
+
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	require.NoError(t, err)
+	assert.Equal(t, "Drücker", from.Name)
+	assert.Equal(t, "printer@example.com", from.Address)
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Grüße vom Drucker", subject)
+
+	assert.Equal(t, "Tue, 04 Mar 2025 05:06:07 +0000", msg.Header.Get("Date"))
+	assert.Regexp(t, `^<[0-9a-f]{32}@relay\.example\.com>$`, msg.Header.Get("Message-ID"))
+	assert.Equal(t, "1.0", msg.Header.Get("MIME-Version"))
+
+	body, err := io.ReadAll(msg.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "Line 1\r\nLine 2\r\n", string(body))
+}
+
+func TestRepair_RawUTF8Header(t *testing.T) {
+	raw := "Date: Tue, 04 Mar 2025 05:06:07 +0000\r\nMessage-ID: <1@example.com>\r\nMIME-Version: 1.0\r\nSubject: Grüße\r\n\r\nBody"
+	out, repairs := repair(t, raw, RepairOptions{LegacyCharset: "windows-1252"})
+	assert.Equal(t, []string{RepairHeaderEncoding}, repairs)
+	assert.Contains(t, out, "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n")
+}
+
+func TestRepair_NoHeader(t *testing.T) {
+	out, repairs := repair(t, "Printer out of paper.\r\nTray 2\r\n", RepairOptions{})
+	assert.Equal(t, []string{RepairMissingHeader, RepairDate, RepairMessageID, RepairMIMEVersion}, repairs)
+
+	msg, err := mail.ReadMessage(strings.NewReader(out))
+	require.NoError(t, err)
+	body, err := io.ReadAll(msg.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "Printer out of paper.\r\nTray 2\r\n", string(body))
+}
+
+func TestRepair_MissingSeparator(t *testing.T) {
+	out, repairs := repair(t, "Subject: Toner low\r\nTray 2\r\n", RepairOptions{})
+	assert.Equal(t, []string{RepairSeparator, RepairDate, RepairMessageID, RepairMIMEVersion}, repairs)
+
+	msg, err := mail.ReadMessage(strings.NewReader(out))
+	require.NoError(t, err)
+	assert.Equal(t, "Toner low", msg.Header.Get("Subject"))
+	body, err := io.ReadAll(msg.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "Tray 2\r\n", string(body))
+}
+
+func TestRepair_UnknownCharset(t *testing.T) {
+	_, err := Repair(io.Discard, strings.NewReader("Subject: x\r\n\r\n"), RepairOptions{LegacyCharset: "klingon"})
+	assert.Error(t, err)
+}
+
+func TestCRLFReader(t *testing.T) {
+	testCases := []struct {
+		in, want string
+		fixed    bool
+	}{
+		{"a\r\nb\r\n", "a\r\nb\r\n", false},
+		{"a\nb\n", "a\r\nb\r\n", true},
+		{"\n\n\n", "\r\n\r\n\r\n", true},
+		{"a\r\nb\nc", "a\r\nb\r\nc", true},
+	}
+	for _, tc := range testCases {
+		// Read one byte at a time to exercise the CRLF split across reads.
+		for _, r := range []io.Reader{strings.NewReader(tc.in), iotest.OneByteReader(strings.NewReader(tc.in))} {
+			c := &crlfReader{r: r}
+			out, err := io.ReadAll(iotest.OneByteReader(c))
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, string(out))
+			assert.Equal(t, tc.fixed, c.fixed)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package netutil
 
 import (
+	"fmt"
 	"log/slog"
 	"net"
 )
@@ -14,14 +15,59 @@ func IsAllowed(log *slog.Logger, clientIP net.IP, allowedSubnets []string) bool
 		return true
 	}
 
-	for _, subnetStr := range allowedSubnets {
+	if entry, ok := matchSubnets(log, clientIP, allowedSubnets, "AllowedSubnets"); ok {
+		log.Debug("client IP is in an allowed subnet", "clientIP", clientIP.String(), "entry", entry)
+		return true
+	}
+
+	// If no match was found after checking all rules, deny access.
+	log.Warn("client IP is not in any allowed subnet", "clientIP", clientIP.String())
+	return false
+}
+
+// IsTrusted checks if a given IP address is in a list of trusted subnets/IPs,
+// whose clients may relay without authenticating. The entries have the same
+// format as for IsAllowed, but an empty list trusts no one.
+func IsTrusted(log *slog.Logger, clientIP net.IP, trustedSubnets []string) bool {
+	if entry, ok := matchSubnets(log, clientIP, trustedSubnets, "TrustedSubnets"); ok {
+		log.Debug("client IP is in a trusted subnet", "clientIP", clientIP.String(), "entry", entry)
+		return true
+	}
+	return false
+}
+
+// InSubnets reports whether a given IP address is in a list of subnets/IPs.
+// Unlike IsAllowed, an empty list contains no addresses.
+func InSubnets(log *slog.Logger, clientIP net.IP, subnets []string) bool {
+	_, ok := matchSubnets(log, clientIP, subnets, "subnets")
+	return ok
+}
+
+// ValidateSubnets returns an error for the first entry that is neither an IP
+// address nor a CIDR block.
+func ValidateSubnets(subnets []string) error {
+	for _, subnetStr := range subnets {
+		if _, _, err := net.ParseCIDR(subnetStr); err == nil {
+			continue
+		}
+		if net.ParseIP(subnetStr) == nil {
+			return fmt.Errorf("%q is neither an IP address nor a CIDR subnet", subnetStr)
+		}
+	}
+	return nil
+}
+
+// matchSubnets returns the first entry of subnets that contains clientIP.
+// listName is the config option the entries came from, used when logging
+// invalid entries.
+func matchSubnets(log *slog.Logger, clientIP net.IP, subnets []string, listName string) (string, bool) {
+	for _, subnetStr := range subnets {
 		// Try parsing as a CIDR block first.
 		_, cidrNet, err := net.ParseCIDR(subnetStr)
 		if err == nil {
 			// If it's a valid CIDR, check if the IP is contained within it.
 			if cidrNet.Contains(clientIP) {
-				log.Debug("client IP is within allowed CIDR", "clientIP", clientIP.String(), "cidr", subnetStr)
-				return true
+				return subnetStr, true
 			}
 			continue
 		}
@@ -31,17 +77,13 @@ func IsAllowed(log *slog.Logger, clientIP net.IP, allowedSubnets []string) bool
 		if ip != nil {
 			// If it's a valid IP, check for an exact match.
 			if ip.Equal(clientIP) {
-				log.Debug("client IP is an exact match for allowed IP", "clientIP", clientIP.String(), "allowedIP", subnetStr)
-				return true
+				return subnetStr, true
 			}
 			continue
 		}
 
 		// If the entry is neither valid CIDR nor a valid IP, log a warning.
-		log.Warn("invalid entry in AllowedSubnets list", "entry", subnetStr)
+		log.Warn("invalid entry in "+listName+" list", "entry", subnetStr)
 	}
-
-	// If no match was found after checking all rules, deny access.
-	log.Warn("client IP is not in any allowed subnet", "clientIP", clientIP.String())
-	return false
+	return "", false
 }
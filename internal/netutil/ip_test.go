@@ -99,3 +99,38 @@ func TestIsAllowed(t *testing.T) {
 		})
 	}
 }
+
+func TestIsTrusted(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	testCases := []struct {
+		name           string
+		clientIP       string
+		trustedSubnets []string
+		expected       bool
+	}{
+		{"Empty list trusts no one", "192.168.1.10", []string{}, false},
+		{"IP in trusted subnet", "192.168.1.10", []string{"192.168.1.0/24"}, true},
+		{"IP matches trusted single IP", "10.0.0.5", []string{"192.168.1.0/24", "10.0.0.5"}, true},
+		{"IP not in trusted list", "10.0.0.6", []string{"192.168.1.0/24", "10.0.0.5"}, false},
+		{"Invalid entry is skipped", "10.0.0.5", []string{"not-an-ip", "10.0.0.5"}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := IsTrusted(logger, net.ParseIP(tc.clientIP), tc.trustedSubnets)
+			if result != tc.expected {
+				t.Errorf("IsTrusted(%s, %v) = %v; want %v", tc.clientIP, tc.trustedSubnets, result, tc.expected)
+			}
+		})
+	}
+}
+
+func TestValidateSubnets(t *testing.T) {
+	if err := ValidateSubnets([]string{"192.168.1.0/24", "10.0.0.5", "2001:db8::/32"}); err != nil {
+		t.Errorf("ValidateSubnets() returned an error for valid entries: %v", err)
+	}
+	if err := ValidateSubnets([]string{"192.168.1.0/24", "printers.lan"}); err == nil {
+		t.Error("ValidateSubnets() accepted a hostname")
+	}
+}
@@ -0,0 +1,40 @@
+package policy
+
+import "fmt"
+
+// RecipientError is returned by CheckRecipient for an address that may not
+// be relayed to.
+type RecipientError struct {
+	Address string
+	// Pattern is the RecipientDeny entry that matched, empty if the address
+	// was refused for not matching RecipientAllow.
+	Pattern string
+}
+
+func (e *RecipientError) Error() string {
+	if e.Pattern != "" {
+		return fmt.Sprintf("recipient %s is denied by %q", e.Address, e.Pattern)
+	}
+	return fmt.Sprintf("recipient %s is not in the allowed recipients", e.Address)
+}
+
+// CheckRecipient checks addr against the recipient allowlist and denylist.
+// The denylist takes precedence. An empty allowlist allows every recipient
+// that is not denied. It returns the allow pattern that matched, if any, for
+// logging.
+func CheckRecipient(allow, deny []string, addr string) (string, error) {
+	for _, pattern := range deny {
+		if MatchAddress(pattern, addr) {
+			return "", &RecipientError{Address: addr, Pattern: pattern}
+		}
+	}
+	if len(allow) == 0 {
+		return "", nil
+	}
+	for _, pattern := range allow {
+		if MatchAddress(pattern, addr) {
+			return pattern, nil
+		}
+	}
+	return "", &RecipientError{Address: addr}
+}
@@ -0,0 +1,39 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckRecipient(t *testing.T) {
+	allow := []string{"@example.com", "@*.example.com"}
+	deny := []string{"@hr.example.com", "ceo@example.com"}
+
+	matched, err := CheckRecipient(allow, deny, "alice@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "@example.com", matched)
+
+	matched, err = CheckRecipient(allow, deny, "ops@alerts.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "@*.example.com", matched)
+
+	// The denylist wins over the allowlist.
+	_, err = CheckRecipient(allow, deny, "payroll@hr.example.com")
+	var rcptErr *RecipientError
+	if assert.True(t, errors.As(err, &rcptErr)) {
+		assert.Equal(t, "@hr.example.com", rcptErr.Pattern)
+	}
+	_, err = CheckRecipient(allow, deny, "CEO@example.com")
+	assert.Error(t, err)
+
+	_, err = CheckRecipient(allow, deny, "someone@gmail.com")
+	assert.EqualError(t, err, "recipient someone@gmail.com is not in the allowed recipients")
+
+	// Without an allowlist only the denylist applies.
+	_, err = CheckRecipient(nil, deny, "someone@gmail.com")
+	assert.NoError(t, err)
+	_, err = CheckRecipient(nil, deny, "ceo@example.com")
+	assert.EqualError(t, err, `recipient ceo@example.com is denied by "ceo@example.com"`)
+}
@@ -0,0 +1,108 @@
+package policy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/ethanpil/smog/internal/netutil"
+)
+
+// MatchAddress reports whether addr matches pattern. A pattern is either an
+// address, "@domain" for every address in a domain, or a glob in which "*"
+// and "?" match any run of characters or a single character, as in
+// "scanner-*@example.com" or "@*.example.com". Matching is case-insensitive.
+func MatchAddress(pattern, addr string) bool {
+	pattern = strings.ToLower(pattern)
+	addr = strings.ToLower(addr)
+	isGlob := strings.ContainsAny(pattern, "*?[")
+	if strings.HasPrefix(pattern, "@") {
+		if !isGlob {
+			return strings.HasSuffix(addr, pattern)
+		}
+		// "@*.example.com" matches every address in the subdomains.
+		pattern = "*" + pattern
+	}
+	if isGlob {
+		// Addresses contain no slashes, so path.Match works as a plain glob.
+		ok, err := path.Match(pattern, addr)
+		return err == nil && ok
+	}
+	return addr == pattern
+}
+
+// ValidatePatterns checks the syntax of address patterns. MatchAddress never
+// matches a malformed glob such as "[a-", so one would silently refuse every
+// address.
+func ValidatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid address pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// MatchAnyAddress reports whether addr matches any of the patterns.
+func MatchAnyAddress(patterns []string, addr string) bool {
+	for _, pattern := range patterns {
+		if MatchAddress(pattern, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// SenderError is returned by CheckSender for an address the client may not
+// use.
+type SenderError struct {
+	Address string
+	// Client describes who was refused, e.g. `user "printer"`.
+	Client string
+}
+
+func (e *SenderError) Error() string {
+	return fmt.Sprintf("sender %s is not allowed for %s", e.Address, e.Client)
+}
+
+// CheckSender checks addr against the sender rules that apply to a client.
+// A rule applies if it lists the user the client authenticated as, or if its
+// subnets contain the client's IP; a rule that lists neither applies to every
+// client. The address must match the Senders of every rule that applies.
+// Clients no rule applies to may use any sender.
+func CheckSender(log *slog.Logger, rules []config.SenderRule, user string, ip net.IP, addr string) error {
+	for i, rule := range rules {
+		client, ok := ruleApplies(log, rule, user, ip)
+		if !ok {
+			continue
+		}
+		if !MatchAnyAddress(rule.Senders, addr) {
+			log.Debug("sender rule refused address", "rule", i+1, "address", addr, "client", client)
+			return &SenderError{Address: addr, Client: client}
+		}
+	}
+	return nil
+}
+
+// ruleApplies reports whether a rule applies to a client and describes the
+// client the way the rule selected it.
+func ruleApplies(log *slog.Logger, rule config.SenderRule, user string, ip net.IP) (string, bool) {
+	if len(rule.Users) == 0 && len(rule.Subnets) == 0 {
+		if user != "" {
+			return fmt.Sprintf("user %q", user), true
+		}
+		return "client " + ip.String(), true
+	}
+	for _, u := range rule.Users {
+		if user != "" && u == user {
+			return fmt.Sprintf("user %q", user), true
+		}
+	}
+	if len(rule.Subnets) > 0 && netutil.InSubnets(log, ip, rule.Subnets) {
+		return "client " + ip.String(), true
+	}
+	return "", false
+}
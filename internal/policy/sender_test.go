@@ -0,0 +1,67 @@
+package policy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchAddress(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		addr    string
+		want    bool
+	}{
+		{"printer@example.com", "printer@example.com", true},
+		{"printer@example.com", "Printer@Example.com", true},
+		{"printer@example.com", "scanner@example.com", false},
+		{"@example.com", "anyone@example.com", true},
+		{"@example.com", "anyone@sub.example.com", false},
+		{"@example.com", "anyone@badexample.com", false},
+		{"scanner-*@example.com", "scanner-3f@example.com", true},
+		{"scanner-*@example.com", "scanner@example.com", false},
+		{"*@*.example.com", "ups@alerts.example.com", true},
+		{"printer?@example.com", "printer1@example.com", true},
+		{"@*.example.com", "ups@alerts.example.com", true},
+		{"@*.example.com", "ups@example.com", false},
+		{"[", "[", false},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, MatchAddress(tc.pattern, tc.addr), "MatchAddress(%q, %q)", tc.pattern, tc.addr)
+	}
+}
+
+func TestCheckSender(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rules := []config.SenderRule{
+		{Subnets: []string{"192.168.1.0/24"}, Senders: []string{"@devices.example.com"}},
+		{Users: []string{"printer"}, Senders: []string{"printer@devices.example.com"}},
+	}
+	lan := net.ParseIP("192.168.1.20")
+	wan := net.ParseIP("203.0.113.7")
+
+	assert.NoError(t, CheckSender(logger, rules, "", lan, "ups@devices.example.com"))
+	assert.NoError(t, CheckSender(logger, rules, "printer", wan, "printer@devices.example.com"))
+	assert.NoError(t, CheckSender(logger, rules, "alice", wan, "alice@example.org"), "no rule applies")
+
+	// Every rule that applies must allow the address.
+	err := CheckSender(logger, rules, "printer", lan, "ups@devices.example.com")
+	var senderErr *SenderError
+	if assert.True(t, errors.As(err, &senderErr)) {
+		assert.Equal(t, "ups@devices.example.com", senderErr.Address)
+		assert.Equal(t, `sender ups@devices.example.com is not allowed for user "printer"`, err.Error())
+	}
+
+	err = CheckSender(logger, rules, "", lan, "ceo@example.com")
+	assert.EqualError(t, err, "sender ceo@example.com is not allowed for client 192.168.1.20")
+
+	// A rule without Users and Subnets applies to everyone.
+	everyone := []config.SenderRule{{Senders: []string{"@example.com"}}}
+	assert.NoError(t, CheckSender(logger, everyone, "", wan, "a@example.com"))
+	assert.Error(t, CheckSender(logger, everyone, "", wan, "a@example.org"))
+}
@@ -0,0 +1,126 @@
+package rules
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/ethanpil/smog/internal/message"
+	"github.com/ethanpil/smog/internal/netutil"
+	"github.com/ethanpil/smog/internal/policy"
+)
+
+// Envelope is what the rules match a message on.
+type Envelope struct {
+	ClientIP net.IP
+	// User is the authenticated username, empty for unauthenticated clients.
+	User string
+	From string
+	To   []string
+}
+
+// field is a parsed "Name: value" action.
+type field struct {
+	name, value string
+}
+
+// rule is a config.Rule with its actions parsed.
+type rule struct {
+	config.Rule
+	set, prefix, add []field
+}
+
+// Engine applies the header rules of the configuration to messages.
+type Engine struct {
+	log   *slog.Logger
+	rules []rule
+}
+
+// New returns an Engine for the rules, which are applied in order.
+func New(logger *slog.Logger, rules []config.Rule) (*Engine, error) {
+	e := &Engine{log: logger}
+	for i, r := range rules {
+		parsed := rule{Rule: r}
+		if parsed.Name == "" {
+			parsed.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		for _, action := range []struct {
+			entries []string
+			fields  *[]field
+		}{{r.Set, &parsed.set}, {r.Prefix, &parsed.prefix}, {r.Add, &parsed.add}} {
+			for _, entry := range action.entries {
+				name, value, err := message.ParseField(entry)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s: %w", parsed.Name, err)
+				}
+				*action.fields = append(*action.fields, field{name, value})
+			}
+		}
+		e.rules = append(e.rules, parsed)
+	}
+	return e, nil
+}
+
+// Empty reports whether there are no rules to apply. A nil Engine is empty.
+func (e *Engine) Empty() bool {
+	return e == nil || len(e.rules) == 0
+}
+
+// Apply applies the rules that match env to header and returns their names.
+// Within a rule, fields are removed first, then set, prefixed and added.
+func (e *Engine) Apply(env Envelope, header *message.Header) []string {
+	var applied []string
+	for _, r := range e.rules {
+		if !e.matches(r, env) {
+			continue
+		}
+		for _, name := range r.Remove {
+			header.Del(name)
+		}
+		for _, f := range r.set {
+			header.Set(f.name, f.value)
+		}
+		for _, f := range r.prefix {
+			header.Set(f.name, prefix(f.value, header.Get(f.name)))
+		}
+		for _, f := range r.add {
+			header.Add(f.name, f.value)
+		}
+		applied = append(applied, r.Name)
+	}
+	return applied
+}
+
+// matches reports whether all the conditions of a rule that are set match.
+func (e *Engine) matches(r rule, env Envelope) bool {
+	if len(r.Subnets) > 0 && (env.ClientIP == nil || !netutil.InSubnets(e.log, env.ClientIP, r.Subnets)) {
+		return false
+	}
+	if len(r.Users) > 0 && (env.User == "" || !slices.Contains(r.Users, env.User)) {
+		return false
+	}
+	if len(r.Senders) > 0 && !policy.MatchAnyAddress(r.Senders, env.From) {
+		return false
+	}
+	if len(r.Recipients) > 0 && !slices.ContainsFunc(env.To, func(to string) bool {
+		return policy.MatchAnyAddress(r.Recipients, to)
+	}) {
+		return false
+	}
+	return true
+}
+
+// prefix puts p in front of value, separated by a space, unless value already
+// contains it, as replies to a prefixed subject do.
+func prefix(p, value string) string {
+	if value == "" {
+		return p
+	}
+	if strings.Contains(value, p) {
+		return value
+	}
+	return p + " " + value
+}
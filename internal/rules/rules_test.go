@@ -0,0 +1,114 @@
+package rules
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/ethanpil/smog/internal/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEngine(t *testing.T, rules []config.Rule) *Engine {
+	t.Helper()
+	e, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), rules)
+	require.NoError(t, err)
+	return e
+}
+
+// applyTo applies the rules of e to the header of raw and returns the
+// rewritten message along with the names of the rules applied.
+func applyTo(t *testing.T, e *Engine, env Envelope, raw string) (string, []string) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(raw))
+	header, err := message.ReadHeader(br)
+	require.NoError(t, err)
+	applied := e.Apply(env, header)
+
+	var out strings.Builder
+	_, err = header.WriteTo(&out)
+	require.NoError(t, err)
+	_, err = io.Copy(&out, br)
+	require.NoError(t, err)
+	return out.String(), applied
+}
+
+func TestEngine_Apply(t *testing.T) {
+	e := newTestEngine(t, []config.Rule{
+		{
+			Name:    "scanner",
+			Subnets: []string{"192.168.1.20"},
+			Remove:  []string{"X-Mailer"},
+			Set:     []string{"Reply-To: helpdesk@example.com"},
+			Prefix:  []string{"Subject: [SCANNER]"},
+			Add:     []string{"X-Device: scanner"},
+		},
+		{
+			Recipients: []string{"@partner.example"},
+			Add:        []string{"X-Tracking: partner"},
+		},
+	})
+
+	raw := "From: scan@device.lan\r\nSubject: Scan\r\nX-Mailer: ScanOS 1.0\r\nReply-To: scan@device.lan\r\n\r\nBody\r\n"
+	env := Envelope{ClientIP: net.ParseIP("192.168.1.20"), From: "scan@device.lan", To: []string{"a@example.com", "b@partner.example"}}
+	out, applied := applyTo(t, e, env, raw)
+	assert.Equal(t, []string{"scanner", "rule 2"}, applied)
+	assert.Equal(t, "From: scan@device.lan\r\n"+
+		"Subject: [SCANNER] Scan\r\n"+
+		"Reply-To: helpdesk@example.com\r\n"+
+		"X-Device: scanner\r\n"+
+		"X-Tracking: partner\r\n"+
+		"\r\nBody\r\n", out)
+
+	// Nothing matches a client on another address without partner recipients.
+	env = Envelope{ClientIP: net.ParseIP("192.168.1.21"), To: []string{"a@example.com"}}
+	out, applied = applyTo(t, e, env, raw)
+	assert.Empty(t, applied)
+	assert.Equal(t, raw, out)
+}
+
+func TestEngine_Matching(t *testing.T) {
+	e := newTestEngine(t, []config.Rule{{
+		Users:   []string{"printer"},
+		Senders: []string{"@example.com"},
+		Set:     []string{"X-Matched: yes"},
+	}})
+
+	testCases := []struct {
+		name string
+		env  Envelope
+		want bool
+	}{
+		{"All conditions match", Envelope{User: "printer", From: "p@example.com"}, true},
+		{"Wrong user", Envelope{User: "alice", From: "p@example.com"}, false},
+		{"Unauthenticated", Envelope{From: "p@example.com"}, false},
+		{"Wrong sender", Envelope{User: "printer", From: "p@example.org"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			header, err := message.ReadHeader(bufio.NewReader(strings.NewReader("Subject: x\r\n\r\n")))
+			require.NoError(t, err)
+			applied := e.Apply(tc.env, header)
+			assert.Equal(t, tc.want, len(applied) == 1)
+			assert.Equal(t, tc.want, header.Has("X-Matched"))
+		})
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	assert.Equal(t, "[SCANNER] Scan", prefix("[SCANNER]", "Scan"))
+	assert.Equal(t, "Re: [SCANNER] Scan", prefix("[SCANNER]", "Re: [SCANNER] Scan"))
+	assert.Equal(t, "[SCANNER]", prefix("[SCANNER]", ""))
+}
+
+func TestEngine_Empty(t *testing.T) {
+	var nilEngine *Engine
+	assert.True(t, nilEngine.Empty())
+	assert.True(t, newTestEngine(t, nil).Empty())
+	assert.False(t, newTestEngine(t, []config.Rule{{Add: []string{"X-Test: yes"}}}).Empty())
+}
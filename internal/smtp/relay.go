@@ -1,37 +1,76 @@
 package smtp
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/mail"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/ethanpil/smog/internal/config"
 	"github.com/ethanpil/smog/internal/gmail"
+	"github.com/ethanpil/smog/internal/message"
 	"github.com/ethanpil/smog/internal/netutil"
-	"golang.org/x/oauth2"
+	"github.com/ethanpil/smog/internal/policy"
+	"github.com/ethanpil/smog/internal/rules"
+	"github.com/ethanpil/smog/internal/spool"
+	"github.com/ethanpil/smog/internal/users"
 )
 
+// errTLSRequired is returned for commands refused on a plaintext connection
+// when RequireTLS is set.
+var errTLSRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Must issue a STARTTLS command first",
+}
+
+// errAuthRequired is returned for MAIL on a listener that requires AUTH when
+// the client has not authenticated.
+var errAuthRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Authentication required",
+}
+
 // The Backend implements SMTP server methods.
 type Backend struct {
 	Cfg         *config.Config
 	Log         *slog.Logger
 	GmailClient gmail.Service
-	Token       *oauth2.Token
+	// Spool, if set, receives accepted messages for background delivery.
+	Spool *spool.Spool
+	// Users, if set, holds the SMTP accounts in addition to SMTPUser.
+	Users *users.Store
+	// Rules, if set, rewrites message headers before they are sent.
+	Rules *rules.Engine
 }
 
-func (be *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return be.newSession(c.Conn())
+// ForListener returns the smtp.Backend for connections accepted on the given
+// listener, so that its policy is applied to them.
+func (be *Backend) ForListener(l config.Listener) smtp.Backend {
+	return smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return be.newSession(c.Conn(), c.Hostname(), l)
+	})
 }
 
-// newSession is the internal, testable implementation of NewSession.
-func (be *Backend) newSession(conn net.Conn) (smtp.Session, error) {
+// newSession is the internal, testable implementation of ForListener. helo is
+// the name the client gave in HELO or EHLO.
+func (be *Backend) newSession(conn net.Conn, helo string, l config.Listener) (smtp.Session, error) {
 	remoteAddr := conn.RemoteAddr()
 	ipStr, _, err := net.SplitHostPort(remoteAddr.String())
 	if err != nil {
@@ -44,22 +83,39 @@ func (be *Backend) newSession(conn net.Conn) (smtp.Session, error) {
 		return nil, fmt.Errorf("internal server error: could not parse ip")
 	}
 
-	if !netutil.IsAllowed(be.Log, ip, be.Cfg.AllowedSubnets) {
-		be.Log.Warn("rejecting connection from disallowed IP", "remoteIP", ip.String())
+	if !netutil.IsAllowed(be.Log, ip, l.AllowedSubnets) {
+		be.Log.Warn("rejecting connection from disallowed IP", "remoteIP", ip.String(), "listener", l.Addr())
 		return nil, &smtp.SMTPError{
 			Code:    554,
 			Message: "access denied",
 		}
 	}
 
-	be.Log.Debug("accepted connection", "remoteIP", ip.String())
+	// After STARTTLS go-smtp starts a new session on the upgraded connection.
+	_, isTLS := conn.(*tls.Conn)
+
+	// Clients in a trusted subnet may relay without authenticating.
+	trusted := netutil.IsTrusted(be.Log, ip, l.TrustedSubnets)
+	requireAuth := l.RequireAuth && !trusted
+
+	be.Log.Info("accepted connection", "remoteIP", ip.String(), "listener", l.Addr(), "tls", isTLS,
+		"trusted", trusted, "require_auth", requireAuth)
 
 	return &Session{
 		log:         be.Log,
 		cfg:         be.Cfg,
 		gmailClient: be.GmailClient,
-		token:       be.Token,
+		spool:       be.Spool,
+		users:       be.Users,
+		rules:       be.Rules,
 		clientIP:    ip.String(),
+		helo:        helo,
+		hostname:    localHostname(),
+		received:    l.ReceivedHeader,
+		tls:         isTLS,
+		requireTLS:  be.Cfg.RequireTLS && l.TLSMode == config.TLSModeStartTLS,
+		requireAuth: requireAuth,
+		mechanisms:  l.AuthMechanisms,
 	}, nil
 }
 
@@ -68,48 +124,234 @@ type Session struct {
 	log          *slog.Logger
 	cfg          *config.Config
 	gmailClient  gmail.Service
-	token        *oauth2.Token
+	spool        *spool.Spool
 	clientIP     string
+	helo         string // The name given in HELO or EHLO
+	hostname     string // The name of this host, used in Received headers
+	received     string // The ReceivedHeader mode of the listener
+	tls          bool   // Whether the connection is encrypted
+	requireTLS   bool   // Whether AUTH and MAIL must wait for STARTTLS
+	requireAuth  bool   // Whether MAIL must wait for a successful AUTH
+	mechanisms   []string
+	users        *users.Store
+	rules        *rules.Engine
+	authUser     string
+	user         *users.User // The account from the users file, if AUTH used one
 	from         string
 	to           []string
 	dataFilePath string // Path to the temporary file holding the message data
 	dataSize     int64  // Size of the message data
 }
 
-// AuthMechanisms returns a slice of available auth mechanisms to satisfy the
-// go-smtp server for AUTH support.
+// AuthMechanisms returns the auth mechanisms enabled on the session's
+// listener to satisfy the go-smtp server for AUTH support.
 func (s *Session) AuthMechanisms() []string {
-	return []string{sasl.Plain}
+	if len(s.mechanisms) == 0 {
+		return config.DefaultAuthMechanisms
+	}
+	return s.mechanisms
 }
 
 // Auth is called to authenticate a user.
 func (s *Session) Auth(mech string) (sasl.Server, error) {
 	s.log.Info("AUTH attempt", "mechanism", mech)
-	if mech != sasl.Plain {
+	if s.requireTLS && !s.tls {
+		s.log.Warn("rejecting AUTH before STARTTLS", "client_ip", s.clientIP)
+		return nil, errTLSRequired
+	}
+	if !slices.Contains(s.AuthMechanisms(), mech) {
 		s.log.Warn("unsupported auth mechanism", "mechanism", mech)
 		return nil, errors.New("unsupported authentication mechanism")
 	}
 
-	return sasl.NewPlainServer(func(identity, username, password string) error {
-		if username != s.cfg.SMTPUser || password != s.cfg.SMTPPassword {
+	switch mech {
+	case config.AuthLogin:
+		return newLoginServer(s.authenticate), nil
+	case config.AuthCRAMMD5:
+		return newCRAMMD5Server(s.cramMD5Secret, func(username string) {
+			s.authSucceeded(username, nil)
+		}), nil
+	default:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return s.authenticate(username, password)
+		}), nil
+	}
+}
+
+// authenticate checks the credentials against the account configured by
+// SMTPUser and SMTPPassword, then against the users file. It is shared by
+// the PLAIN and LOGIN mechanisms.
+func (s *Session) authenticate(username, password string) error {
+	if s.legacyAccountEnabled() && username == s.cfg.SMTPUser {
+		if subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.SMTPPassword)) != 1 {
 			s.log.Warn("authentication failed: invalid credentials", "username", username)
-			return errors.New("invalid username or password")
+			return errInvalidCredentials
 		}
-
-		s.log.Info("AUTH successful", "username", username)
+		s.authSucceeded(username, nil)
 		return nil
-	}), nil
+	}
+
+	if s.users == nil {
+		s.log.Warn("authentication failed: invalid credentials", "username", username)
+		return errInvalidCredentials
+	}
+	user, err := s.users.Authenticate(username, password)
+	if err != nil {
+		s.log.Warn("authentication failed: invalid credentials", "username", username)
+		return errInvalidCredentials
+	}
+
+	s.authSucceeded(username, user)
+	return nil
+}
+
+// cramMD5Secret returns the plaintext password CRAM-MD5 needs to verify a
+// response. Only the SMTPUser account has one; the users file stores hashes.
+func (s *Session) cramMD5Secret(username string) (string, bool) {
+	if s.legacyAccountEnabled() && username == s.cfg.SMTPUser {
+		return s.cfg.SMTPPassword, true
+	}
+	s.log.Warn("authentication failed: CRAM-MD5 is only available for SMTPUser", "username", username)
+	return "", false
+}
+
+// legacyAccountEnabled reports whether the SMTPUser account can log in.
+func (s *Session) legacyAccountEnabled() bool {
+	return s.cfg.SMTPUser != "" && s.cfg.SMTPPassword != ""
+}
+
+// authSucceeded records the authenticated user. user is nil for the SMTPUser
+// account.
+func (s *Session) authSucceeded(username string, user *users.User) {
+	s.log.Info("AUTH successful", "username", username)
+	s.authUser = username
+	s.user = user
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	s.log.Info("MAIL FROM", "from", from)
+	if s.requireTLS && !s.tls {
+		s.log.Warn("rejecting MAIL before STARTTLS", "client_ip", s.clientIP)
+		return errTLSRequired
+	}
+	if s.requireAuth && s.authUser == "" {
+		s.log.Warn("rejecting MAIL before AUTH", "client_ip", s.clientIP)
+		return errAuthRequired
+	}
+	if err := s.checkSender(from); err != nil {
+		s.log.Warn("rejecting envelope sender", "from", from, "username", s.authUser, "client_ip", s.clientIP, "reason", err.Error())
+		return senderRefused(err)
+	}
 	s.Reset()
 	s.from = from
 	return nil
 }
 
+// checkSender checks that the client may use addr as sender, both under the
+// AllowedSenders of its account in the users file and under the SenderRules.
+func (s *Session) checkSender(addr string) error {
+	if s.user != nil && !s.user.MaySend(addr) {
+		return &policy.SenderError{Address: addr, Client: fmt.Sprintf("user %q", s.authUser)}
+	}
+	return policy.CheckSender(s.log, s.cfg.SenderRules, s.authUser, net.ParseIP(s.clientIP), addr)
+}
+
+// checkFromHeader checks the addresses in the From header of the message in
+// r against checkSender. It is skipped when no restriction applies to the
+// client, so that messages with an unusual From header still go through.
+func (s *Session) checkFromHeader(r io.Reader) error {
+	if (s.user == nil || len(s.user.AllowedSenders) == 0) && len(s.cfg.SenderRules) == 0 {
+		return nil
+	}
+
+	header, err := message.ReadHeader(bufio.NewReader(r))
+	if err != nil {
+		return fmt.Errorf("could not read message header: %w", err)
+	}
+	from := header.Values("From")
+	if len(from) == 0 {
+		// Gmail sets the From header itself.
+		return nil
+	}
+	addrs, err := mail.ParseAddressList(strings.Join(from, ", "))
+	if err != nil {
+		return fmt.Errorf("could not parse From header: %w", err)
+	}
+	for _, addr := range addrs {
+		if err := s.checkSender(addr.Address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// senderRefused returns the 550 reply for a sender refused by checkSender.
+func senderRefused(err error) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender address not allowed: " + err.Error(),
+	}
+}
+
+// checkHeaderRecipients checks the addresses in the To, Cc and Bcc headers of
+// the message in r against RecipientAllow and RecipientDeny. Gmail delivers
+// to the header recipients, so checking the envelope alone is not enough.
+func (s *Session) checkHeaderRecipients(r io.Reader) error {
+	if len(s.cfg.RecipientAllow) == 0 && len(s.cfg.RecipientDeny) == 0 {
+		return nil
+	}
+
+	header, err := message.ReadHeader(bufio.NewReader(r))
+	if err != nil {
+		return fmt.Errorf("could not read message header: %w", err)
+	}
+	for _, name := range []string{"To", "Cc", "Bcc"} {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		addrs, err := mail.ParseAddressList(strings.Join(values, ", "))
+		if err != nil {
+			return fmt.Errorf("could not parse %s header: %w", name, err)
+		}
+		for _, addr := range addrs {
+			if _, err := policy.CheckRecipient(s.cfg.RecipientAllow, s.cfg.RecipientDeny, addr.Address); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recipientRefused returns the 550 reply for a recipient refused by
+// policy.CheckRecipient.
+func recipientRefused(err error) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Recipient address not allowed: " + err.Error(),
+	}
+}
+
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	s.log.Info("RCPT TO", "to", to)
+	matched, err := policy.CheckRecipient(s.cfg.RecipientAllow, s.cfg.RecipientDeny, to)
+	if err != nil {
+		s.log.Warn("rejecting recipient", "to", to, "username", s.authUser, "client_ip", s.clientIP, "reason", err.Error())
+		return recipientRefused(err)
+	}
+	if matched != "" {
+		s.log.Info("recipient allowed by RecipientAllow", "to", to, "pattern", matched)
+	}
+	if s.user != nil && s.user.MaxRecipients > 0 && len(s.to) >= s.user.MaxRecipients {
+		s.log.Warn("rejecting recipient over user limit", "to", to, "username", s.authUser, "limit", s.user.MaxRecipients)
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+			Message:      "Too many recipients",
+		}
+	}
 	s.to = append(s.to, to)
 	return nil
 }
@@ -126,18 +368,11 @@ func (s *Session) Data(r io.Reader) error {
 	s.dataFilePath = tmpFile.Name()
 	// No need to defer removal here because Reset() will handle it.
 
-	var reader io.Reader = r
-	var rawLimit int64
-
-	if s.cfg.MessageSizeLimitMB > 0 {
-		limitBytes := int64(s.cfg.MessageSizeLimitMB) * 1024 * 1024
-		// The message size limit is for the base64 encoded message.
-		// We calculate the approximate raw size limit. The base64-encoded size is
-		// roughly 4/3 of the original size.
-		rawLimit = (limitBytes * 3) / 4
-		// We read up to rawLimit + 1 to detect if the message is too large.
-		reader = io.LimitReader(r, rawLimit+1)
-	}
+	// Large messages are uploaded to Gmail without base64 encoding, so the
+	// limit applies to the raw size. We read up to limit + 1 bytes to detect
+	// if the message is too large.
+	limit := gmail.MessageSizeLimit(s.cfg.MessageSizeLimitMB)
+	reader := io.LimitReader(r, limit+1)
 
 	// Copy the data from the reader to the temporary file.
 	s.dataSize, err = io.Copy(tmpFile, reader)
@@ -147,19 +382,18 @@ func (s *Session) Data(r io.Reader) error {
 		return &smtp.SMTPError{Code: 451, Message: "Error reading message data"}
 	}
 
-	// Check if the message size exceeds the raw limit.
-	if rawLimit > 0 && s.dataSize > rawLimit {
+	// Check if the message size exceeds the limit.
+	if s.dataSize > limit {
 		tmpFile.Close()
 		s.log.Warn("message rejected: size exceeds limit",
-			"raw_size_bytes", s.dataSize,
-			"approx_encoded_size_mb", float64(s.dataSize*4/3)/(1024*1024),
-			"limit_mb", s.cfg.MessageSizeLimitMB)
+			"size_bytes", s.dataSize,
+			"limit_bytes", limit)
 		return &smtp.SMTPError{
-			Code: 552,
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
 			Message: fmt.Sprintf(
-				"Message raw size %.2f MB is too large. The limit of %d MB applies to the base64-encoded message.",
-				float64(s.dataSize)/(1024*1024),
-				s.cfg.MessageSizeLimitMB,
+				"Message is too large. The limit is %.2f MB.",
+				float64(limit)/(1024*1024),
 			),
 		}
 	}
@@ -170,6 +404,13 @@ func (s *Session) Data(r io.Reader) error {
 		return &smtp.SMTPError{Code: 451, Message: "Temporary server error"}
 	}
 
+	if s.cfg.RepairMessages {
+		if err := s.repairData(); err != nil {
+			// A message that cannot be repaired may still be deliverable.
+			s.log.Warn("could not repair message, relaying it unchanged", "err", err)
+		}
+	}
+
 	// Now, open the same temporary file for reading.
 	readFile, err := os.Open(s.dataFilePath)
 	if err != nil {
@@ -178,30 +419,256 @@ func (s *Session) Data(r io.Reader) error {
 	}
 	defer readFile.Close()
 
-	s.log.Info("message data received, preparing to send via gmail", "from", s.from, "to", s.to, "size_bytes", s.dataSize)
+	if err := s.checkFromHeader(readFile); err != nil {
+		s.log.Warn("rejecting message From header", "from", s.from, "username", s.authUser, "client_ip", s.clientIP, "reason", err.Error())
+		return senderRefused(err)
+	}
+	if _, err := readFile.Seek(0, io.SeekStart); err != nil {
+		s.log.Error("failed to rewind temporary file", "err", err)
+		return &smtp.SMTPError{Code: 451, Message: "Temporary server error"}
+	}
+	if err := s.checkHeaderRecipients(readFile); err != nil {
+		s.log.Warn("rejecting message recipient headers", "from", s.from, "username", s.authUser, "client_ip", s.clientIP, "reason", err.Error())
+		return recipientRefused(err)
+	}
 
-	ctx := context.Background()
-	sentMsg, err := s.gmailClient.Send(ctx, s.token, s.to, readFile)
+	queueID, err := newQueueID()
 	if err != nil {
-		s.log.Error("failed to send email via gmail", "err", err)
-		if strings.Contains(err.Error(), "quota") {
-			return &smtp.SMTPError{Code: 452, Message: "Service temporarily unavailable due to quota limits"}
+		s.log.Error("failed to generate queue id", "err", err)
+		return &smtp.SMTPError{Code: 451, Message: "Temporary server error"}
+	}
+
+	src, err := s.messageSource(readFile, queueID)
+	if err != nil {
+		s.log.Error("failed to prepare message header", "queue_id", queueID, "err", err)
+		return &smtp.SMTPError{Code: 451, Message: "Temporary server error"}
+	}
+
+	if s.spool != nil {
+		// The queue ID names the spool entry too, so the Received header, the
+		// log lines and the files in the spool all carry the same ID.
+		msg := &spool.Message{
+			ID:       queueID,
+			From:     s.from,
+			To:       append([]string(nil), s.to...),
+			ClientIP: s.clientIP,
 		}
-		if strings.Contains(err.Error(), "authentication") {
-			return &smtp.SMTPError{Code: 535, Message: "Authentication required - please run 'smog auth login'"}
+		body, err := src()
+		if err != nil {
+			s.log.Error("failed to read message data", "err", err)
+			return &smtp.SMTPError{Code: 451, Message: "Temporary server error"}
+		}
+		if err := s.spool.Enqueue(msg, body); err != nil {
+			s.log.Error("failed to queue message", "err", err)
+			return &smtp.SMTPError{Code: 451, Message: "Temporary server error"}
+		}
+		s.log.Info("message queued for delivery", "id", msg.ID, "from", s.from, "to", s.to, "size_bytes", s.dataSize)
+		return nil
+	}
+
+	s.log.Info("message data received, preparing to send via gmail", "queue_id", queueID, "from", s.from, "to", s.to, "size_bytes", s.dataSize)
+
+	// The client waits for the reply while the message is sent, so the send
+	// and its retries must end in time for it.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.SendTimeout)*time.Second)
+	defer cancel()
+	sentMsg, err := s.gmailClient.Send(ctx, s.to, src)
+	if err != nil {
+		s.log.Error("failed to send email via gmail", "err", err)
+		var partial *gmail.PartialError
+		if errors.As(err, &partial) {
+			// The client will retry the whole message; recipients that already
+			// received it will get a duplicate, which is better than losing it.
+			s.log.Warn("message delivered to some recipients only", "delivered", partial.Delivered)
 		}
-		return &smtp.SMTPError{Code: 451, Message: "Temporary failure relaying message"}
+		return sendFailed(err)
 	}
 
 	s.log.Info("message relayed successfully",
 		"client_ip", s.clientIP,
 		"from", s.from,
 		"to", s.to,
+		"queue_id", queueID,
 		"message_id", sentMsg.Id,
 	)
 	return nil
 }
 
+// sendFailed returns the reply for a message the Gmail service failed to
+// send, based on the kind of the *gmail.Error. Failures that may go away
+// get a 4xx reply so that the client retries later.
+func sendFailed(err error) *smtp.SMTPError {
+	var gerr *gmail.Error
+	if !errors.As(err, &gerr) {
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Temporary failure relaying message"}
+	}
+	switch gerr.Kind {
+	case gmail.ErrAuthExpired:
+		// The administrator has to authorize smog again; until then the
+		// client should keep the message and retry.
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Relay is not authorized with Gmail - please run 'smog auth login'"}
+	case gmail.ErrRateLimited:
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 5}, Message: "Gmail rate limit reached, try again later"}
+	case gmail.ErrQuotaExhausted:
+		return &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 3, 1}, Message: "Service temporarily unavailable due to quota limits"}
+	case gmail.ErrInvalidRecipient:
+		return &smtp.SMTPError{Code: 553, EnhancedCode: smtp.EnhancedCode{5, 1, 3}, Message: "Recipient address rejected by Gmail"}
+	case gmail.ErrMessageTooLarge:
+		return &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 3, 4}, Message: "Message too large for Gmail"}
+	case gmail.ErrRejected:
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "Message rejected by Gmail"}
+	default:
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 2}, Message: "Temporary failure relaying message"}
+	}
+}
+
+// receivedValue returns the value of the Received trace field (RFC 5321
+// section 4.4) for a message with the given queue ID, or "" if the listener
+// adds none. The anonymous form leaves out everything about the client.
+func (s *Session) receivedValue(queueID string, now time.Time) string {
+	protocol := "ESMTP"
+	if s.tls {
+		protocol += "S"
+	}
+	if s.authUser != "" {
+		protocol += "A" // RFC 3848
+	}
+
+	var b strings.Builder
+	switch s.received {
+	case config.ReceivedHeaderFull:
+		from := "[" + s.clientIP + "]"
+		if helo := sanitizeTrace(s.helo); helo != "" {
+			from = helo + " (" + from + ")"
+		}
+		fmt.Fprintf(&b, "from %s", from)
+		if s.authUser != "" {
+			fmt.Fprintf(&b, " (authenticated as %s)", sanitizeTrace(s.authUser))
+		}
+		b.WriteString(" ")
+	case config.ReceivedHeaderAnonymous:
+	default:
+		return ""
+	}
+	fmt.Fprintf(&b, "by %s (smog) with %s id %s", s.hostname, protocol, queueID)
+	if s.received == config.ReceivedHeaderFull && len(s.to) == 1 {
+		// Naming more recipients would disclose Bcc recipients.
+		fmt.Fprintf(&b, " for <%s>", s.to[0])
+	}
+	fmt.Fprintf(&b, "; %s", now.Format(time.RFC1123Z))
+	return b.String()
+}
+
+// sanitizeTrace removes the characters that could break out of a Received
+// field comment from client-supplied text such as the HELO name.
+func sanitizeTrace(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || strings.ContainsRune("()<>;\\\"", r) {
+			return -1
+		}
+		return r
+	}, name)
+}
+
+// messageSource returns the message to relay: the data file f with the
+// Received field prepended and the header rules applied. The new header is
+// held in memory, and the body is read from f whenever the message is read.
+// An error is returned only if the header rules cannot be applied.
+func (s *Session) messageSource(f *os.File, queueID string) (gmail.Source, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat message data: %w", err)
+	}
+	size := info.Size()
+	received := s.receivedValue(queueID, time.Now())
+	hasRules := !s.rules.Empty()
+	if received == "" && !hasRules {
+		return gmail.ReaderAtSource(f, size), nil
+	}
+
+	sr := io.NewSectionReader(f, 0, size)
+	br := bufio.NewReader(sr)
+	header, err := message.ReadHeader(br)
+	if err != nil {
+		if hasRules {
+			return nil, fmt.Errorf("failed to parse message header: %w", err)
+		}
+		// The trace header is for troubleshooting only; relay the message without it.
+		s.log.Warn("could not add Received header", "queue_id", queueID, "err", err)
+		return gmail.ReaderAtSource(f, size), nil
+	}
+	read, _ := sr.Seek(0, io.SeekCurrent)
+	bodyStart := read - int64(br.Buffered())
+
+	if received != "" {
+		header.Prepend("Received", received)
+	}
+	if hasRules {
+		env := rules.Envelope{ClientIP: net.ParseIP(s.clientIP), User: s.authUser, From: s.from, To: s.to}
+		if applied := s.rules.Apply(env, header); len(applied) > 0 {
+			s.log.Info("applied header rules", "rules", applied, "client_ip", s.clientIP, "from", s.from)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := header.WriteTo(&buf); err != nil {
+		return nil, fmt.Errorf("failed to write message header: %w", err)
+	}
+	head := buf.Bytes()
+	return func() (io.Reader, error) {
+		return io.MultiReader(bytes.NewReader(head), io.NewSectionReader(f, bodyStart, size-bodyStart)), nil
+	}, nil
+}
+
+// newQueueID returns a unique ID for an accepted message, recorded in its
+// Received header and in the logs.
+func newQueueID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate queue id: %w", err)
+	}
+	return strings.ToUpper(hex.EncodeToString(b)), nil
+}
+
+// localHostname returns the name of this host for Received headers.
+func localHostname() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "localhost"
+	}
+	return name
+}
+
+// repairData rewrites the temporary data file with message.Repair, fixing
+// the problems legacy devices are known for, and logs the repairs applied.
+func (s *Session) repairData() error {
+	in, err := os.Open(s.dataFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open message data: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp("", "smog-data-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	repairs, err := message.Repair(out, in, message.RepairOptions{LegacyCharset: s.cfg.LegacyCharset})
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || len(repairs) == 0 {
+		os.Remove(out.Name())
+		return err
+	}
+
+	if err := os.Remove(s.dataFilePath); err != nil {
+		s.log.Warn("failed to remove temporary data file", "path", s.dataFilePath, "err", err)
+	}
+	s.dataFilePath = out.Name()
+	s.log.Info("repaired message", "from", s.from, "client_ip", s.clientIP, "repairs", repairs)
+	return nil
+}
+
 func (s *Session) Reset() {
 	if s.dataFilePath != "" {
 		if err := os.Remove(s.dataFilePath); err != nil {
@@ -2,17 +2,23 @@ package smtp
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/ethanpil/smog/internal/config"
 	"github.com/ethanpil/smog/internal/gmail"
-	"golang.org/x/oauth2"
+	"github.com/ethanpil/smog/internal/rules"
+	"github.com/ethanpil/smog/internal/spool"
+	"github.com/ethanpil/smog/internal/users"
 	gapi "google.golang.org/api/gmail/v1"
 )
 
@@ -20,7 +26,7 @@ func TestSession_MailRcptData(t *testing.T) {
 	// 1. Setup
 	dataContent := "This is the email body."
 	mockGmail := &gmail.MockService{
-		SendFunc: func(ctx context.Context, token *oauth2.Token, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
 			if len(recipients) != 2 {
 				t.Errorf("expected 2 recipients, got %d", len(recipients))
 			}
@@ -49,7 +55,6 @@ func TestSession_MailRcptData(t *testing.T) {
 		log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
 		cfg:         &config.Config{},
 		gmailClient: mockGmail,
-		token:       &oauth2.Token{}, // Dummy token
 	}
 	defer session.Reset()
 
@@ -115,7 +120,7 @@ func TestSession_MailRcptData(t *testing.T) {
 func TestSession_Data_SizeLimit(t *testing.T) {
 	// Use a mock that does nothing, as we don't expect it to be called.
 	mockGmail := &gmail.MockService{
-		SendFunc: func(ctx context.Context, token *oauth2.Token, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
 			t.Error("gmail.Send should not be called for oversized messages")
 			return nil, nil
 		},
@@ -125,11 +130,9 @@ func TestSession_Data_SizeLimit(t *testing.T) {
 		log: slog.New(slog.NewTextHandler(io.Discard, nil)),
 		cfg: &config.Config{
 			// Set a small limit, e.g., 1MB.
-			// The raw limit will be ~0.75MB.
 			MessageSizeLimitMB: 1,
 		},
 		gmailClient: mockGmail,
-		token:       &oauth2.Token{},
 	}
 	defer session.Reset()
 
@@ -152,6 +155,9 @@ func TestSession_Data_SizeLimit(t *testing.T) {
 		if smtpErr.Code != 552 {
 			t.Errorf("Expected SMTP error code 552, but got %d", smtpErr.Code)
 		}
+		if smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) {
+			t.Errorf("Expected enhanced code 5.3.4, but got %v", smtpErr.EnhancedCode)
+		}
 
 		if !strings.Contains(smtpErr.Message, "is too large") {
 			t.Errorf("Expected error message to contain 'is too large', but got '%s'", smtpErr.Message)
@@ -161,7 +167,7 @@ func TestSession_Data_SizeLimit(t *testing.T) {
 	// Test case 2: Message is within the limit
 	t.Run("MessageWithinLimit", func(t *testing.T) {
 		// This time, the mock should succeed.
-		mockGmail.SendFunc = func(ctx context.Context, token *oauth2.Token, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+		mockGmail.SendFunc = func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
 			return &gapi.Message{Id: "success-id"}, nil
 		}
 		session.gmailClient = mockGmail
@@ -175,6 +181,238 @@ func TestSession_Data_SizeLimit(t *testing.T) {
 			t.Fatalf("Expected no error for message within limit, but got: %v", err)
 		}
 	})
+
+	// Test case 3: The limit applies to the raw size, not the base64-encoded size
+	t.Run("RawSizeWithinLimit", func(t *testing.T) {
+		data := make([]byte, 900*1024) // Over 1MB once base64-encoded
+		if err := session.Data(strings.NewReader(string(data))); err != nil {
+			t.Fatalf("Expected no error for message within limit, but got: %v", err)
+		}
+	})
+}
+
+func TestSession_RequireTLS(t *testing.T) {
+	newSession := func(isTLS bool) *Session {
+		return &Session{
+			log:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+			cfg:        &config.Config{SMTPUser: "user", SMTPPassword: "pass"},
+			tls:        isTLS,
+			requireTLS: true,
+		}
+	}
+
+	t.Run("PlaintextIsRefused", func(t *testing.T) {
+		session := newSession(false)
+
+		err := session.Mail("sender@example.com", nil)
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok {
+			t.Fatalf("Expected error to be of type *smtp.SMTPError, but got %T", err)
+		}
+		if smtpErr.Code != 530 {
+			t.Errorf("Expected SMTP error code 530, but got %d", smtpErr.Code)
+		}
+		if session.from != "" {
+			t.Errorf("Expected from to stay empty, got '%s'", session.from)
+		}
+
+		if _, err := session.Auth(sasl.Plain); err == nil {
+			t.Error("Expected AUTH to be refused before STARTTLS")
+		}
+	})
+
+	t.Run("TLSIsAccepted", func(t *testing.T) {
+		session := newSession(true)
+		defer session.Reset()
+
+		if err := session.Mail("sender@example.com", nil); err != nil {
+			t.Fatalf("Mail() returned an error: %v", err)
+		}
+		if _, err := session.Auth(sasl.Plain); err != nil {
+			t.Fatalf("Auth() returned an error: %v", err)
+		}
+	})
+}
+
+func TestSession_RequireAuth(t *testing.T) {
+	session := &Session{
+		log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg:         &config.Config{SMTPUser: "user", SMTPPassword: "pass"},
+		requireAuth: true,
+	}
+	defer session.Reset()
+
+	err := session.Mail("sender@example.com", nil)
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatalf("Expected error to be of type *smtp.SMTPError, but got %T", err)
+	}
+	if smtpErr.Code != 530 {
+		t.Errorf("Expected SMTP error code 530, but got %d", smtpErr.Code)
+	}
+
+	server, err := session.Auth(sasl.Plain)
+	if err != nil {
+		t.Fatalf("Auth() returned an error: %v", err)
+	}
+	if _, _, err := server.Next([]byte("\x00user\x00pass")); err != nil {
+		t.Fatalf("AUTH PLAIN exchange failed: %v", err)
+	}
+
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() after AUTH returned an error: %v", err)
+	}
+
+	// RSET starts a new transaction but keeps the authentication.
+	session.Reset()
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() after Reset() returned an error: %v", err)
+	}
+}
+
+func TestBackend_newSession_ListenerPolicy(t *testing.T) {
+	backend := &Backend{
+		Cfg: &config.Config{RequireTLS: true},
+		Log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	conn := &mockNetConn{remoteAddr: &mockAddr{network: "tcp", address: "127.0.0.1:12345"}}
+
+	session, err := backend.newSession(conn, "client.example.com", config.Listener{Port: 25, TLSMode: config.TLSModeNone})
+	if err != nil {
+		t.Fatalf("Did not expect an error, but got: %v", err)
+	}
+	if s := session.(*Session); s.requireTLS || s.requireAuth {
+		t.Errorf("Expected a plaintext listener to require neither TLS nor AUTH, got requireTLS=%v requireAuth=%v", s.requireTLS, s.requireAuth)
+	}
+
+	session, err = backend.newSession(conn, "client.example.com", config.Listener{Port: 587, TLSMode: config.TLSModeStartTLS, RequireAuth: true})
+	if err != nil {
+		t.Fatalf("Did not expect an error, but got: %v", err)
+	}
+	if s := session.(*Session); !s.requireTLS || !s.requireAuth {
+		t.Errorf("Expected a STARTTLS listener to require TLS and AUTH, got requireTLS=%v requireAuth=%v", s.requireTLS, s.requireAuth)
+	}
+
+	_, err = backend.newSession(conn, "client.example.com", config.Listener{Port: 25, AllowedSubnets: []string{"10.0.0.0/8"}})
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("Expected the listener's AllowedSubnets to deny the connection, got %v", err)
+	}
+}
+
+func TestBackend_newSession_TrustedSubnets(t *testing.T) {
+	backend := &Backend{
+		Cfg: &config.Config{},
+		Log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	listener := config.Listener{Port: 25, RequireAuth: true, TrustedSubnets: []string{"192.168.50.0/24", "10.1.1.1"}}
+
+	testCases := []struct {
+		name        string
+		address     string
+		requireAuth bool
+	}{
+		{"Trusted subnet", "192.168.50.20:12345", false},
+		{"Trusted single IP", "10.1.1.1:12345", false},
+		{"Untrusted IP", "192.168.51.20:12345", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &mockNetConn{remoteAddr: &mockAddr{network: "tcp", address: tc.address}}
+			session, err := backend.newSession(conn, "client.example.com", listener)
+			if err != nil {
+				t.Fatalf("Did not expect an error, but got: %v", err)
+			}
+			s := session.(*Session)
+			if s.requireAuth != tc.requireAuth {
+				t.Errorf("Expected requireAuth=%v, got %v", tc.requireAuth, s.requireAuth)
+			}
+
+			err = s.Mail("printer@example.com", nil)
+			if tc.requireAuth && err == nil {
+				t.Error("Expected MAIL without AUTH to be refused")
+			} else if !tc.requireAuth && err != nil {
+				t.Errorf("Expected MAIL without AUTH to be accepted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSession_UsersFile(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	hash, err := users.HashPassword("printerpass", users.HashBcrypt)
+	if err != nil {
+		t.Fatalf("HashPassword() returned an error: %v", err)
+	}
+	store, err := users.Load(logger, filepath.Join(t.TempDir(), "users.toml"))
+	if err != nil {
+		t.Fatalf("users.Load() returned an error: %v", err)
+	}
+	if err := store.Add(users.User{Name: "printer", PasswordHash: hash, AllowedSenders: []string{"printer@example.com"}, MaxRecipients: 1}); err != nil {
+		t.Fatalf("Add() returned an error: %v", err)
+	}
+
+	newSession := func() *Session {
+		return &Session{
+			log:   logger,
+			cfg:   &config.Config{SMTPUser: "legacy", SMTPPassword: "legacypass"},
+			users: store,
+		}
+	}
+	auth := func(s *Session, username, password string) error {
+		server, err := s.Auth(sasl.Plain)
+		if err != nil {
+			return err
+		}
+		_, _, err = server.Next([]byte("\x00" + username + "\x00" + password))
+		return err
+	}
+
+	t.Run("Credentials", func(t *testing.T) {
+		if err := auth(newSession(), "printer", "printerpass"); err != nil {
+			t.Errorf("Expected the users file account to authenticate, got: %v", err)
+		}
+		if err := auth(newSession(), "legacy", "legacypass"); err != nil {
+			t.Errorf("Expected the SMTPUser account to authenticate, got: %v", err)
+		}
+		if err := auth(newSession(), "printer", "legacypass"); err == nil {
+			t.Error("Expected a wrong password to be rejected")
+		}
+		if err := auth(newSession(), "nobody", "printerpass"); err == nil {
+			t.Error("Expected an unknown user to be rejected")
+		}
+	})
+
+	t.Run("LegacyAccountNeedsPassword", func(t *testing.T) {
+		session := &Session{log: logger, cfg: &config.Config{SMTPUser: "legacy"}}
+		if err := auth(session, "legacy", ""); err == nil {
+			t.Error("Expected the SMTPUser account to be disabled without SMTPPassword")
+		}
+	})
+
+	t.Run("UserRestrictions", func(t *testing.T) {
+		session := newSession()
+		defer session.Reset()
+		if err := auth(session, "printer", "printerpass"); err != nil {
+			t.Fatalf("AUTH failed: %v", err)
+		}
+
+		err := session.Mail("ceo@example.com", nil)
+		if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 {
+			t.Errorf("Expected a 550 error for a disallowed sender, got %v", err)
+		}
+
+		if err := session.Mail("printer@example.com", nil); err != nil {
+			t.Fatalf("Mail() returned an error: %v", err)
+		}
+		if err := session.Rcpt("one@example.com", nil); err != nil {
+			t.Fatalf("Rcpt() returned an error: %v", err)
+		}
+		err = session.Rcpt("two@example.com", nil)
+		if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 452 {
+			t.Errorf("Expected a 452 error over the recipient limit, got %v", err)
+		}
+	})
 }
 
 // mockNetConn is a mock implementation of net.Conn for testing Backend.newSession.
@@ -203,7 +441,9 @@ func (a *mockAddr) String() string {
 
 func TestBackend_newSession(t *testing.T) {
 	logger := slog.Default()
-	cfg := &config.Config{
+	cfg := &config.Config{}
+	listener := config.Listener{
+		Port:           2525,
 		AllowedSubnets: []string{"192.168.1.0/24", "2001:db8::/32"},
 	}
 
@@ -275,7 +515,7 @@ func TestBackend_newSession(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			mockConn := &mockNetConn{remoteAddr: tc.remoteAddr}
-			session, err := backend.newSession(mockConn)
+			session, err := backend.newSession(mockConn, "client.example.com", listener)
 
 			if tc.expectError {
 				if err == nil {
@@ -295,3 +535,480 @@ func TestBackend_newSession(t *testing.T) {
 		})
 	}
 }
+
+func TestSession_SenderRules(t *testing.T) {
+	var sent int
+	mockGmail := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			sent++
+			return &gapi.Message{Id: "test-id"}, nil
+		},
+	}
+	cfg := &config.Config{
+		SenderRules: []config.SenderRule{
+			{Subnets: []string{"192.168.1.0/24"}, Senders: []string{"scanner-*@example.com"}},
+			{Users: []string{"alice"}, Senders: []string{"@example.com"}},
+		},
+	}
+	newSession := func(clientIP, authUser string) *Session {
+		return &Session{
+			log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+			cfg:         cfg,
+			gmailClient: mockGmail,
+			clientIP:    clientIP,
+			authUser:    authUser,
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		clientIP   string
+		authUser   string
+		from       string
+		fromHeader string
+		expectCode int // 0 if the message is accepted
+	}{
+		{"Subnet allowed", "192.168.1.5", "", "scanner-2@example.com", "Scanner <scanner-2@example.com>", 0},
+		{"Subnet wrong envelope sender", "192.168.1.5", "", "ceo@example.com", "", 550},
+		{"Subnet wrong From header", "192.168.1.5", "", "scanner-2@example.com", "CEO <ceo@example.com>", 550},
+		{"User allowed domain", "10.0.0.5", "alice", "alice@example.com", "alice@example.com", 0},
+		{"User other domain", "10.0.0.5", "alice", "alice@example.org", "", 550},
+		{"No rule applies", "10.0.0.5", "bob", "anyone@example.org", "anyone@example.org", 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sent = 0
+			session := newSession(tc.clientIP, tc.authUser)
+			defer session.Reset()
+
+			err := session.Mail(tc.from, nil)
+			if tc.fromHeader == "" {
+				smtpErr, ok := err.(*smtp.SMTPError)
+				if !ok || smtpErr.Code != tc.expectCode {
+					t.Fatalf("Expected a %d error for MAIL FROM, got %v", tc.expectCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mail() returned an error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() returned an error: %v", err)
+			}
+
+			err = session.Data(strings.NewReader("From: " + tc.fromHeader + "\r\nSubject: Test\r\n\r\nBody\r\n"))
+			if tc.expectCode == 0 {
+				if err != nil {
+					t.Fatalf("Data() returned an error: %v", err)
+				}
+				if sent != 1 {
+					t.Errorf("Expected the message to be sent once, got %d", sent)
+				}
+				return
+			}
+			smtpErr, ok := err.(*smtp.SMTPError)
+			if !ok || smtpErr.Code != tc.expectCode {
+				t.Fatalf("Expected a %d error for the From header, got %v", tc.expectCode, err)
+			}
+			if !strings.Contains(smtpErr.Message, "ceo@example.com") {
+				t.Errorf("Expected the reply to name the refused address, got %q", smtpErr.Message)
+			}
+			if sent != 0 {
+				t.Error("Expected the message not to be sent")
+			}
+		})
+	}
+}
+
+func TestSession_RecipientPolicyHeaders(t *testing.T) {
+	testCases := []struct {
+		name    string
+		header  string
+		allowed bool
+	}{
+		{"AllowedHeaders", "To: alice@example.com\r\nCc: Bob <bob@example.com>\r\n", true},
+		{"DeniedCc", "To: alice@example.com\r\nCc: ceo@example.com\r\n", false},
+		{"DeniedBcc", "To: alice@example.com\r\nBcc: someone@gmail.com\r\n", false},
+		{"DeniedTo", "To: alice@example.com, payroll@hr.example.com\r\n", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sent := 0
+			mockGmail := &gmail.MockService{
+				SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+					sent++
+					return &gapi.Message{Id: "test-id"}, nil
+				},
+			}
+			session := &Session{
+				log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+				cfg: &config.Config{
+					RecipientAllow: []string{"@example.com"},
+					RecipientDeny:  []string{"@hr.example.com", "ceo@example.com"},
+				},
+				gmailClient: mockGmail,
+			}
+			defer session.Reset()
+
+			if err := session.Mail("scanner@example.com", nil); err != nil {
+				t.Fatalf("Mail() returned an error: %v", err)
+			}
+			if err := session.Rcpt("alice@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() returned an error: %v", err)
+			}
+			err := session.Data(strings.NewReader(tc.header + "Subject: Test\r\n\r\nBody\r\n"))
+			if tc.allowed {
+				if err != nil {
+					t.Fatalf("Data() returned an error: %v", err)
+				}
+				if sent != 1 {
+					t.Error("Expected the message to be sent")
+				}
+				return
+			}
+			smtpErr, ok := err.(*smtp.SMTPError)
+			if !ok || smtpErr.Code != 550 {
+				t.Fatalf("Expected a 550 error, got %v", err)
+			}
+			if sent != 0 {
+				t.Error("Expected the message not to be sent")
+			}
+		})
+	}
+}
+
+func TestSession_RecipientPolicy(t *testing.T) {
+	var got []string
+	mockGmail := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			got = recipients
+			return &gapi.Message{Id: "test-id"}, nil
+		},
+	}
+	session := &Session{
+		log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg: &config.Config{
+			RecipientAllow: []string{"@example.com"},
+			RecipientDeny:  []string{"@hr.example.com", "ceo@example.com"},
+		},
+		gmailClient: mockGmail,
+	}
+	defer session.Reset()
+
+	if err := session.Mail("scanner@example.com", nil); err != nil {
+		t.Fatalf("Mail() returned an error: %v", err)
+	}
+	for _, tc := range []struct {
+		to      string
+		allowed bool
+	}{
+		{"alice@example.com", true},
+		{"someone@gmail.com", false},
+		{"ceo@example.com", false},
+		{"bob@example.com", true},
+	} {
+		err := session.Rcpt(tc.to, nil)
+		if tc.allowed {
+			if err != nil {
+				t.Errorf("Rcpt(%s) returned an error: %v", tc.to, err)
+			}
+			continue
+		}
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok || smtpErr.Code != 550 {
+			t.Errorf("Expected a 550 error for %s, got %v", tc.to, err)
+		}
+	}
+
+	// The refused recipients do not abort the transaction.
+	if err := session.Data(strings.NewReader("Subject: Test\r\n\r\nBody\r\n")); err != nil {
+		t.Fatalf("Data() returned an error: %v", err)
+	}
+	if len(got) != 2 || got[0] != "alice@example.com" || got[1] != "bob@example.com" {
+		t.Errorf("Expected the message to go to the allowed recipients only, got %v", got)
+	}
+}
+
+func TestSession_Data_Rules(t *testing.T) {
+	var got string
+	mockGmail := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			b, err := io.ReadAll(rawEmail)
+			if err != nil {
+				t.Fatalf("failed to read rawEmail: %v", err)
+			}
+			got = string(b)
+			return &gapi.Message{Id: "test-id"}, nil
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	engine, err := rules.New(logger, []config.Rule{{Users: []string{"scanner"}, Prefix: []string{"Subject: [SCANNER]"}}})
+	if err != nil {
+		t.Fatalf("rules.New() returned an error: %v", err)
+	}
+	session := &Session{
+		log:         logger,
+		cfg:         &config.Config{},
+		gmailClient: mockGmail,
+		rules:       engine,
+		authUser:    "scanner",
+	}
+	defer session.Reset()
+
+	if err := session.Mail("scanner@example.com", nil); err != nil {
+		t.Fatalf("Mail() returned an error: %v", err)
+	}
+	if err := session.Rcpt("to@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() returned an error: %v", err)
+	}
+	if err := session.Data(strings.NewReader("Subject: Scan\r\n\r\nBody\r\n")); err != nil {
+		t.Fatalf("Data() returned an error: %v", err)
+	}
+	if want := "Subject: [SCANNER] Scan\r\n\r\nBody\r\n"; got != want {
+		t.Errorf("Expected the rules to be applied before sending, got %q, want %q", got, want)
+	}
+}
+
+func TestSession_Data_Repair(t *testing.T) {
+	var got string
+	mockGmail := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			b, err := io.ReadAll(rawEmail)
+			if err != nil {
+				t.Fatalf("failed to read rawEmail: %v", err)
+			}
+			got = string(b)
+			return &gapi.Message{Id: "test-id"}, nil
+		},
+	}
+	session := &Session{
+		log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg:         &config.Config{RepairMessages: true, LegacyCharset: "windows-1252"},
+		gmailClient: mockGmail,
+	}
+	defer session.Reset()
+
+	if err := session.Mail("printer@example.com", nil); err != nil {
+		t.Fatalf("Mail() returned an error: %v", err)
+	}
+	if err := session.Rcpt("to@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() returned an error: %v", err)
+	}
+	if err := session.Data(strings.NewReader("Subject: Toner\nTray 2\n")); err != nil {
+		t.Fatalf("Data() returned an error: %v", err)
+	}
+
+	for _, want := range []string{"Subject: Toner\r\n", "\r\nDate: ", "\r\nMessage-ID: <", "\r\nMIME-Version: 1.0\r\n", "\r\n\r\nTray 2\r\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected the relayed message to contain %q, got %q", want, got)
+		}
+	}
+}
+
+func TestSession_receivedValue(t *testing.T) {
+	now := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		session  Session
+		expected string
+	}{
+		{
+			name:     "Full",
+			session:  Session{received: config.ReceivedHeaderFull, helo: "scanner.lan", clientIP: "192.168.1.20", hostname: "relay", to: []string{"to@example.com"}},
+			expected: "from scanner.lan ([192.168.1.20]) by relay (smog) with ESMTP id ABC for <to@example.com>; Tue, 04 Mar 2025 05:06:07 +0000",
+		},
+		{
+			name:     "FullAuthenticatedTLS",
+			session:  Session{received: config.ReceivedHeaderFull, helo: "pc", clientIP: "10.0.0.5", hostname: "relay", tls: true, authUser: "alice", to: []string{"a@example.com", "b@example.com"}},
+			expected: "from pc ([10.0.0.5]) (authenticated as alice) by relay (smog) with ESMTPSA id ABC; Tue, 04 Mar 2025 05:06:07 +0000",
+		},
+		{
+			name:     "HostileHELO",
+			session:  Session{received: config.ReceivedHeaderFull, helo: "x) by evil;\r\nBcc: y", clientIP: "10.0.0.5", hostname: "relay"},
+			expected: "from xbyevilBcc:y ([10.0.0.5]) by relay (smog) with ESMTP id ABC; Tue, 04 Mar 2025 05:06:07 +0000",
+		},
+		{
+			name:     "Anonymous",
+			session:  Session{received: config.ReceivedHeaderAnonymous, helo: "scanner.lan", clientIP: "192.168.1.20", hostname: "relay", authUser: "alice", to: []string{"to@example.com"}},
+			expected: "by relay (smog) with ESMTPA id ABC; Tue, 04 Mar 2025 05:06:07 +0000",
+		},
+		{
+			name:     "Off",
+			session:  Session{received: config.ReceivedHeaderOff, clientIP: "192.168.1.20", hostname: "relay"},
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.session.receivedValue("ABC", now); got != tc.expected {
+				t.Errorf("receivedValue() = %q, want %q", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSession_Data_Received(t *testing.T) {
+	var got string
+	mockGmail := &gmail.MockService{
+		SendFunc: func(ctx context.Context, recipients []string, rawEmail io.Reader) (*gapi.Message, error) {
+			b, err := io.ReadAll(rawEmail)
+			if err != nil {
+				t.Fatalf("failed to read rawEmail: %v", err)
+			}
+			got = string(b)
+			return &gapi.Message{Id: "test-id"}, nil
+		},
+	}
+	session := &Session{
+		log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg:         &config.Config{},
+		gmailClient: mockGmail,
+		clientIP:    "192.168.1.20",
+		helo:        "scanner.lan",
+		hostname:    "relay",
+		received:    config.ReceivedHeaderFull,
+	}
+	defer session.Reset()
+
+	if err := session.Mail("scanner@example.com", nil); err != nil {
+		t.Fatalf("Mail() returned an error: %v", err)
+	}
+	if err := session.Rcpt("to@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() returned an error: %v", err)
+	}
+	if err := session.Data(strings.NewReader("Subject: Scan\r\n\r\nBody\r\n")); err != nil {
+		t.Fatalf("Data() returned an error: %v", err)
+	}
+
+	if !strings.HasPrefix(got, "Received: from scanner.lan ([192.168.1.20]) by relay (smog) with ESMTP id") {
+		t.Errorf("Expected the message to start with a Received header, got %q", got)
+	}
+	if !strings.Contains(got, " for <to@example.com>; ") {
+		t.Errorf("Expected the Received header to name the recipient, got %q", got)
+	}
+	if !strings.HasSuffix(got, "\r\nSubject: Scan\r\n\r\nBody\r\n") {
+		t.Errorf("Expected the original message after the Received header, got %q", got)
+	}
+}
+
+func TestSession_Data_SpoolUsesQueueID(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sp, err := spool.New(logger, t.TempDir())
+	if err != nil {
+		t.Fatalf("spool.New() returned an error: %v", err)
+	}
+	session := &Session{
+		log:      logger,
+		cfg:      &config.Config{},
+		spool:    sp,
+		clientIP: "192.168.1.20",
+		helo:     "scanner.lan",
+		hostname: "relay",
+		received: config.ReceivedHeaderAnonymous,
+	}
+	defer session.Reset()
+
+	if err := session.Mail("scanner@example.com", nil); err != nil {
+		t.Fatalf("Mail() returned an error: %v", err)
+	}
+	if err := session.Rcpt("to@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() returned an error: %v", err)
+	}
+	if err := session.Data(strings.NewReader("Subject: Scan\r\n\r\nBody\r\n")); err != nil {
+		t.Fatalf("Data() returned an error: %v", err)
+	}
+
+	pending, err := sp.Pending()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("expected one queued message, got %d (err: %v)", len(pending), err)
+	}
+	f, err := sp.Open(pending[0])
+	if err != nil {
+		t.Fatalf("failed to open queued message: %v", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read queued message: %v", err)
+	}
+	// The Received header names the message by its spool ID.
+	if want := " with ESMTP id " + pending[0].ID + ";"; !strings.Contains(string(data), want) {
+		t.Errorf("expected the Received header to contain %q, got %q", want, data)
+	}
+}
+
+func TestSendFailed(t *testing.T) {
+	testCases := []struct {
+		name         string
+		err          error
+		code         int
+		enhancedCode smtp.EnhancedCode
+	}{
+		{"Untyped", errors.New("quota of something"), 451, smtp.EnhancedCode{4, 3, 0}},
+		{"AuthExpired", &gmail.Error{Kind: gmail.ErrAuthExpired}, 451, smtp.EnhancedCode{4, 7, 0}},
+		{"RateLimited", &gmail.Error{Kind: gmail.ErrRateLimited}, 451, smtp.EnhancedCode{4, 4, 5}},
+		{"QuotaExhausted", &gmail.Error{Kind: gmail.ErrQuotaExhausted}, 452, smtp.EnhancedCode{4, 3, 1}},
+		{"InvalidRecipient", &gmail.Error{Kind: gmail.ErrInvalidRecipient}, 553, smtp.EnhancedCode{5, 1, 3}},
+		{"TooLarge", &gmail.Error{Kind: gmail.ErrMessageTooLarge}, 552, smtp.EnhancedCode{5, 3, 4}},
+		{"Rejected", &gmail.Error{Kind: gmail.ErrRejected}, 554, smtp.EnhancedCode{5, 6, 0}},
+		{"Transient", &gmail.Error{Kind: gmail.ErrTransient}, 451, smtp.EnhancedCode{4, 4, 2}},
+		{"Partial", &gmail.PartialError{Delivered: []string{"a@example.com"}, Err: &gmail.Error{Kind: gmail.ErrRateLimited}}, 451, smtp.EnhancedCode{4, 4, 5}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			smtpErr := sendFailed(tc.err)
+			if smtpErr.Code != tc.code || smtpErr.EnhancedCode != tc.enhancedCode {
+				t.Errorf("sendFailed() = %d %v, want %d %v", smtpErr.Code, smtpErr.EnhancedCode, tc.code, tc.enhancedCode)
+			}
+		})
+	}
+}
+
+func TestSession_MessageSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	body := strings.Repeat("0123456789abcdef\r\n", 1<<12)
+	if err := os.WriteFile(path, []byte("Subject: Scan\r\n\r\n"+body), 0600); err != nil {
+		t.Fatalf("failed to write message data: %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open message data: %v", err)
+	}
+	defer f.Close()
+
+	session := &Session{
+		log:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		hostname: "relay",
+		received: config.ReceivedHeaderAnonymous,
+	}
+	src, err := session.messageSource(f, "QUEUEID")
+	if err != nil {
+		t.Fatalf("messageSource() returned an error: %v", err)
+	}
+
+	// Every read of the source returns the whole message, read from the data file.
+	var reads []string
+	for range 2 {
+		r, err := src()
+		if err != nil {
+			t.Fatalf("failed to open source: %v", err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("failed to read source: %v", err)
+		}
+		reads = append(reads, string(b))
+	}
+	if reads[0] != reads[1] {
+		t.Errorf("expected every read to return the same message")
+	}
+	if !strings.HasPrefix(reads[0], "Received: by relay (smog) with ESMTP id QUEUEID; ") {
+		t.Errorf("expected the message to start with a Received header, got %q", reads[0][:80])
+	}
+	if !strings.HasSuffix(reads[0], "\r\nSubject: Scan\r\n\r\n"+body) {
+		t.Errorf("expected the original message after the Received header")
+	}
+}
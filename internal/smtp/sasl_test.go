@@ -0,0 +1,147 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"path/filepath"
+	"testing"
+
+	gosmtp "github.com/emersion/go-smtp"
+	"github.com/ethanpil/smog/internal/config"
+	"github.com/ethanpil/smog/internal/users"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loginAuth implements the client side of AUTH LOGIN, which net/smtp lacks.
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.username), nil
+	case "Password:":
+		return []byte(a.password), nil
+	default:
+		return nil, errors.New("unexpected server challenge: " + string(fromServer))
+	}
+}
+
+// startTestServer serves the backend for the listener on a loopback port and
+// returns its address.
+func startTestServer(t *testing.T, be *Backend, l config.Listener) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := gosmtp.NewServer(be.ForListener(l))
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+func TestAuthMechanisms_SMTPConversation(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	hash, err := users.HashPassword("filepass", users.HashBcrypt)
+	require.NoError(t, err)
+	store, err := users.Load(logger, filepath.Join(t.TempDir(), "users.toml"))
+	require.NoError(t, err)
+	require.NoError(t, store.Add(users.User{Name: "fileuser", PasswordHash: hash}))
+
+	be := &Backend{
+		Cfg:   &config.Config{SMTPUser: "legacy", SMTPPassword: "legacypass"},
+		Log:   logger,
+		Users: store,
+	}
+	addr := startTestServer(t, be, config.Listener{
+		Port:           25,
+		AuthMechanisms: []string{config.AuthPlain, config.AuthLogin, config.AuthCRAMMD5},
+	})
+
+	testCases := []struct {
+		name      string
+		auth      smtp.Auth
+		expectErr bool
+	}{
+		{"PLAIN", smtp.PlainAuth("", "legacy", "legacypass", "127.0.0.1"), false},
+		{"PLAIN users file", smtp.PlainAuth("", "fileuser", "filepass", "127.0.0.1"), false},
+		{"PLAIN wrong password", smtp.PlainAuth("", "legacy", "nope", "127.0.0.1"), true},
+		{"LOGIN", &loginAuth{"legacy", "legacypass"}, false},
+		{"LOGIN users file", &loginAuth{"fileuser", "filepass"}, false},
+		{"LOGIN wrong password", &loginAuth{"fileuser", "nope"}, true},
+		{"CRAM-MD5", smtp.CRAMMD5Auth("legacy", "legacypass"), false},
+		{"CRAM-MD5 wrong secret", smtp.CRAMMD5Auth("legacy", "nope"), true},
+		// Hashed passwords cannot be used to verify a CRAM-MD5 response.
+		{"CRAM-MD5 users file", smtp.CRAMMD5Auth("fileuser", "filepass"), true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := smtp.Dial(addr)
+			require.NoError(t, err)
+			defer c.Close()
+			require.NoError(t, c.Hello("localhost"))
+
+			_, mechs := c.Extension("AUTH")
+			assert.Equal(t, "PLAIN LOGIN CRAM-MD5", mechs)
+
+			err = c.Auth(tc.auth)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.NoError(t, c.Mail("sender@example.com"))
+		})
+	}
+}
+
+func TestAuthMechanisms_PerListener(t *testing.T) {
+	be := &Backend{
+		Cfg: &config.Config{SMTPUser: "legacy", SMTPPassword: "legacypass"},
+		Log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	addr := startTestServer(t, be, config.Listener{Port: 25, AuthMechanisms: []string{config.AuthLogin}})
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("localhost"))
+
+	_, mechs := c.Extension("AUTH")
+	assert.Equal(t, "LOGIN", mechs)
+	assert.Error(t, c.Auth(smtp.PlainAuth("", "legacy", "legacypass", "127.0.0.1")), "PLAIN is not enabled on this listener")
+}
+
+func TestLoginServer_InitialResponse(t *testing.T) {
+	var got [2]string
+	server := newLoginServer(func(username, password string) error {
+		got = [2]string{username, password}
+		return nil
+	})
+
+	// AUTH LOGIN <base64 username> skips the username prompt.
+	challenge, done, err := server.Next([]byte("user"))
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, "Password:", string(challenge))
+
+	_, done, err = server.Next([]byte("pass"))
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, [2]string{"user", "pass"}, got)
+}
@@ -0,0 +1,303 @@
+package spool
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sub-directories of the spool directory.
+const (
+	queueDir = "queue" // Messages waiting for delivery.
+	deadDir  = "dead"  // Messages that exhausted their delivery attempts.
+	tmpDir   = "tmp"   // Partially written files, never read back.
+)
+
+const (
+	dataExt = ".eml"
+	metaExt = ".json"
+)
+
+// Message holds the envelope and delivery metadata of a spooled message. The
+// raw message data is stored next to it in a separate file.
+type Message struct {
+	ID          string    `json:"id"`
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	ClientIP    string    `json:"client_ip"`
+	Size        int64     `json:"size"`
+	Attempts    int       `json:"attempts"`
+	CreatedAt   time.Time `json:"created_at"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Spool is a durable on-disk message queue. Every message is stored as a pair
+// of files: the raw data (<id>.eml) and its metadata (<id>.json). The metadata
+// file is always written last, so its presence marks a complete entry.
+type Spool struct {
+	log   *slog.Logger
+	dir   string
+	ready chan struct{}
+}
+
+// New opens the spool rooted at dir, creating its directory layout if needed,
+// and cleans up any entries left incomplete by a previous crash.
+func New(logger *slog.Logger, dir string) (*Spool, error) {
+	for _, sub := range []string{queueDir, deadDir, tmpDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create spool directory: %w", err)
+		}
+	}
+
+	s := &Spool{
+		log:   logger,
+		dir:   dir,
+		ready: make(chan struct{}, 1),
+	}
+	if err := s.recover(); err != nil {
+		return nil, fmt.Errorf("failed to recover spool: %w", err)
+	}
+	return s, nil
+}
+
+// Ready returns a channel that receives a value whenever a new message has been
+// enqueued, so that delivery can start without waiting for the next poll.
+func (s *Spool) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Enqueue persists a new message and its raw data, giving it a new ID unless
+// msg.ID is set. When Enqueue returns without error the message is safely on
+// disk and will survive a restart.
+func (s *Spool) Enqueue(msg *Message, data io.Reader) error {
+	if msg.ID == "" {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		msg.ID = id
+	}
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now().UTC()
+	}
+	if msg.NextAttempt.IsZero() {
+		msg.NextAttempt = msg.CreatedAt
+	}
+
+	size, err := s.writeAtomic(s.path(queueDir, msg.ID, dataExt), func(w io.Writer) error {
+		_, err := io.Copy(w, data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to spool message data: %w", err)
+	}
+	msg.Size = size
+
+	if err := s.Update(msg); err != nil {
+		os.Remove(s.path(queueDir, msg.ID, dataExt))
+		return err
+	}
+
+	s.log.Debug("message spooled", "id", msg.ID, "size_bytes", msg.Size)
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending returns all queued messages, ordered by their next delivery attempt.
+func (s *Spool) Pending() ([]*Message, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, queueDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	var msgs []*Message
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != metaExt {
+			continue
+		}
+		msg, err := s.readMeta(filepath.Join(s.dir, queueDir, e.Name()))
+		if err != nil {
+			s.log.Warn("skipping unreadable spool entry", "file", e.Name(), "err", err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].NextAttempt.Before(msgs[j].NextAttempt)
+	})
+	return msgs, nil
+}
+
+// Open opens the raw data of a queued message for reading.
+func (s *Spool) Open(msg *Message) (*os.File, error) {
+	return os.Open(s.path(queueDir, msg.ID, dataExt))
+}
+
+// Update atomically rewrites the metadata of a queued message.
+func (s *Spool) Update(msg *Message) error {
+	_, err := s.writeAtomic(s.path(queueDir, msg.ID, metaExt), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(msg)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write spool metadata: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes a delivered message from the queue.
+func (s *Spool) Remove(msg *Message) error {
+	// The metadata goes first so a crash never leaves a queued entry without data.
+	if err := os.Remove(s.path(queueDir, msg.ID, metaExt)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove spool metadata: %w", err)
+	}
+	if err := os.Remove(s.path(queueDir, msg.ID, dataExt)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove spool data: %w", err)
+	}
+	return nil
+}
+
+// Bury moves a message that can no longer be delivered to the dead-letter
+// directory, where it is kept for manual inspection. A message whose data file
+// has gone missing is buried with its metadata only.
+func (s *Spool) Bury(msg *Message) error {
+	if err := s.Update(msg); err != nil {
+		return err
+	}
+	if err := os.Rename(s.path(queueDir, msg.ID, dataExt), s.path(deadDir, msg.ID, dataExt)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to move message data to dead-letter directory: %w", err)
+	}
+	if err := os.Rename(s.path(queueDir, msg.ID, metaExt), s.path(deadDir, msg.ID, metaExt)); err != nil {
+		return fmt.Errorf("failed to move message metadata to dead-letter directory: %w", err)
+	}
+	return nil
+}
+
+// recover removes temporary files and finishes or discards queue entries that
+// were interrupted half-way by a crash.
+func (s *Spool) recover() error {
+	tmpEntries, err := os.ReadDir(filepath.Join(s.dir, tmpDir))
+	if err != nil {
+		return err
+	}
+	for _, e := range tmpEntries {
+		os.Remove(filepath.Join(s.dir, tmpDir, e.Name()))
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, queueDir))
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		present[e.Name()] = true
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		id := strings.TrimSuffix(name, filepath.Ext(name))
+		switch filepath.Ext(name) {
+		case dataExt:
+			// Data without metadata was never acknowledged to the client.
+			if !present[id+metaExt] {
+				s.log.Warn("removing incomplete spool entry", "id", id)
+				os.Remove(filepath.Join(s.dir, queueDir, name))
+			}
+		case metaExt:
+			if present[id+dataExt] {
+				continue
+			}
+			// Metadata without data is left over from an interrupted Bury.
+			if _, err := os.Stat(s.path(deadDir, id, dataExt)); err == nil {
+				s.log.Warn("completing interrupted dead-letter move", "id", id)
+				os.Rename(filepath.Join(s.dir, queueDir, name), s.path(deadDir, id, metaExt))
+				continue
+			}
+			s.log.Warn("removing spool metadata without data", "id", id)
+			os.Remove(filepath.Join(s.dir, queueDir, name))
+		}
+	}
+	return nil
+}
+
+// writeAtomic writes a file through a temporary file in the spool's tmp
+// directory, syncs it, and renames it into place.
+func (s *Spool) writeAtomic(path string, write func(io.Writer) error) (int64, error) {
+	f, err := os.CreateTemp(filepath.Join(s.dir, tmpDir), "spool-")
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := f.Name()
+
+	cw := &countingWriter{w: f}
+	if err := write(cw); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+func (s *Spool) readMeta(path string) (*Message, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *Spool) path(sub, id, ext string) string {
+	return filepath.Join(s.dir, sub, id+ext)
+}
+
+// newID returns a unique, time-ordered message identifier.
+func newID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate message id: %w", err)
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
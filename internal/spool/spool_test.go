@@ -0,0 +1,120 @@
+package spool
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSpool(t *testing.T) (*Spool, string) {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), dir)
+	require.NoError(t, err)
+	return s, dir
+}
+
+func TestSpool_EnqueueAndPending(t *testing.T) {
+	s, _ := newTestSpool(t)
+
+	msg := &Message{From: "sender@example.com", To: []string{"rcpt@example.com"}, ClientIP: "127.0.0.1"}
+	require.NoError(t, s.Enqueue(msg, strings.NewReader("Subject: test\r\n\r\nbody")))
+
+	assert.NotEmpty(t, msg.ID)
+	assert.Equal(t, int64(len("Subject: test\r\n\r\nbody")), msg.Size)
+
+	// Enqueue must signal the ready channel.
+	select {
+	case <-s.Ready():
+	default:
+		t.Error("expected Enqueue to signal readiness")
+	}
+
+	pending, err := s.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, msg.ID, pending[0].ID)
+	assert.Equal(t, msg.To, pending[0].To)
+
+	f, err := s.Open(pending[0])
+	require.NoError(t, err)
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: test\r\n\r\nbody", string(data))
+}
+
+func TestSpool_PendingOrder(t *testing.T) {
+	s, _ := newTestSpool(t)
+	now := time.Now()
+
+	later := &Message{NextAttempt: now.Add(time.Hour)}
+	sooner := &Message{NextAttempt: now.Add(-time.Hour)}
+	require.NoError(t, s.Enqueue(later, strings.NewReader("a")))
+	require.NoError(t, s.Enqueue(sooner, strings.NewReader("b")))
+
+	pending, err := s.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, sooner.ID, pending[0].ID)
+	assert.Equal(t, later.ID, pending[1].ID)
+}
+
+func TestSpool_UpdateRemoveBury(t *testing.T) {
+	s, dir := newTestSpool(t)
+
+	delivered := &Message{}
+	failed := &Message{}
+	require.NoError(t, s.Enqueue(delivered, strings.NewReader("a")))
+	require.NoError(t, s.Enqueue(failed, strings.NewReader("b")))
+
+	failed.Attempts = 3
+	failed.LastError = "boom"
+	require.NoError(t, s.Update(failed))
+
+	require.NoError(t, s.Remove(delivered))
+	require.NoError(t, s.Bury(failed))
+
+	pending, err := s.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	_, err = os.Stat(filepath.Join(dir, deadDir, failed.ID+dataExt))
+	assert.NoError(t, err, "buried message data should be in the dead-letter directory")
+	meta, err := s.readMeta(filepath.Join(dir, deadDir, failed.ID+metaExt))
+	require.NoError(t, err)
+	assert.Equal(t, 3, meta.Attempts)
+	assert.Equal(t, "boom", meta.LastError)
+}
+
+func TestSpool_SurvivesRestart(t *testing.T) {
+	s, dir := newTestSpool(t)
+
+	msg := &Message{To: []string{"rcpt@example.com"}}
+	require.NoError(t, s.Enqueue(msg, strings.NewReader("data")))
+
+	// Leave behind the debris of a crash: a temporary file and data without metadata.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, tmpDir, "spool-123"), []byte("x"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, queueDir, "orphan"+dataExt), []byte("x"), 0600))
+
+	reopened, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), dir)
+	require.NoError(t, err)
+
+	pending, err := reopened.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, msg.ID, pending[0].ID)
+
+	_, err = os.Stat(filepath.Join(dir, queueDir, "orphan"+dataExt))
+	assert.True(t, os.IsNotExist(err), "incomplete entry should have been removed")
+	tmpEntries, err := os.ReadDir(filepath.Join(dir, tmpDir))
+	require.NoError(t, err)
+	assert.Empty(t, tmpEntries)
+}
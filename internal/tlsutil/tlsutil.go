@@ -0,0 +1,169 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethanpil/smog/internal/config"
+)
+
+// versions maps the TLSMinVersion config values to TLS protocol versions.
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewConfig builds the server TLS configuration from the application config.
+// It returns nil if no certificate is configured, in which case TLS is disabled.
+func NewConfig(logger *slog.Logger, cfg *config.Config) (*tls.Config, error) {
+	if cfg.TLSCertPath == "" {
+		return nil, nil
+	}
+
+	minVersion, err := ParseVersion(cfg.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := ParseCipherSuites(cfg.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := NewCertReloader(logger, cfg.TLSCertPath, cfg.TLSKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+	}, nil
+}
+
+// ParseVersion converts a version string such as "1.2" to its crypto/tls
+// constant. An empty string selects TLS 1.2.
+func ParseVersion(s string) (uint16, error) {
+	if s == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := versions[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version %q: must be one of 1.0, 1.1, 1.2, 1.3", s)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites converts cipher suite names, as listed by crypto/tls (e.g.
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"), to their IDs. Suites that crypto/tls
+// considers insecure are rejected. An empty list selects the Go defaults. The
+// list does not apply to TLS 1.3, whose suites are not configurable.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// CertReloader serves a certificate and key pair from disk and reloads it
+// when either file changes, so that certificates can be renewed without
+// restarting the server.
+type CertReloader struct {
+	log      *slog.Logger
+	certPath string
+	keyPath  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewCertReloader loads the certificate and key pair. It fails if the initial
+// load fails.
+func NewCertReloader(logger *slog.Logger, certPath, keyPath string) (*CertReloader, error) {
+	r := &CertReloader{
+		log:      logger,
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(certMod, keyMod); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the
+// files have been modified. If the reload fails the previous certificate
+// keeps being served. It is suitable for tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		r.log.Warn("could not check TLS certificate for changes, using the loaded one", "error", err)
+		return r.cert, nil
+	}
+	if certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return r.cert, nil
+	}
+
+	if err := r.load(certMod, keyMod); err != nil {
+		// A renewal tool may have written only one of the two files so far.
+		r.log.Warn("could not reload TLS certificate, using the loaded one", "error", err)
+		return r.cert, nil
+	}
+	r.log.Info("reloaded TLS certificate", "cert", r.certPath, "key", r.keyPath)
+	return r.cert, nil
+}
+
+// load reads the key pair and records the modification times it was read at.
+func (r *CertReloader) load(certMod, keyMod time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.cert = &cert
+	r.certMod = certMod
+	r.keyMod = keyMod
+	return nil
+}
+
+func (r *CertReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	info, err := os.Stat(r.certPath)
+	if err != nil {
+		return certMod, keyMod, fmt.Errorf("failed to stat TLS certificate: %w", err)
+	}
+	certMod = info.ModTime()
+	info, err = os.Stat(r.keyPath)
+	if err != nil {
+		return certMod, keyMod, fmt.Errorf("failed to stat TLS key: %w", err)
+	}
+	return certMod, info.ModTime(), nil
+}
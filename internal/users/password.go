@@ -0,0 +1,153 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported password hash algorithms.
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// Parameters for new argon2id hashes, following the recommendations of
+// RFC 9106 for memory-constrained environments.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// Limits for the parameters of stored argon2id hashes. The minimum salt and
+// key lengths are those of RFC 9106; the memory limit keeps a hash edited
+// into the users file from exhausting the memory of the server.
+const (
+	argon2MinSaltLen = 8
+	argon2MinKeyLen  = 4
+	argon2MaxMemory  = 4 * 1024 * 1024 // KiB
+)
+
+// ErrUnknownHash is returned when a stored hash is in an unsupported format.
+var ErrUnknownHash = errors.New("unsupported password hash format")
+
+// HashPassword hashes a password with the given algorithm. Bcrypt hashes use
+// the usual $2a$ format, argon2id hashes the PHC string format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash).
+func HashPassword(password, algorithm string) (string, error) {
+	switch algorithm {
+	case HashBcrypt, "":
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %w", err)
+		}
+		return string(hash), nil
+	case HashArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", fmt.Errorf("failed to generate salt: %w", err)
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("unknown hash algorithm %q: must be %q or %q", algorithm, HashBcrypt, HashArgon2id)
+	}
+}
+
+// VerifyPassword reports whether password matches the stored hash.
+func VerifyPassword(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("invalid bcrypt hash: %w", err)
+		}
+		return true, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+// ValidateHash checks that hash is a bcrypt or argon2id hash that
+// VerifyPassword can check passwords against.
+func ValidateHash(hash string) error {
+	switch {
+	case hash == "":
+		return errors.New("no password hash")
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("%w: invalid bcrypt hash: %v", ErrUnknownHash, err)
+		}
+		return nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, err := parseArgon2id(hash)
+		return err
+	default:
+		return ErrUnknownHash
+	}
+}
+
+// argon2idHash is a parsed argon2id hash.
+type argon2idHash struct {
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+// parseArgon2id parses an argon2id hash in the PHC string format and checks
+// that its parameters are ones argon2.IDKey can be called with.
+func parseArgon2id(hash string) (*argon2idHash, error) {
+	// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("%w: malformed argon2id hash", ErrUnknownHash)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("%w: unsupported argon2 version %q", ErrUnknownHash, parts[2])
+	}
+	h := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("%w: malformed argon2id parameters: %v", ErrUnknownHash, err)
+	}
+	if h.time == 0 || h.threads == 0 || h.memory == 0 || h.memory > argon2MaxMemory {
+		return nil, fmt.Errorf("%w: argon2id parameters out of range: %s", ErrUnknownHash, parts[3])
+	}
+	var err error
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(h.salt) < argon2MinSaltLen {
+		return nil, fmt.Errorf("%w: malformed argon2id salt", ErrUnknownHash)
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(h.key) < argon2MinKeyLen {
+		return nil, fmt.Errorf("%w: malformed argon2id key", ErrUnknownHash)
+	}
+	return h, nil
+}
+
+func verifyArgon2id(hash, password string) (bool, error) {
+	h, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	got := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(got, h.key) == 1, nil
+}
@@ -0,0 +1,87 @@
+package users
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashAndVerifyPassword(t *testing.T) {
+	for _, algorithm := range []string{HashBcrypt, HashArgon2id} {
+		t.Run(algorithm, func(t *testing.T) {
+			hash, err := HashPassword("correct horse", algorithm)
+			require.NoError(t, err)
+			assert.NotContains(t, hash, "correct horse")
+			assert.NoError(t, ValidateHash(hash))
+
+			ok, err := VerifyPassword(hash, "correct horse")
+			require.NoError(t, err)
+			assert.True(t, ok)
+
+			ok, err = VerifyPassword(hash, "wrong horse")
+			require.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+
+	// Every hash has its own salt.
+	a, err := HashPassword("same", HashArgon2id)
+	require.NoError(t, err)
+	b, err := HashPassword("same", HashArgon2id)
+	require.NoError(t, err)
+	assert.NotEqual(t, a, b)
+	assert.True(t, strings.HasPrefix(a, "$argon2id$v=19$m=65536,t=3,p=4$"))
+
+	_, err = HashPassword("pw", "md5")
+	assert.Error(t, err)
+}
+
+func TestVerifyPassword_KnownHashes(t *testing.T) {
+	// Hashes produced by other tools must be accepted.
+	testCases := []struct {
+		name string
+		hash string
+	}{
+		// Reference vector of the argon2 command line tool:
+		// echo -n password | argon2 somesalt -id -t 2 -m 16 -p 1
+		{"argon2id", "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, ValidateHash(tc.hash))
+			ok, err := VerifyPassword(tc.hash, "password")
+			require.NoError(t, err)
+			assert.True(t, ok)
+		})
+	}
+
+	// htpasswd writes bcrypt hashes with the $2y$ prefix, which only differs
+	// from $2a$ in name.
+	hash, err := HashPassword("password", HashBcrypt)
+	require.NoError(t, err)
+	ok, err := VerifyPassword("$2y$"+strings.TrimPrefix(hash, "$2a$"), "password")
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestVerifyPassword_Malformed(t *testing.T) {
+	for _, hash := range []string{
+		"plaintext",
+		"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"$argon2id$v=19$m=65536,t=3,p=4$onlysalt",
+		"$argon2id$v=16$m=65536,t=3,p=4$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=x,t=3,p=4$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=0,p=4$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=3,p=0$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=0,t=3,p=4$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=4294967295,t=3,p=4$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+	} {
+		assert.ErrorIs(t, ValidateHash(hash), ErrUnknownHash, hash)
+		ok, err := VerifyPassword(hash, "password")
+		assert.False(t, ok, hash)
+		assert.ErrorIs(t, err, ErrUnknownHash, hash)
+	}
+}
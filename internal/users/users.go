@@ -0,0 +1,292 @@
+package users
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/ethanpil/smog/internal/policy"
+	"github.com/pelletier/go-toml/v2"
+)
+
+var (
+	// ErrInvalidCredentials is returned by Authenticate for an unknown user or
+	// a wrong password.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrUserExists is returned by Add for a name that is already taken.
+	ErrUserExists = errors.New("user already exists")
+	// ErrUserNotFound is returned for a name that is not in the file.
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// fileHeader is written at the top of the users file.
+const fileHeader = "# smog SMTP users. Manage this file with the \"smog user\" commands.\n\n"
+
+// User is an SMTP account.
+type User struct {
+	// Name is the username given in SMTP AUTH.
+	Name string `toml:"Name"`
+	// PasswordHash is a bcrypt or argon2id hash of the password.
+	PasswordHash string `toml:"PasswordHash"`
+	// AllowedSenders restricts the envelope senders (MAIL FROM) the user may
+	// use. Entries are addresses, "@domain" for a whole domain, or patterns
+	// with "*" and "?". Any sender is allowed if it is empty.
+	AllowedSenders []string `toml:"AllowedSenders,omitempty"`
+	// MaxRecipients limits the recipients per message. The global limit
+	// applies if it is 0.
+	MaxRecipients int `toml:"MaxRecipients,omitempty"`
+}
+
+// MaySend reports whether the user may use from as the envelope sender.
+func (u *User) MaySend(from string) bool {
+	return len(u.AllowedSenders) == 0 || policy.MatchAnyAddress(u.AllowedSenders, from)
+}
+
+// Validate checks the username, the password hash and the AllowedSenders
+// patterns.
+func (u *User) Validate() error {
+	if err := validateName(u.Name); err != nil {
+		return err
+	}
+	if err := ValidateHash(u.PasswordHash); err != nil {
+		return fmt.Errorf("user %q: %w", u.Name, err)
+	}
+	if err := policy.ValidatePatterns(u.AllowedSenders); err != nil {
+		return fmt.Errorf("user %q: %w", u.Name, err)
+	}
+	return nil
+}
+
+// file is the on-disk layout of the users file, a list of [[User]] tables.
+type file struct {
+	Users []User `toml:"User"`
+}
+
+// Store is the set of SMTP accounts kept in a users file. The file is
+// re-read when it changes on disk, so accounts edited with "smog user" take
+// effect without restarting the server.
+type Store struct {
+	log  *slog.Logger
+	path string
+
+	mu      sync.Mutex
+	users   []User
+	modTime time.Time
+}
+
+// Load reads the users file at path. A missing file is treated as empty.
+func Load(logger *slog.Logger, path string) (*Store, error) {
+	s := &Store{log: logger, path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload re-reads the file if its modification time has changed. It must be
+// called with mu held or before the store is shared.
+func (s *Store) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if !s.modTime.IsZero() {
+			// The file has been deleted since it was read.
+			s.users = nil
+			s.modTime = time.Time{}
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat users file: %w", err)
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read users file: %w", err)
+	}
+	var f file
+	if err := toml.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("failed to parse users file %s: %w", s.path, err)
+	}
+	for _, u := range f.Users {
+		if err := u.Validate(); err != nil {
+			return fmt.Errorf("invalid user in %s: %w", s.path, err)
+		}
+	}
+
+	s.users = f.Users
+	s.modTime = info.ModTime()
+	s.log.Debug("loaded users file", "path", s.path, "users", len(s.users))
+	return nil
+}
+
+// Authenticate checks a username and password and returns the matching user.
+func (s *Store) Authenticate(name, password string) (*User, error) {
+	s.mu.Lock()
+	if err := s.reload(); err != nil {
+		// Keep serving the accounts that were loaded last.
+		s.log.Error("could not reload users file", "path", s.path, "error", err)
+	}
+	u, ok := s.find(name)
+	s.mu.Unlock()
+
+	if !ok {
+		// Spend the time of a password check anyway, so that valid usernames
+		// cannot be told apart by the response time.
+		VerifyPassword(dummyHash(), password)
+		return nil, ErrInvalidCredentials
+	}
+
+	match, err := VerifyPassword(u.PasswordHash, password)
+	if err != nil {
+		s.log.Error("could not verify password", "username", name, "error", err)
+		return nil, ErrInvalidCredentials
+	}
+	if !match {
+		return nil, ErrInvalidCredentials
+	}
+	return &u, nil
+}
+
+// dummyHash returns a bcrypt hash used to equalize the timing of failed logins.
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("smog-dummy-password", HashBcrypt)
+	return hash
+})
+
+// Get returns the user with the given name.
+func (s *Store) Get(name string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.find(name)
+}
+
+// List returns all users sorted by name.
+func (s *Store) List() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := append([]User(nil), s.users...)
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Add adds a new user. Call Save to write the change to disk.
+func (s *Store) Add(u User) error {
+	if err := u.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.find(u.Name); ok {
+		return fmt.Errorf("%w: %s", ErrUserExists, u.Name)
+	}
+	s.users = append(s.users, u)
+	return nil
+}
+
+// Update replaces an existing user. Call Save to write the change to disk.
+func (s *Store) Update(u User) error {
+	if err := u.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.users {
+		if s.users[i].Name == u.Name {
+			s.users[i] = u
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUserNotFound, u.Name)
+}
+
+// Remove deletes a user. Call Save to write the change to disk.
+func (s *Store) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.users {
+		if s.users[i].Name == name {
+			s.users = append(s.users[:i], s.users[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUserNotFound, name)
+}
+
+// Save atomically writes the users to the file, readable by its owner only.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf bytes.Buffer
+	buf.WriteString(fileHeader)
+	if err := toml.NewEncoder(&buf).Encode(file{Users: s.users}); err != nil {
+		return fmt.Errorf("failed to encode users file: %w", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create users file directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary users file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op after a successful rename.
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set users file permissions: %w", err)
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write users file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync users file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close users file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace users file: %w", err)
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	s.log.Info("saved users file", "path", s.path, "users", len(s.users))
+	return nil
+}
+
+func (s *Store) find(name string) (User, bool) {
+	for _, u := range s.users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// validateName checks that a username can be typed into a mail client.
+func validateName(name string) error {
+	if name == "" {
+		return errors.New("username must not be empty")
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return fmt.Errorf("username %q must not contain spaces or control characters", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package users
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func mustHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := HashPassword(password, HashBcrypt)
+	require.NoError(t, err)
+	return hash
+}
+
+func TestStore_SaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.toml")
+
+	store, err := Load(discardLogger(), path)
+	require.NoError(t, err, "a missing users file is not an error")
+	assert.Empty(t, store.List())
+
+	require.NoError(t, store.Add(User{Name: "scanner", PasswordHash: mustHash(t, "s3cret"), AllowedSenders: []string{"scanner@example.com"}}))
+	require.NoError(t, store.Add(User{Name: "app", PasswordHash: mustHash(t, "hunter2"), MaxRecipients: 5}))
+	assert.ErrorIs(t, store.Add(User{Name: "app", PasswordHash: mustHash(t, "other")}), ErrUserExists)
+	assert.Error(t, store.Add(User{Name: "with space", PasswordHash: mustHash(t, "other")}))
+	require.NoError(t, store.Save())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	reloaded, err := Load(discardLogger(), path)
+	require.NoError(t, err)
+	list := reloaded.List()
+	require.Len(t, list, 2)
+	assert.Equal(t, "app", list[0].Name)
+	assert.Equal(t, 5, list[0].MaxRecipients)
+	assert.Equal(t, []string{"scanner@example.com"}, list[1].AllowedSenders)
+
+	require.NoError(t, reloaded.Remove("app"))
+	assert.ErrorIs(t, reloaded.Remove("app"), ErrUserNotFound)
+	assert.ErrorIs(t, reloaded.Update(User{Name: "app", PasswordHash: mustHash(t, "other")}), ErrUserNotFound)
+}
+
+func TestStore_Authenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.toml")
+	store, err := Load(discardLogger(), path)
+	require.NoError(t, err)
+	require.NoError(t, store.Add(User{Name: "app", PasswordHash: mustHash(t, "hunter2")}))
+	require.NoError(t, store.Save())
+
+	user, err := store.Authenticate("app", "hunter2")
+	require.NoError(t, err)
+	assert.Equal(t, "app", user.Name)
+
+	_, err = store.Authenticate("app", "wrong")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = store.Authenticate("nobody", "hunter2")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestStore_ReloadsChangedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.toml")
+	server, err := Load(discardLogger(), path)
+	require.NoError(t, err)
+
+	// Another process, e.g. "smog user add", edits the file.
+	cli, err := Load(discardLogger(), path)
+	require.NoError(t, err)
+	require.NoError(t, cli.Add(User{Name: "late", PasswordHash: mustHash(t, "pw")}))
+	require.NoError(t, cli.Save())
+	// Make sure the change is visible even on file systems with coarse timestamps.
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	_, err = server.Authenticate("late", "pw")
+	assert.NoError(t, err)
+
+	// A broken file keeps the last good accounts in service.
+	require.NoError(t, os.WriteFile(path, []byte("[[User]\nbroken"), 0600))
+	evenLater := later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, evenLater, evenLater))
+	_, err = server.Authenticate("late", "pw")
+	assert.NoError(t, err)
+
+	_, err = Load(discardLogger(), path)
+	assert.Error(t, err, "loading a broken file at startup must fail")
+}
+
+func TestStore_RejectsInvalidSenderPattern(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.toml")
+	store, err := Load(discardLogger(), path)
+	require.NoError(t, err)
+	hash := mustHash(t, "s3cret")
+
+	err = store.Add(User{Name: "scanner", PasswordHash: hash, AllowedSenders: []string{"[a-"}})
+	assert.ErrorContains(t, err, `invalid address pattern "[a-"`)
+	require.NoError(t, store.Add(User{Name: "scanner", PasswordHash: hash, AllowedSenders: []string{"scanner-*@example.com"}}))
+	assert.Error(t, store.Update(User{Name: "scanner", PasswordHash: hash, AllowedSenders: []string{"[a-"}}))
+
+	// A file edited by hand is checked when it is loaded.
+	require.NoError(t, os.WriteFile(path, []byte("[[User]]\nName = \"scanner\"\nPasswordHash = \""+hash+"\"\nAllowedSenders = [\"[a-\"]\n"), 0600))
+	_, err = Load(discardLogger(), path)
+	assert.ErrorContains(t, err, `invalid address pattern "[a-"`)
+}
+
+func TestStore_RejectsInvalidPasswordHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.toml")
+	store, err := Load(discardLogger(), path)
+	require.NoError(t, err)
+
+	// argon2.IDKey panics on zero time or threads, so such hashes must not
+	// get as far as a login.
+	for _, hash := range []string{
+		"",
+		"plaintext",
+		"$2a$99$invalidbcrypthashinvalidbcrypthashinvalidbcrypthash12",
+		"$argon2id$v=19$m=65536,t=0,p=4$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=3,p=0$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+	} {
+		assert.Error(t, store.Add(User{Name: "app", PasswordHash: hash}), hash)
+	}
+	require.NoError(t, store.Add(User{Name: "app", PasswordHash: mustHash(t, "hunter2")}))
+	assert.Error(t, store.Update(User{Name: "app", PasswordHash: "plaintext"}))
+
+	// A file edited by hand is checked when it is loaded.
+	content := "[[User]]\nName = \"app\"\nPasswordHash = \"$argon2id$v=19$m=65536,t=0,p=4$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc\"\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	_, err = Load(discardLogger(), path)
+	assert.ErrorContains(t, err, "argon2id parameters out of range")
+}
+
+func TestUser_MaySend(t *testing.T) {
+	anyone := User{Name: "anyone"}
+	assert.True(t, anyone.MaySend("whoever@example.org"))
+
+	restricted := User{Name: "printer", AllowedSenders: []string{"Printer@Example.com", "@alerts.example.com"}}
+	assert.True(t, restricted.MaySend("printer@example.com"))
+	assert.True(t, restricted.MaySend("ups@alerts.example.com"))
+	assert.False(t, restricted.MaySend("ceo@example.com"))
+	assert.False(t, restricted.MaySend("x@evilalerts.example.com"))
+	assert.False(t, restricted.MaySend(""))
+}